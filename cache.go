@@ -0,0 +1,365 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// artifactRefPrefix prefixes the digest of an artifact of the cache
+	// given in place of a path, as in --kernel=sha256:HEX
+	artifactRefPrefix = "sha256:"
+	// artifactBlobsDir is the directory of the cache holding the artifacts,
+	// named after their digest
+	artifactBlobsDir = "blobs/sha256"
+	// artifactTempPrefix prefixes the artifacts being added to the cache
+	artifactTempPrefix = ".tmp-"
+)
+
+// artifactAddOptions are the options of the artifact add command
+type artifactAddOptions struct {
+	Args struct {
+		Files []string `positional-arg-name:"file" required:"1"`
+	} `positional-args:"yes"`
+}
+
+// artifactGCOptions are the options of the artifact gc command
+type artifactGCOptions struct {
+	OlderThan time.Duration `long:"older-than" description:"Remove the artifacts not used for the given duration" default:"720h"`
+}
+
+// artifactCache is a local store of kernels, initrds, drives and binaries,
+// addressed by their SHA-256 digest
+type artifactCache struct {
+	dir string
+}
+
+// cachedArtifact is an artifact of the cache
+type cachedArtifact struct {
+	digest string
+	path   string
+	size   int64
+	// lastUsed is when the artifact was last added or used, kept as the
+	// modification time of the file
+	lastUsed time.Time
+}
+
+// artifactCache returns the cache in the directory given with --cache-dir,
+// $XDG_CACHE_HOME/firectl or ~/.cache/firectl
+func (opts *options) artifactCache() (*artifactCache, error) {
+	if opts.CacheDir != "" {
+		return &artifactCache{dir: opts.CacheDir}, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return &artifactCache{dir: filepath.Join(dir, "firectl")}, nil
+}
+
+func (c *artifactCache) blobs() string {
+	return filepath.Join(c.dir, filepath.FromSlash(artifactBlobsDir))
+}
+
+// add copies the file at path into the cache, as a reflink when the
+// filesystem supports it, and returns its digest.
+func (c *artifactCache) add(path string) (string, error) {
+	if err := os.MkdirAll(c.blobs(), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(c.blobs(), artifactTempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// the copy is hashed rather than the original, which may change
+	method, err := cloneFile(path, tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	digest, err := fileSHA256(tmp.Name())
+	if err != nil {
+		return "", err
+	}
+
+	blob := filepath.Join(c.blobs(), digest)
+	if _, err := c.verify(digest); err == nil {
+		return digest, touch(blob)
+	}
+	// artifacts are shared by every microVM using them, so they are made
+	// read-only
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), blob); err != nil {
+		return "", err
+	}
+	log.Debugf("Added %s to the cache as %s with a %s", path, blob, method)
+	return digest, nil
+}
+
+// verify returns the path of the artifact with the given digest once its
+// content was checked to match the digest
+func (c *artifactCache) verify(digest string) (string, error) {
+	blob := filepath.Join(c.blobs(), digest)
+	if err := checkOwnedFile(blob); err != nil {
+		return "", err
+	}
+	actual, err := fileSHA256(blob)
+	if err != nil {
+		return "", err
+	}
+	if actual != digest {
+		return "", fmt.Errorf("%w: %s has digest %s", errUntrustedCachedFile, blob, actual)
+	}
+	return blob, nil
+}
+
+// resolve returns the path of the artifact referred to by ref, of the form
+// sha256:HEX where HEX is the digest of the artifact or a unique prefix of
+// it, and marks it as used. The artifact is verified, so that a blob
+// tampered with in the cache is not used under the digest it was given by.
+func (c *artifactCache) resolve(ref string) (string, error) {
+	prefix := strings.ToLower(strings.TrimPrefix(ref, artifactRefPrefix))
+	if prefix == "" || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return "", errInvalidArtifactRef
+	}
+	artifacts, err := c.list()
+	if err != nil {
+		return "", err
+	}
+	var matches []cachedArtifact
+	for _, a := range artifacts {
+		if strings.HasPrefix(a.digest, prefix) {
+			matches = append(matches, a)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%w in %s", errArtifactNotFound, c.dir)
+	case 1:
+		blob, err := c.verify(matches[0].digest)
+		if err != nil {
+			return "", err
+		}
+		if err := touch(blob); err != nil {
+			log.Debugf("Failed to mark %s as used: %v", blob, err)
+		}
+		return blob, nil
+	}
+	return "", fmt.Errorf("%w: %d artifacts match", errAmbiguousArtifactRef, len(matches))
+}
+
+// list returns the artifacts of the cache, sorted by digest
+func (c *artifactCache) list() ([]cachedArtifact, error) {
+	entries, err := os.ReadDir(c.blobs())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var artifacts []cachedArtifact
+	for _, entry := range entries {
+		// artifacts being added and clones of cached root drives made by
+		// --root-drive-cow are not named after a digest
+		if checkDigest(entry.Name()) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, cachedArtifact{
+			digest:   entry.Name(),
+			path:     filepath.Join(c.blobs(), entry.Name()),
+			size:     info.Size(),
+			lastUsed: info.ModTime(),
+		})
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].digest < artifacts[j].digest
+	})
+	return artifacts, nil
+}
+
+// gc removes the artifacts last used before the given time, and the
+// leftovers of artifacts which failed to be added. It returns the artifacts
+// removed.
+func (c *artifactCache) gc(before time.Time) ([]cachedArtifact, error) {
+	temps, err := filepath.Glob(filepath.Join(c.blobs(), artifactTempPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range temps {
+		if info, err := os.Stat(tmp); err == nil && info.ModTime().Before(before) {
+			os.Remove(tmp)
+		}
+	}
+
+	artifacts, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	var removed []cachedArtifact
+	for _, a := range artifacts {
+		if !a.lastUsed.Before(before) {
+			continue
+		}
+		if err := os.Remove(a.path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, a)
+	}
+	return removed, nil
+}
+
+// checkOwnedFile returns an error unless path is a regular file which only
+// the current user can write, in a directory only they can write, so that
+// another user cannot have planted or replaced it.
+func checkOwnedFile(path string) error {
+	for i, p := range []string{path, filepath.Dir(path)} {
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		if i == 0 && !info.Mode().IsRegular() {
+			return fmt.Errorf("%w: %s is not a regular file", errUntrustedCachedFile, p)
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+			return fmt.Errorf("%w: %s is owned by uid %d", errUntrustedCachedFile, p, st.Uid)
+		}
+		if info.Mode().Perm()&0022 != 0 {
+			return fmt.Errorf("%w: %s is writable by other users", errUntrustedCachedFile, p)
+		}
+	}
+	return nil
+}
+
+// touch marks the file at path as used
+func touch(path string) error {
+	now := time.Now()
+	return os.Chtimes(path, now, now)
+}
+
+// isArtifactRef reports whether path refers to an artifact of the cache
+func isArtifactRef(path string) bool {
+	return strings.HasPrefix(path, artifactRefPrefix)
+}
+
+// resolveArtifacts replaces the references to artifacts of the cache given
+// in place of the kernel, initrd and drive paths with their path in the
+// cache. Drives of the cache are shared, so they can only be attached
+// read-only, or as a copy-on-write root drive.
+func (opts *options) resolveArtifacts() error {
+	var cache *artifactCache
+	resolve := func(field, value, ref string) (string, error) {
+		if cache == nil {
+			var err error
+			if cache, err = opts.artifactCache(); err != nil {
+				return "", newConfigError(field, value, err)
+			}
+		}
+		path, err := cache.resolve(ref)
+		if err != nil {
+			return "", newConfigError(field, value, err)
+		}
+		log.Debugf("Resolved %s to %s", ref, path)
+		return path, nil
+	}
+
+	var err error
+	if isArtifactRef(opts.FcKernelImage) {
+		if opts.FcKernelImage, err = resolve("kernel", opts.FcKernelImage, opts.FcKernelImage); err != nil {
+			return err
+		}
+	}
+	if isArtifactRef(opts.FcInitrd) {
+		if opts.FcInitrd, err = resolve("initrd-path", opts.FcInitrd, opts.FcInitrd); err != nil {
+			return err
+		}
+	}
+	if ref, readOnly := parseDevice(opts.FcRootDrivePath); isArtifactRef(ref) {
+		if !readOnly && !opts.RootDriveCOW {
+			return newConfigError("root-drive", opts.FcRootDrivePath, errCachedArtifactReadWrite)
+		}
+		path, err := resolve("root-drive", opts.FcRootDrivePath, ref)
+		if err != nil {
+			return err
+		}
+		opts.FcRootDrivePath = path + strings.TrimPrefix(opts.FcRootDrivePath, ref)
+	}
+	for i, entry := range opts.FcAdditionalDrives {
+		ref, readOnly, _, err := parseDriveEntry(entry)
+		if err != nil || !isArtifactRef(ref) {
+			// invalid entries are reported by the preflight checks
+			continue
+		}
+		if !readOnly {
+			return newConfigError("add-drive", entry, errCachedArtifactReadWrite)
+		}
+		path, err := resolve("add-drive", entry, ref)
+		if err != nil {
+			return err
+		}
+		opts.FcAdditionalDrives[i] = path + strings.TrimPrefix(entry, ref)
+	}
+	return nil
+}
+
+// runArtifactCommand runs the artifact subcommand name, writing its output
+// to w
+func (opts *options) runArtifactCommand(w io.Writer, name string, add *artifactAddOptions, gc *artifactGCOptions) error {
+	cache, err := opts.artifactCache()
+	if err != nil {
+		return err
+	}
+
+	switch name {
+	case "add":
+		for _, path := range add.Args.Files {
+			digest, err := cache.add(path)
+			if err != nil {
+				return fmt.Errorf("failed to add %s to the cache: %w", path, err)
+			}
+			fmt.Fprintf(w, "%s%s  %s\n", artifactRefPrefix, digest, path)
+		}
+	case "ls":
+		artifacts, err := cache.list()
+		if err != nil {
+			return err
+		}
+		for _, a := range artifacts {
+			fmt.Fprintf(w, "%s%s  %10d  %s\n", artifactRefPrefix, a.digest, a.size, a.lastUsed.Format(time.RFC3339))
+		}
+	case "gc":
+		removed, err := cache.gc(time.Now().Add(-gc.OlderThan))
+		for _, a := range removed {
+			fmt.Fprintf(w, "removed %s%s\n", artifactRefPrefix, a.digest)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArtifactCache(t *testing.T) {
+	dir := t.TempDir()
+	cache := &artifactCache{dir: filepath.Join(dir, "cache")}
+	kernel := filepath.Join(dir, "vmlinux")
+	if err := os.WriteFile(kernel, []byte("vmlinux"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := cache.add(kernel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := sha256Hex([]byte("vmlinux")); digest != expected {
+		t.Fatalf("expected digest %s but got %s", expected, digest)
+	}
+	// adding the same content again is a no-op
+	if again, err := cache.add(kernel); err != nil || again != digest {
+		t.Fatalf("expected %s but got %s, %v", digest, again, err)
+	}
+
+	cases := []struct {
+		ref    string
+		outErr error
+	}{
+		{ref: "sha256:" + digest},
+		{ref: "sha256:" + strings.ToUpper(digest[:12])},
+		{ref: "sha256:" + strings.Repeat("0", 64), outErr: errArtifactNotFound},
+		{ref: "sha256:", outErr: errInvalidArtifactRef},
+		{ref: "sha256:xyz", outErr: errInvalidArtifactRef},
+	}
+	for _, c := range cases {
+		t.Run(c.ref, func(t *testing.T) {
+			path, err := cache.resolve(c.ref)
+			if !errors.Is(err, c.outErr) {
+				t.Fatalf("expected %v but got %v", c.outErr, err)
+			}
+			if c.outErr == nil && path != filepath.Join(cache.blobs(), digest) {
+				t.Errorf("expected the path of %s but got %s", digest, path)
+			}
+		})
+	}
+
+	artifacts, err := cache.list()
+	if err != nil || len(artifacts) != 1 || artifacts[0].size != int64(len("vmlinux")) {
+		t.Fatalf("expected one artifact but got %+v, %v", artifacts, err)
+	}
+	if info, err := os.Stat(artifacts[0].path); err != nil || info.Mode().Perm() != 0444 {
+		t.Errorf("expected the artifact to be read-only but got %v, %v", info.Mode(), err)
+	}
+
+	// a blob tampered with in the cache is refused
+	blob := artifacts[0].path
+	if err := os.Chmod(blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, []byte("tampered"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.resolve("sha256:" + digest); !errors.Is(err, errUntrustedCachedFile) {
+		t.Errorf("expected %v but got %v", errUntrustedCachedFile, err)
+	}
+
+	if removed, err := cache.gc(time.Now().Add(-time.Hour)); err != nil || len(removed) != 0 {
+		t.Errorf("expected a recently used artifact to be kept but got %+v, %v", removed, err)
+	}
+	if removed, err := cache.gc(time.Now().Add(time.Hour)); err != nil || len(removed) != 1 {
+		t.Errorf("expected the artifact to be removed but got %+v, %v", removed, err)
+	}
+	if artifacts, _ := cache.list(); len(artifacts) != 0 {
+		t.Errorf("expected an empty cache but got %+v", artifacts)
+	}
+}
+
+func TestResolveArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "rootfs.ext4")
+	if err := os.WriteFile(root, []byte("rootfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{CacheDir: filepath.Join(dir, "cache")}
+	var out bytes.Buffer
+	add := &artifactAddOptions{}
+	add.Args.Files = []string{root}
+	if err := opts.runArtifactCommand(&out, "add", add, nil); err != nil {
+		t.Fatal(err)
+	}
+	ref := strings.Fields(out.String())[0]
+	blob := filepath.Join(dir, "cache", artifactBlobsDir, strings.TrimPrefix(ref, artifactRefPrefix))
+
+	cases := []struct {
+		name   string
+		opts   options
+		out    options
+		outErr error
+	}{
+		{
+			name: "read-only drives",
+			opts: options{FcRootDrivePath: ref + roDeviceSuffix, FcAdditionalDrives: []string{ref + roDeviceSuffix + digestAttribute + sha256Hex([]byte("rootfs"))}},
+			out:  options{FcRootDrivePath: blob + roDeviceSuffix, FcAdditionalDrives: []string{blob + roDeviceSuffix + digestAttribute + sha256Hex([]byte("rootfs"))}},
+		},
+		{
+			name: "copy-on-write root drive",
+			opts: options{FcRootDrivePath: ref, RootDriveCOW: true},
+			out:  options{FcRootDrivePath: blob, RootDriveCOW: true},
+		},
+		{
+			name: "kernel and initrd paths",
+			opts: options{FcKernelImage: ref, FcInitrd: ref[:20]},
+			out:  options{FcKernelImage: blob, FcInitrd: blob},
+		},
+		{
+			name:   "read-write root drive",
+			opts:   options{FcRootDrivePath: ref},
+			outErr: errCachedArtifactReadWrite,
+		},
+		{
+			name:   "read-write drive",
+			opts:   options{FcAdditionalDrives: []string{ref + rwDeviceSuffix}},
+			outErr: errCachedArtifactReadWrite,
+		},
+		{
+			name:   "missing kernel",
+			opts:   options{FcKernelImage: "sha256:" + strings.Repeat("0", 64)},
+			outErr: errArtifactNotFound,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			opts.CacheDir = filepath.Join(dir, "cache")
+			err := opts.resolveArtifacts()
+			if !errors.Is(err, c.outErr) {
+				t.Fatalf("expected %v but got %v", c.outErr, err)
+			}
+			if c.outErr != nil {
+				if code := exitCode(err, false); code != exitConfigError {
+					t.Errorf("expected exit code %d but got %d", exitConfigError, code)
+				}
+				return
+			}
+			if opts.FcKernelImage != c.out.FcKernelImage || opts.FcInitrd != c.out.FcInitrd || opts.FcRootDrivePath != c.out.FcRootDrivePath {
+				t.Errorf("expected %+v but got %+v", c.out, opts)
+			}
+			if strings.Join(opts.FcAdditionalDrives, ",") != strings.Join(c.out.FcAdditionalDrives, ",") {
+				t.Errorf("expected drives %v but got %v", c.out.FcAdditionalDrives, opts.FcAdditionalDrives)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// consoleAction is an action requested through a console escape sequence.
+type consoleAction int
+
+const (
+	// consoleDetach stops forwarding input and restores the terminal, the VM
+	// keeps running.
+	consoleDetach consoleAction = iota
+	// consoleShutdown requests a clean shutdown of the VM.
+	consoleShutdown
+	// consoleStop forcefully stops the VMM.
+	consoleStop
+)
+
+// keys which may follow the escape character
+const (
+	escapeKeyDetach   = 'd'
+	escapeKeyShutdown = 'q'
+	escapeKeyStop     = 'k'
+	escapeKeyHelp     = '?'
+)
+
+const escapeHelp = "\r\nSupported escape sequences:\r\n" +
+	"  %[1]s d - detach, stop forwarding input to the guest\r\n" +
+	"  %[1]s q - request a clean shutdown of the VM\r\n" +
+	"  %[1]s k - force stop the VMM\r\n" +
+	"  %[1]s ? - show this help\r\n" +
+	"  %[1]s %[1]s - send the escape character to the guest\r\n"
+
+// Given a string of the form ^X or a single character, return the escape
+// character it represents
+func parseEscapeChar(s string) (byte, error) {
+	switch {
+	case len(s) == 1:
+		return s[0], nil
+	case len(s) == 2 && s[0] == '^' && s[1] >= '@' && s[1] <= '_':
+		return s[1] - '@', nil
+	case len(s) == 2 && s[0] == '^' && s[1] >= 'a' && s[1] <= 'z':
+		return s[1] - 'a' + 1, nil
+	}
+	return 0, errInvalidEscapeChar
+}
+
+// formatEscapeChar returns the ^X notation of a control character, or the
+// character itself otherwise.
+func formatEscapeChar(c byte) string {
+	if c < 0x20 {
+		return "^" + string(rune(c+'@'))
+	}
+	return string(rune(c))
+}
+
+// escapeFilter removes escape sequences from the console input and reports
+// the actions they request.
+type escapeFilter struct {
+	escape  byte
+	pending bool
+	// detached is set once the detach escape sequence was entered, the
+	// input following it is not forwarded
+	detached bool
+	actions  chan<- consoleAction
+	// help is called when the help escape sequence is entered
+	help func()
+}
+
+// filter returns the part of p which must be forwarded to the guest. Actions
+// requested by escape sequences are sent on the actions channel. The escape
+// character is only recognized when it is followed by a known key. Nothing
+// is forwarded once the console was detached.
+func (f *escapeFilter) filter(p []byte) []byte {
+	out := make([]byte, 0, len(p))
+	for _, c := range p {
+		if f.detached {
+			break
+		}
+		if !f.pending {
+			if c == f.escape {
+				f.pending = true
+				continue
+			}
+			out = append(out, c)
+			continue
+		}
+
+		f.pending = false
+		switch c {
+		case escapeKeyDetach:
+			f.detached = true
+			f.actions <- consoleDetach
+		case escapeKeyShutdown:
+			f.actions <- consoleShutdown
+		case escapeKeyStop:
+			f.actions <- consoleStop
+		case escapeKeyHelp:
+			if f.help != nil {
+				f.help()
+			}
+		case f.escape:
+			out = append(out, c)
+		default:
+			out = append(out, f.escape, c)
+		}
+	}
+	return out
+}
+
+// interactiveConsole forwards a host terminal in raw mode to the guest serial
+// console.
+type interactiveConsole struct {
+	terminal *os.File
+	// guest is the read end of the pipe given to firecracker as its stdin
+	guest *os.File
+	pipe  *os.File
+
+	filter  escapeFilter
+	actions chan consoleAction
+
+	restoreOnce sync.Once
+	restore     func() error
+}
+
+// newInteractiveConsole puts the terminal in raw mode and returns a console
+// forwarding its input. Close must be called to restore the terminal.
+func newInteractiveConsole(terminal *os.File, escape byte) (*interactiveConsole, error) {
+	restore, err := makeRaw(int(terminal.Fd()))
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		_ = restore()
+		return nil, fmt.Errorf("failed to create console pipe: %w", err)
+	}
+
+	actions := make(chan consoleAction, 1)
+	c := &interactiveConsole{
+		terminal: terminal,
+		guest:    r,
+		pipe:     w,
+		actions:  actions,
+		restore:  restore,
+	}
+	c.filter = escapeFilter{
+		escape:  escape,
+		actions: actions,
+		help: func() {
+			fmt.Fprintf(os.Stderr, escapeHelp, formatEscapeChar(escape))
+		},
+	}
+
+	go c.forward()
+
+	return c, nil
+}
+
+// forward copies the terminal input to the guest until the console is
+// detached or the terminal is closed. The input following the detach escape
+// sequence is dropped, and the terminal is not read once it was entered.
+func (c *interactiveConsole) forward() {
+	defer c.pipe.Close()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.terminal.Read(buf)
+		if n > 0 {
+			if _, werr := c.pipe.Write(c.filter.filter(buf[:n])); werr != nil {
+				return
+			}
+		}
+		if err != nil || c.filter.detached {
+			return
+		}
+	}
+}
+
+// serve handles the actions requested through escape sequences until ctx is
+// done.
+func (c *interactiveConsole) serve(ctx context.Context, m *firecracker.Machine, report *exitReport) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case action := <-c.actions:
+				switch action {
+				case consoleDetach:
+					log.Printf("Detaching from console, the VM keeps running")
+					if err := c.Close(); err != nil {
+						log.Errorf("An error occurred while restoring the terminal: %v", err)
+					}
+					return
+				case consoleShutdown:
+					log.Printf("Escape sequence received, requesting clean shutdown")
+					if err := m.Shutdown(ctx); err != nil {
+						log.Errorf("An error occurred while shutting down Firecracker VM: %v", err)
+					}
+				case consoleStop:
+					log.Printf("Escape sequence received, forcing shutdown")
+					report.setKilled("escape sequence")
+					if err := m.StopVMM(); err != nil {
+						log.Errorf("An error occurred while stopping Firecracker VMM: %v", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Close restores the terminal to the state it was in before the console was
+// created.
+func (c *interactiveConsole) Close() error {
+	var err error
+	c.restoreOnce.Do(func() {
+		err = c.restore()
+	})
+	return err
+}
+
+// makeRaw puts the terminal referred to by fd in raw mode and returns a
+// function restoring its previous state. Output processing is left enabled so
+// that messages logged by firectl are still rendered properly.
+func makeRaw(fd int) (func() error, error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, errNotATerminal
+	}
+
+	saved := *termios
+	raw := *termios
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+		unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, fmt.Errorf("failed to put terminal in raw mode: %w", err)
+	}
+
+	return func() error {
+		return unix.IoctlSetTermios(fd, unix.TCSETS, &saved)
+	}, nil
+}
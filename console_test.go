@@ -0,0 +1,206 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseEscapeChar(t *testing.T) {
+	cases := []struct {
+		name     string
+		in       string
+		outChar  byte
+		outError error
+	}{
+		{
+			name:     "default escape char",
+			in:       "^]",
+			outChar:  0x1d,
+			outError: nil,
+		},
+		{
+			name:     "lower case control char",
+			in:       "^a",
+			outChar:  0x01,
+			outError: nil,
+		},
+		{
+			name:     "single char",
+			in:       "~",
+			outChar:  '~',
+			outError: nil,
+		},
+		{
+			name:     "empty escape char",
+			in:       "",
+			outChar:  0,
+			outError: errInvalidEscapeChar,
+		},
+		{
+			name:     "too long",
+			in:       "^]x",
+			outChar:  0,
+			outError: errInvalidEscapeChar,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			escape, err := parseEscapeChar(c.in)
+			if escape != c.outChar {
+				t.Errorf("expected escape char %#x but got %#x for input %s",
+					c.outChar,
+					escape,
+					c.in)
+			}
+			if err != c.outError {
+				t.Errorf("expected error %s but got %s for input %s",
+					c.outError,
+					err,
+					c.in)
+			}
+		})
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	const escape = 0x1d
+	cases := []struct {
+		name       string
+		in         [][]byte
+		outData    []byte
+		outActions []consoleAction
+	}{
+		{
+			name:       "no escape sequence",
+			in:         [][]byte{[]byte("ls -l\r")},
+			outData:    []byte("ls -l\r"),
+			outActions: nil,
+		},
+		{
+			name:       "ctrl-c is forwarded",
+			in:         [][]byte{{0x03}},
+			outData:    []byte{0x03},
+			outActions: nil,
+		},
+		{
+			name:       "clean shutdown",
+			in:         [][]byte{{'a', escape, 'q', 'b'}},
+			outData:    []byte("ab"),
+			outActions: []consoleAction{consoleShutdown},
+		},
+		{
+			name:       "escape sequence split across reads",
+			in:         [][]byte{{escape}, {'k'}},
+			outData:    []byte{},
+			outActions: []consoleAction{consoleStop},
+		},
+		{
+			name:       "escaped escape char",
+			in:         [][]byte{{escape, escape}},
+			outData:    []byte{escape},
+			outActions: nil,
+		},
+		{
+			name:       "unknown key after escape char",
+			in:         [][]byte{{escape, 'x'}},
+			outData:    []byte{escape, 'x'},
+			outActions: nil,
+		},
+		{
+			name:       "detach",
+			in:         [][]byte{{escape, 'd'}},
+			outData:    []byte{},
+			outActions: []consoleAction{consoleDetach},
+		},
+		{
+			name:       "input after detach",
+			in:         [][]byte{{'a', escape, 'd', 'b'}, []byte("ls\r")},
+			outData:    []byte("a"),
+			outActions: []consoleAction{consoleDetach},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actions := make(chan consoleAction, 10)
+			f := escapeFilter{
+				escape:  escape,
+				actions: actions,
+			}
+
+			data := []byte{}
+			for _, p := range c.in {
+				data = append(data, f.filter(p)...)
+			}
+			close(actions)
+
+			var got []consoleAction
+			for a := range actions {
+				got = append(got, a)
+			}
+
+			if !reflect.DeepEqual(data, c.outData) {
+				t.Errorf("expected data %v but got %v", c.outData, data)
+			}
+			if !reflect.DeepEqual(got, c.outActions) {
+				t.Errorf("expected actions %v but got %v", c.outActions, got)
+			}
+		})
+	}
+}
+
+func TestInteractiveConsoleForwardDetach(t *testing.T) {
+	terminal, input, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer terminal.Close()
+	defer input.Close()
+	guest, pipe, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+
+	actions := make(chan consoleAction, 1)
+	c := &interactiveConsole{
+		terminal: terminal,
+		guest:    guest,
+		pipe:     pipe,
+		actions:  actions,
+		filter:   escapeFilter{escape: 0x1d, actions: actions},
+	}
+	if _, err := input.Write([]byte{'a', 0x1d, 'd'}); err != nil {
+		t.Fatal(err)
+	}
+	go c.forward()
+
+	// the guest pipe is closed once the console is detached, before the
+	// terminal is read again
+	data, err := io.ReadAll(guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a" {
+		t.Errorf("expected only the input before the detach to be forwarded but got %q", data)
+	}
+	if action := <-actions; action != consoleDetach {
+		t.Errorf("expected a detach action but got %v", action)
+	}
+}
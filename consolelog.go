@@ -0,0 +1,171 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// consoleLogTimeFormat is the format of the timestamps prefixed to console log
+// lines.
+const consoleLogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// consoleLog is an io.Writer capturing the guest console output to a file. It
+// optionally prefixes each line with a timestamp and rotates the file once it
+// grows beyond a maximum size. Since it is written along with the console,
+// Write never fails: the console keeps going when the log cannot be written.
+type consoleLog struct {
+	mu sync.Mutex
+
+	path string
+	file *os.File
+	size int64
+
+	// maxSize is the size in bytes after which the file is rotated, zero
+	// disables rotation
+	maxSize int64
+	// maxFiles is the number of rotated files which are kept
+	maxFiles   int
+	timestamps bool
+
+	atLineStart bool
+	now         func() time.Time
+
+	// noRotate is set once rotation failed, the output then keeps going to
+	// the current file
+	noRotate bool
+	// failed is set once the file could not be written, the output is then
+	// dropped
+	failed bool
+}
+
+// newConsoleLog opens, or creates, the console log at path. Output is
+// appended to an existing file.
+func newConsoleLog(path string, maxSize int64, maxFiles int, timestamps bool) (*consoleLog, error) {
+	l := &consoleLog{
+		path:        path,
+		maxSize:     maxSize,
+		maxFiles:    maxFiles,
+		timestamps:  timestamps,
+		atLineStart: true,
+		now:         time.Now,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *consoleLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Write writes p to the console log. The file is only rotated at line
+// boundaries, so that a line is never split across two files.
+func (l *consoleLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for rest := p; len(rest) > 0 && !l.failed; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		if l.atLineStart {
+			if l.maxSize > 0 && l.size >= l.maxSize && !l.noRotate {
+				if err := l.rotate(); err != nil {
+					log.Warnf("Failed to rotate the console log %s, it keeps growing: %v", l.path, err)
+					l.noRotate = true
+				}
+			}
+			if l.timestamps {
+				l.write([]byte(l.now().Format(consoleLogTimeFormat) + " "))
+			}
+		}
+
+		l.write(line)
+		l.atLineStart = line[len(line)-1] == '\n'
+	}
+
+	return len(p), nil
+}
+
+// write writes p to the file, the output is dropped from then on if it fails
+func (l *consoleLog) write(p []byte) {
+	if l.failed {
+		return
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	if err != nil {
+		log.Warnf("Failed to write the console log %s, no longer capturing the console: %v", l.path, err)
+		l.failed = true
+	}
+}
+
+// rotate renames path.N-1 to path.N, ..., path to path.1 and reopens an empty
+// file at path. The oldest file is removed once maxFiles is reached. The
+// current file is only closed once the new one is open, so that the output
+// keeps going to it if rotation fails.
+func (l *consoleLog) rotate() error {
+	if l.maxFiles > 0 {
+		for i := l.maxFiles - 1; i > 0; i-- {
+			err := os.Rename(rotatedName(l.path, i), rotatedName(l.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(l.path, rotatedName(l.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+
+	current := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	return current.Close()
+}
+
+// Close closes the underlying file
+func (l *consoleLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+func rotatedName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
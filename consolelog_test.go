@@ -0,0 +1,145 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConsoleLog(t *testing.T) {
+	now := time.Date(2021, 1, 2, 3, 4, 5, 6000, time.UTC)
+	const stamp = "2021-01-02T03:04:05.000006Z "
+
+	cases := []struct {
+		name       string
+		timestamps bool
+		maxSize    int64
+		maxFiles   int
+		writes     []string
+		outFiles   map[string]string
+	}{
+		{
+			name:     "plain output",
+			writes:   []string{"hello ", "world\n", "bye\n"},
+			outFiles: map[string]string{"console.log": "hello world\nbye\n"},
+		},
+		{
+			name:       "timestamps on partial lines",
+			timestamps: true,
+			writes:     []string{"hello ", "world\nbye", "\n"},
+			outFiles: map[string]string{
+				"console.log": stamp + "hello world\n" + stamp + "bye\n",
+			},
+		},
+		{
+			name:     "rotation keeps lines whole",
+			maxSize:  4,
+			maxFiles: 2,
+			writes:   []string{"one\ntwo\nthree\nfour\n"},
+			outFiles: map[string]string{
+				"console.log":   "four\n",
+				"console.log.1": "three\n",
+				"console.log.2": "two\n",
+			},
+		},
+		{
+			name:     "rotation without rotated files",
+			maxSize:  4,
+			maxFiles: 0,
+			writes:   []string{"one\ntwo\n"},
+			outFiles: map[string]string{
+				"console.log": "two\n",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "console.log")
+			l, err := newConsoleLog(path, c.maxSize, c.maxFiles, c.timestamps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.now = func() time.Time { return now }
+
+			for _, w := range c.writes {
+				if n, err := l.Write([]byte(w)); err != nil || n != len(w) {
+					t.Errorf("expected to write %d bytes but wrote %d: %v", len(w), n, err)
+				}
+			}
+			if err := l.Close(); err != nil {
+				t.Error(err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(c.outFiles) {
+				t.Errorf("expected %d files but got %d", len(c.outFiles), len(entries))
+			}
+			for name, expected := range c.outFiles {
+				content, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Errorf("failed to read %s: %v", name, err)
+					continue
+				}
+				if string(content) != expected {
+					t.Errorf("expected %q but got %q in %s", expected, content, name)
+				}
+			}
+		})
+	}
+}
+
+func TestConsoleLogFailures(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "console.log")
+	// path.1 cannot be replaced, so rotation fails
+	if err := os.MkdirAll(filepath.Join(path+".1", "kept"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	l, err := newConsoleLog(path, 4, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var console bytes.Buffer
+	stdout := io.MultiWriter(&console, l)
+	if _, err := io.WriteString(stdout, "one\ntwo\n"); err != nil {
+		t.Fatalf("expected the console to be written despite the failed rotation but got %v", err)
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "one\ntwo\n" {
+		t.Errorf("expected the output to keep going to the current file but got %q: %v", content, err)
+	}
+
+	// the log cannot be written anymore
+	l.file.Close()
+	if _, err := io.WriteString(stdout, "three\n"); err != nil {
+		t.Fatalf("expected the console to be written despite the failed log but got %v", err)
+	}
+	if _, err := io.WriteString(stdout, "four\n"); err != nil {
+		t.Fatalf("expected the console to be written despite the failed log but got %v", err)
+	}
+	if expected := "one\ntwo\nthree\nfour\n"; console.String() != expected {
+		t.Errorf("expected %q on the console but got %q", expected, console.String())
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// digestAttribute pins the SHA-256 digest of a drive, as PATH:rw:sha256=HEX
+const digestAttribute = ":sha256="
+
+// splitDigest splits the sha256 attribute off a drive entry and returns the
+// rest of the entry and the digest, which is empty if the entry has none.
+func splitDigest(entry string) (string, string) {
+	i := strings.LastIndex(entry, digestAttribute)
+	if i < 0 {
+		return entry, ""
+	}
+	return entry[:i], entry[i+len(digestAttribute):]
+}
+
+// checkDigest returns an error unless digest is a hex encoded SHA-256 digest
+func checkDigest(digest string) error {
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+		return errInvalidDigest
+	}
+	return nil
+}
+
+// pin is an expected digest of an artifact
+type pin struct {
+	// field and value identify where the digest was given
+	field  string
+	value  string
+	digest string
+}
+
+// parseManifest parses a manifest in the format of sha256sum, with a digest
+// and a path on each line. Relative paths are relative to the directory of
+// the manifest. It returns the digests by absolute path.
+func parseManifest(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	digests := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, file, ok := strings.Cut(line, " ")
+		// sha256sum marks files hashed in binary mode with a *
+		file = strings.TrimPrefix(strings.TrimLeft(file, " "), "*")
+		if !ok || file == "" {
+			return nil, fmt.Errorf("%w: line %d is not of the form DIGEST PATH", errInvalidManifest, n)
+		}
+		if err := checkDigest(strings.ToLower(digest)); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", errInvalidManifest, n, err)
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		digests[filepath.Clean(file)] = strings.ToLower(digest)
+	}
+	return digests, scanner.Err()
+}
+
+// artifactPins returns the expected digests of the artifacts the microVM is
+// launched with, by path, from the digest options, the sha256 attribute of
+// the drives and the manifest.
+func (opts *options) artifactPins() (map[string][]pin, error) {
+	var manifest map[string]string
+	if opts.Manifest != "" {
+		var err error
+		if manifest, err = parseManifest(opts.Manifest); err != nil {
+			return nil, newConfigError("manifest", opts.Manifest, err)
+		}
+	}
+
+	pins := map[string][]pin{}
+	add := func(field, value, path, digest string) error {
+		if path == "" {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if digest != "" {
+			if err := checkDigest(strings.ToLower(digest)); err != nil {
+				return newConfigError(field, value, err)
+			}
+			pins[abs] = append(pins[abs], pin{field: field, value: value, digest: strings.ToLower(digest)})
+		}
+		if digest, ok := manifest[abs]; ok {
+			pins[abs] = append(pins[abs], pin{field: "manifest", value: opts.Manifest, digest: digest})
+		}
+		return nil
+	}
+
+	// the binary run as firecracker is the exec file when using the jailer
+	binary := opts.ExecFile
+	if opts.JailerBinary == "" {
+		binary, _ = opts.firecrackerBinary()
+	}
+	type artifact struct {
+		field, value, path, digest string
+	}
+	artifacts := []artifact{
+		{"kernel-sha256", opts.KernelSHA256, opts.FcKernelImage, opts.KernelSHA256},
+		{"initrd-sha256", opts.InitrdSHA256, opts.FcInitrd, opts.InitrdSHA256},
+		{"firecracker-sha256", opts.FirecrackerSHA256, binary, opts.FirecrackerSHA256},
+		{"jailer-sha256", opts.JailerSHA256, opts.JailerBinary, opts.JailerSHA256},
+	}
+	if opts.FcRootDrivePath != "" {
+		_, digest := splitDigest(opts.FcRootDrivePath)
+		path, _ := parseDevice(opts.FcRootDrivePath)
+		artifacts = append(artifacts, artifact{"root-drive", opts.FcRootDrivePath, path, digest})
+	}
+	for _, entry := range opts.FcAdditionalDrives {
+		_, digest := splitDigest(entry)
+		path, _, _, err := parseDriveEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, artifact{"add-drive", entry, path, digest})
+	}
+	for _, a := range artifacts {
+		if err := add(a.field, a.value, a.path, a.digest); err != nil {
+			return nil, err
+		}
+	}
+	return pins, nil
+}
+
+// verifyDigests hashes the pinned artifacts in parallel and refuses to start
+// the microVM if any digest does not match.
+func (opts *options) verifyDigests() error {
+	pins, err := opts.artifactPins()
+	if err != nil || len(pins) == 0 {
+		return err
+	}
+
+	paths := make([]string, 0, len(pins))
+	for path := range pins {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	digests, errs := hashFiles(paths)
+
+	var problems []error
+	for i, path := range paths {
+		// the lock reuses the digests rather than hashing the files again
+		if errs[i] == nil {
+			if opts.digests == nil {
+				opts.digests = map[string]string{}
+			}
+			opts.digests[path] = digests[i]
+		}
+		for _, p := range pins[path] {
+			if errs[i] != nil {
+				problems = append(problems, newConfigError(p.field, p.value, errs[i]))
+			} else if digests[i] != p.digest {
+				problems = append(problems, newConfigError(p.field, p.value,
+					fmt.Errorf("%w: %s has digest %s, expected %s", errDigestMismatch, path, digests[i], p.digest)))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return &preflightError{problems: problems}
+	}
+	return nil
+}
+
+// hashFiles returns the digests of the files at paths, hashed in parallel,
+// and the error hashing each file
+func hashFiles(paths []string) ([]string, []error) {
+	start := time.Now()
+	digests := make([]string, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			digests[i], errs[i] = fileSHA256(path)
+		}(i, path)
+	}
+	wg.Wait()
+	log.Debugf("Hashed %d artifacts in %v", len(paths), time.Since(start).Round(time.Millisecond))
+	return digests, errs
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dirSHA256 returns the hex encoded SHA-256 digest of the tree at dir: the
+// path, type, permissions and owner of every entry, with the content of
+// regular files, the target of symlinks and the number of devices. The
+// modification times are left out, so that a copy of the tree has the same
+// digest.
+func dirSHA256(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		var uid, gid uint32
+		var rdev uint64
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid, rdev = stat.Uid, stat.Gid, uint64(stat.Rdev)
+		}
+		fmt.Fprintf(h, "%q %o %d %d", rel, uint32(info.Mode()), uid, gid)
+		switch {
+		case info.Mode().IsRegular():
+			digest, err := fileSHA256(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %s", digest)
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %q", target)
+		case info.Mode()&fs.ModeDevice != 0:
+			fmt.Fprintf(h, " %d", rdev)
+		}
+		fmt.Fprintln(h)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,169 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func TestParseManifest(t *testing.T) {
+	dir := t.TempDir()
+	digest := sha256Hex([]byte("vmlinux"))
+	cases := []struct {
+		name     string
+		manifest string
+		out      map[string]string
+		outErr   error
+	}{
+		{
+			name:     "sha256sum output",
+			manifest: "# pinned artifacts\n" + digest + "  vmlinux\n" + strings.ToUpper(digest) + " */images/rootfs.ext4\n\n",
+			out: map[string]string{
+				filepath.Join(dir, "vmlinux"): digest,
+				"/images/rootfs.ext4":         digest,
+			},
+		},
+		{
+			name:     "missing path",
+			manifest: digest + "\n",
+			outErr:   errInvalidManifest,
+		},
+		{
+			name:     "invalid digest",
+			manifest: "abc  vmlinux\n",
+			outErr:   errInvalidManifest,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, "SHA256SUMS")
+			if err := os.WriteFile(path, []byte(c.manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+			digests, err := parseManifest(path)
+			if !errors.Is(err, c.outErr) {
+				t.Fatalf("expected %v but got %v", c.outErr, err)
+			}
+			if c.outErr != nil {
+				return
+			}
+			if len(digests) != len(c.out) {
+				t.Errorf("expected %v but got %v", c.out, digests)
+			}
+			for path, digest := range c.out {
+				if digests[path] != digest {
+					t.Errorf("expected %s for %s but got %q", digest, path, digests[path])
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyDigests(t *testing.T) {
+	cases := []struct {
+		name   string
+		setup  func(opts *options)
+		outErr error
+	}{
+		{
+			name: "no digests",
+			setup: func(opts *options) {
+			},
+		},
+		{
+			name: "matching kernel and binary",
+			setup: func(opts *options) {
+				opts.KernelSHA256 = sha256Hex(supportedKernel())
+				data, err := os.ReadFile(opts.FcBinary)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts.FirecrackerSHA256 = strings.ToUpper(sha256Hex(data))
+			},
+		},
+		{
+			name: "mismatching kernel",
+			setup: func(opts *options) {
+				opts.KernelSHA256 = sha256Hex([]byte("stale"))
+			},
+			outErr: errDigestMismatch,
+		},
+		{
+			name: "mismatching drive attribute",
+			setup: func(opts *options) {
+				opts.FcRootDrivePath += digestAttribute + sha256Hex([]byte("stale"))
+			},
+			outErr: errDigestMismatch,
+		},
+		{
+			name: "matching drive attribute",
+			setup: func(opts *options) {
+				opts.FcAdditionalDrives = []string{
+					filepath.Join(filepath.Dir(opts.FcRootDrivePath), "data") + rwDeviceSuffix + digestAttribute + sha256Hex(nil),
+				}
+			},
+		},
+		{
+			name: "mismatching manifest",
+			setup: func(opts *options) {
+				opts.Manifest = filepath.Join(filepath.Dir(opts.FcKernelImage), "SHA256SUMS")
+				manifest := sha256Hex([]byte("stale")) + "  vmlinux\n"
+				if err := os.WriteFile(opts.Manifest, []byte(manifest), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			outErr: errDigestMismatch,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := setupPreflight(t)
+			c.setup(opts)
+			if err := opts.preflight(); err != nil {
+				t.Fatalf("expected no preflight problems but got %v", err)
+			}
+			err := opts.verifyDigests()
+			if !errors.Is(err, c.outErr) {
+				t.Errorf("expected %v but got %v", c.outErr, err)
+			}
+			if c.outErr != nil {
+				if code := exitCode(err, false); code != exitConfigError {
+					t.Errorf("expected exit code %d but got %d", exitConfigError, code)
+				}
+			}
+		})
+	}
+}
+
+func TestPreflightDigests(t *testing.T) {
+	opts := setupPreflight(t)
+	opts.KernelSHA256 = "abc"
+	opts.FcRootDrivePath += digestAttribute + "xyz"
+	err := opts.preflight()
+	var preflight *preflightError
+	if !errors.As(err, &preflight) || len(preflight.problems) != 2 || !errors.Is(err, errInvalidDigest) {
+		t.Errorf("expected two invalid digests but got %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// methods used to clone a disk image
+const (
+	cloneMethodReflink    = "reflink"
+	cloneMethodSparseCopy = "sparse copy"
+)
+
+// sparseCopyBlockSize is the size of the blocks compared to zero by a sparse
+// copy, blocks of zeros are left as holes in the copy
+const sparseCopyBlockSize = 64 << 10
+
+// cloneRootDrive replaces the root drive with a clone when --root-drive-cow
+// is given, so that the guest cannot modify the original image. The clone is
+// removed on exit unless --keep-disk is given.
+func (opts *options) cloneRootDrive() error {
+	if !opts.RootDriveCOW {
+		return nil
+	}
+	path, readOnly := parseDevice(opts.FcRootDrivePath)
+
+	// a reflink requires the clone to be on the same filesystem, so it is
+	// created next to the original when possible
+	name := filepath.Base(path) + ".cow-*"
+	f, err := os.CreateTemp(filepath.Dir(path), name)
+	if err != nil {
+		log.Debugf("Creating the clone of %s in the temporary directory: %v", path, err)
+		if f, err = os.CreateTemp("", name); err != nil {
+			return fmt.Errorf("%w: %w", errUnableToCloneDisk, err)
+		}
+	}
+	clone := f.Name()
+	f.Close()
+	opts.addCreatedFile(clone)
+	if opts.KeepDisk {
+		opts.addCloser(func() error {
+			log.Infof("Kept the root drive clone %s", clone)
+			return nil
+		})
+	} else {
+		opts.addCloser(func() error {
+			return os.Remove(clone)
+		})
+	}
+
+	start := time.Now()
+	method, err := cloneFile(path, clone)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", errUnableToCloneDisk, path, err)
+	}
+	log.Infof("Cloned root drive %s to %s with a %s in %v", path, clone, method, time.Since(start).Round(time.Millisecond))
+
+	opts.FcRootDrivePath = clone
+	if readOnly {
+		opts.FcRootDrivePath += roDeviceSuffix
+	}
+	return nil
+}
+
+// cloneFile clones src into the existing file dst, sharing its extents with
+// a reflink when the filesystem supports it, otherwise with a sparse copy.
+// It returns the method used.
+func cloneFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	method := cloneMethodReflink
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		log.Debugf("Reflink of %s failed, falling back to a sparse copy: %v", src, err)
+		method = cloneMethodSparseCopy
+		if err := sparseCopy(out, in); err != nil {
+			return "", err
+		}
+	}
+	return method, out.Close()
+}
+
+// sparseCopy copies in to out, leaving holes in out for the holes of in and
+// for blocks of zeros.
+func sparseCopy(out, in *os.File) error {
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	buf := make([]byte, sparseCopyBlockSize)
+	zeros := make([]byte, sparseCopyBlockSize)
+	for offset := int64(0); offset < size; {
+		// skip to the next data extent, ENXIO means only a hole is left
+		data, err := unix.Seek(int(in.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break
+		} else if err != nil {
+			// the filesystem cannot report holes, every block is read
+			data = offset
+		}
+		hole, err := unix.Seek(int(in.Fd()), data, unix.SEEK_HOLE)
+		if err != nil {
+			hole = size
+		}
+
+		for offset = data; offset < hole; {
+			n, err := in.ReadAt(buf[:min(int64(len(buf)), hole-offset)], offset)
+			if n == 0 && err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			if !bytes.Equal(buf[:n], zeros[:n]) {
+				if _, err := out.WriteAt(buf[:n], offset); err != nil {
+					return err
+				}
+			}
+			offset += int64(n)
+		}
+		if offset < hole {
+			break
+		}
+	}
+	return out.Truncate(size)
+}
+
+// scratchDiskFilesystems are the filesystems a scratch disk can be formatted
+// with by mke2fs
+var scratchDiskFilesystems = map[string]bool{
+	"ext2": true,
+	"ext3": true,
+	"ext4": true,
+}
+
+// ext4LabelMaxLength is the maximum length of the label of an ext2, ext3 or
+// ext4 filesystem
+const ext4LabelMaxLength = 16
+
+// scratchDisk is a drive created empty for the lifetime of the microVM
+type scratchDisk struct {
+	size  int64
+	fs    string
+	label string
+}
+
+// parseScratchDisk parses a scratch disk of the form
+// size=SIZE[,fs=ext4][,label=LABEL]
+func parseScratchDisk(entry string) (scratchDisk, error) {
+	var disk scratchDisk
+	invalid := func(reason string) (scratchDisk, error) {
+		return scratchDisk{}, newConfigError("scratch-disk", entry,
+			fmt.Errorf("%w: %s", errInvalidScratchDisk, reason))
+	}
+	for _, attr := range strings.Split(entry, ",") {
+		key, value, ok := strings.Cut(attr, "=")
+		if !ok || value == "" {
+			return invalid(fmt.Sprintf("%q has no value", attr))
+		}
+		switch key {
+		case "size":
+			size, err := parseSize(value)
+			if err != nil {
+				return scratchDisk{}, newConfigError("scratch-disk", entry, err)
+			}
+			disk.size = size
+		case "fs":
+			if !scratchDiskFilesystems[value] {
+				return invalid(fmt.Sprintf("unsupported filesystem %q", value))
+			}
+			disk.fs = value
+		case "label":
+			if len(value) > ext4LabelMaxLength {
+				return invalid(fmt.Sprintf("label is longer than %d characters", ext4LabelMaxLength))
+			}
+			disk.label = value
+		default:
+			return invalid(fmt.Sprintf("unknown attribute %q", key))
+		}
+	}
+	if disk.size == 0 {
+		return invalid("size is required")
+	}
+	if disk.label != "" && disk.fs == "" {
+		return invalid("label requires fs")
+	}
+	return disk, nil
+}
+
+// create creates the disk as a sparse file at path, formatted if it has a
+// filesystem
+func (d scratchDisk) create(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(d.size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || d.fs == "" {
+		return err
+	}
+
+	args := []string{"-q", "-F", "-t", d.fs}
+	if d.label != "" {
+		args = append(args, "-L", d.label)
+	}
+	return runImageTool(mke2fsBinary, nil, append(args, path)...)
+}
+
+// createScratchDisks creates the drives given with --scratch-disk in a
+// temporary directory, attaches them read-write as additional drives and
+// removes them on exit.
+func (opts *options) createScratchDisks() error {
+	if len(opts.ScratchDisks) == 0 {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "firectl-scratch-")
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUnableToCreateScratchDisk, err)
+	}
+	opts.addCloser(func() error {
+		return os.RemoveAll(dir)
+	})
+
+	for i, entry := range opts.ScratchDisks {
+		disk, err := parseScratchDisk(entry)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, fmt.Sprintf("scratch%d.img", i))
+		if err := disk.create(path); err != nil {
+			return fmt.Errorf("%w: %s: %w", errUnableToCreateScratchDisk, entry, err)
+		}
+		log.Debugf("Created scratch disk %s for %s", path, entry)
+		opts.addCreatedFile(path)
+		opts.FcAdditionalDrives = append(opts.FcAdditionalDrives, path+rwDeviceSuffix)
+	}
+	return nil
+}
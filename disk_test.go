@@ -0,0 +1,200 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// writeSparseImage writes an image of size bytes with data at its start and
+// at its middle, and holes elsewhere
+func writeSparseImage(t *testing.T, path string, size int64) []byte {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("firectl"), 1000)
+	for _, offset := range []int64{0, size / 2} {
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestSparseCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "rootfs.ext4")
+	size := int64(64 << 20)
+	expected := writeSparseImage(t, src, size)
+
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, "clone.ext4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := sparseCopy(out, in); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Errorf("expected the copy to have the content of the original")
+	}
+	info, err := out.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allocated := info.Sys().(*syscall.Stat_t).Blocks * 512; allocated >= size/2 {
+		t.Errorf("expected a sparse copy but %d of %d bytes are allocated", allocated, size)
+	}
+}
+
+func TestCloneRootDrive(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		t.Run(map[bool]string{false: "remove", true: "keep"}[keep], func(t *testing.T) {
+			dir := t.TempDir()
+			root := filepath.Join(dir, "rootfs.ext4")
+			expected := writeSparseImage(t, root, 1<<20)
+
+			opts := &options{
+				FcRootDrivePath: root + roDeviceSuffix,
+				RootDriveCOW:    true,
+				KeepDisk:        keep,
+			}
+			defer opts.Close()
+			if err := opts.cloneRootDrive(); err != nil {
+				t.Fatal(err)
+			}
+
+			clone, readOnly := parseDevice(opts.FcRootDrivePath)
+			if clone == root || !readOnly {
+				t.Fatalf("expected a read-only clone of %s but got %s", root, opts.FcRootDrivePath)
+			}
+			content, err := os.ReadFile(clone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, expected) {
+				t.Errorf("expected the clone to have the content of the root drive")
+			}
+
+			opts.Close()
+			if _, err := os.Stat(clone); os.IsNotExist(err) == keep {
+				t.Errorf("expected the clone to be kept %v on close but got %v", keep, err)
+			}
+			if _, err := os.Stat(root); err != nil {
+				t.Errorf("expected the root drive to be left in place: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseScratchDisk(t *testing.T) {
+	cases := []struct {
+		in     string
+		out    scratchDisk
+		outErr error
+	}{
+		{in: "size=4G", out: scratchDisk{size: 4 << 30}},
+		{in: "size=512M,fs=ext4,label=scratch", out: scratchDisk{size: 512 << 20, fs: "ext4", label: "scratch"}},
+		{in: "fs=ext4", outErr: errInvalidScratchDisk},
+		{in: "size=4X", outErr: errInvalidImageSize},
+		{in: "size=4G,fs=xfs", outErr: errInvalidScratchDisk},
+		{in: "size=4G,label=scratch", outErr: errInvalidScratchDisk},
+		{in: "size=4G,fs=ext4,label=averyveryverylonglabel", outErr: errInvalidScratchDisk},
+		{in: "size=4G,mode=ro", outErr: errInvalidScratchDisk},
+		{in: "size", outErr: errInvalidScratchDisk},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			disk, err := parseScratchDisk(c.in)
+			if disk != c.out || !errors.Is(err, c.outErr) {
+				t.Errorf("expected %+v, %v but got %+v, %v", c.out, c.outErr, disk, err)
+			}
+		})
+	}
+}
+
+func TestCreateScratchDisks(t *testing.T) {
+	if _, err := exec.LookPath(mke2fsBinary); err != nil {
+		t.Skipf("%s is required: %v", mke2fsBinary, err)
+	}
+	opts := &options{
+		FcAdditionalDrives: []string{"data.ext4:ro"},
+		ScratchDisks:       []string{"size=16M", "size=32M,fs=ext4,label=scratch"},
+	}
+	defer opts.Close()
+	if err := opts.createScratchDisks(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(opts.FcAdditionalDrives) != 3 {
+		t.Fatalf("expected the scratch disks to be added to the drives but got %v", opts.FcAdditionalDrives)
+	}
+	var paths []string
+	for i, size := range []int64{16 << 20, 32 << 20} {
+		entry := opts.FcAdditionalDrives[i+1]
+		path, readOnly, _, err := parseDriveEntry(entry)
+		if err != nil || readOnly {
+			t.Fatalf("expected a read-write drive but got %q, %v", entry, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != size {
+			t.Errorf("expected %s to be %d bytes but got %d", path, size, info.Size())
+		}
+		paths = append(paths, path)
+	}
+
+	out, err := exec.Command(debugfsBinary, "-R", "stats", paths[1]).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "Filesystem volume name:   scratch") {
+		t.Errorf("expected an ext4 filesystem labelled scratch but got %s", out)
+	}
+
+	opts.Close()
+	for _, path := range paths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed on close", path)
+		}
+	}
+}
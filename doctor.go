@@ -0,0 +1,367 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// KVM ioctls, see include/uapi/linux/kvm.h
+	kvmGetAPIVersion  = 0xAE00
+	kvmCheckExtension = 0xAE03
+
+	// kvmAPIVersion is the only stable version of the KVM API
+	kvmAPIVersion = 12
+
+	// oldest host kernel supported by firecracker, and the oldest one it
+	// is tested against
+	minHostKernel         = "4.14"
+	recommendedHostKernel = "5.10"
+)
+
+var (
+	// tunDevicePath is the device used to create tap devices
+	tunDevicePath = "/dev/net/tun"
+	// cgroupRootPath is where the cgroup hierarchy is mounted
+	cgroupRootPath = "/sys/fs/cgroup"
+	procMountsPath = "/proc/mounts"
+	// procMeminfoPath reports the hugepages of the host
+	procMeminfoPath = "/proc/meminfo"
+)
+
+// kvmCapability is a KVM extension required by firecracker
+type kvmCapability struct {
+	name string
+	id   uintptr
+}
+
+// requiredKVMCapabilities are the KVM extensions firecracker requires on every
+// architecture
+var requiredKVMCapabilities = []kvmCapability{
+	{"KVM_CAP_IRQCHIP", 0},
+	{"KVM_CAP_USER_MEMORY", 3},
+	{"KVM_CAP_MP_STATE", 14},
+	{"KVM_CAP_IRQFD", 32},
+	{"KVM_CAP_IOEVENTFD", 36},
+	{"KVM_CAP_IMMEDIATE_EXIT", 136},
+}
+
+// requiredX86KVMCapabilities are the KVM extensions firecracker additionally
+// requires on x86_64
+var requiredX86KVMCapabilities = []kvmCapability{
+	{"KVM_CAP_SET_TSS_ADDR", 4},
+	{"KVM_CAP_EXT_CPUID", 7},
+	{"KVM_CAP_PIT2", 33},
+	{"KVM_CAP_PIT_STATE2", 35},
+	{"KVM_CAP_ADJUST_CLOCK", 39},
+	{"KVM_CAP_VCPU_EVENTS", 41},
+	{"KVM_CAP_XSAVE", 55},
+	{"KVM_CAP_XCRS", 56},
+}
+
+// cgroup controllers used by the jailer. The cpuset controller is required to
+// pin the VMM to a NUMA node, the others are needed to apply resource limits.
+var (
+	requiredCgroupControllers = []string{"cpuset"}
+	optionalCgroupControllers = []string{"cpu", "memory", "pids"}
+)
+
+type checkStatus int
+
+const (
+	checkPass checkStatus = iota
+	checkWarn
+	checkFail
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case checkPass:
+		return "PASS"
+	case checkWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// doctorCheck is the result of a host readiness check
+type doctorCheck struct {
+	name    string
+	status  checkStatus
+	message string
+}
+
+func doctorResult(name string, status checkStatus, format string, args ...interface{}) doctorCheck {
+	return doctorCheck{name: name, status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// doctorChecks returns the checks run by firectl doctor, in order
+func (opts *options) doctorChecks() []func() doctorCheck {
+	return []func() doctorCheck{
+		doctorKVM,
+		doctorKVMExtensions,
+		func() doctorCheck {
+			var uname unix.Utsname
+			if err := unix.Uname(&uname); err != nil {
+				return doctorResult("host kernel", checkFail, "unable to determine kernel version: %v", err)
+			}
+			return doctorHostKernel(unix.ByteSliceToString(uname.Release[:]))
+		},
+		doctorTun,
+		doctorCgroups,
+		doctorHugepages,
+		opts.doctorFirecracker,
+	}
+}
+
+// runDoctor runs the checks, printing one line per check to w, and returns
+// false if any of them failed.
+func runDoctor(w io.Writer, checks []func() doctorCheck) bool {
+	ok := true
+	for _, check := range checks {
+		c := check()
+		fmt.Fprintf(w, "%-4s  %-16s %s\n", c.status, c.name, c.message)
+		if c.status == checkFail {
+			ok = false
+		}
+	}
+	return ok
+}
+
+func doctorKVM() doctorCheck {
+	if err := checkKVM(); err != nil {
+		return doctorResult("kvm", checkFail, "%v", err)
+	}
+	return doctorResult("kvm", checkPass, "%s is accessible", kvmDevicePath)
+}
+
+func doctorKVMExtensions() doctorCheck {
+	const name = "kvm extensions"
+
+	f, err := os.OpenFile(kvmDevicePath, os.O_RDWR, 0)
+	if err != nil {
+		return doctorResult(name, checkFail, "unable to open %s: %v", kvmDevicePath, err)
+	}
+	defer f.Close()
+
+	version, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), kvmGetAPIVersion, 0)
+	if errno != 0 {
+		return doctorResult(name, checkFail, "unable to get the KVM API version: %v", errno)
+	}
+	if version != kvmAPIVersion {
+		return doctorResult(name, checkFail, "unsupported KVM API version %d, expected %d", version, kvmAPIVersion)
+	}
+
+	capabilities := append([]kvmCapability{}, requiredKVMCapabilities...)
+	if runtime.GOARCH == "amd64" {
+		capabilities = append(capabilities, requiredX86KVMCapabilities...)
+	}
+	var missing []string
+	for _, c := range capabilities {
+		supported, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), kvmCheckExtension, c.id)
+		if errno != 0 || supported == 0 {
+			missing = append(missing, c.name)
+		}
+	}
+	if len(missing) > 0 {
+		return doctorResult(name, checkFail, "missing %s", strings.Join(missing, ", "))
+	}
+	return doctorResult(name, checkPass, "all %d required extensions are supported", len(capabilities))
+}
+
+// doctorHostKernel checks the host kernel release, such as 5.10.0-19-amd64
+func doctorHostKernel(release string) doctorCheck {
+	const name = "host kernel"
+
+	switch {
+	case compareKernelVersions(release, minHostKernel) < 0:
+		return doctorResult(name, checkFail, "%s is older than %s, the oldest kernel supported by firecracker", release, minHostKernel)
+	case compareKernelVersions(release, recommendedHostKernel) < 0:
+		return doctorResult(name, checkWarn, "%s is older than %s, the oldest kernel firecracker is tested on", release, recommendedHostKernel)
+	}
+	return doctorResult(name, checkPass, "%s", release)
+}
+
+// compareKernelVersions compares the major and minor numbers of two kernel
+// releases, returning -1, 0 or 1.
+func compareKernelVersions(a, b string) int {
+	parse := func(release string) [2]int {
+		var v [2]int
+		fields := strings.FieldsFunc(release, func(r rune) bool {
+			return r < '0' || r > '9'
+		})
+		for i := 0; i < len(v) && i < len(fields); i++ {
+			v[i], _ = strconv.Atoi(fields[i])
+		}
+		return v
+	}
+
+	va, vb := parse(a), parse(b)
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func doctorTun() doctorCheck {
+	const name = "tun"
+
+	info, err := os.Stat(tunDevicePath)
+	if err != nil {
+		return doctorResult(name, checkFail, "%s is missing, load the tun module to use tap devices: %v", tunDevicePath, err)
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return doctorResult(name, checkFail, "%s is not a character device", tunDevicePath)
+	}
+	return doctorResult(name, checkPass, "%s is available", tunDevicePath)
+}
+
+func doctorCgroups() doctorCheck {
+	const name = "cgroups"
+
+	version := "v1"
+	var controllers []string
+	if data, err := os.ReadFile(filepath.Join(cgroupRootPath, "cgroup.controllers")); err == nil {
+		version = "v2"
+		controllers = strings.Fields(string(data))
+	} else {
+		var err error
+		if controllers, err = cgroupV1Controllers(); err != nil {
+			return doctorResult(name, checkFail, "unable to read mounts: %v", err)
+		}
+		if len(controllers) == 0 {
+			return doctorResult(name, checkFail, "no cgroup hierarchy is mounted, the jailer requires one")
+		}
+	}
+
+	available := map[string]bool{}
+	for _, c := range controllers {
+		available[c] = true
+	}
+	missing := func(wanted []string) []string {
+		var m []string
+		for _, c := range wanted {
+			if !available[c] {
+				m = append(m, c)
+			}
+		}
+		return m
+	}
+
+	if m := missing(requiredCgroupControllers); len(m) > 0 {
+		return doctorResult(name, checkFail, "cgroup %s is missing the %s controller(s) required by the jailer",
+			version, strings.Join(m, ", "))
+	}
+	if m := missing(optionalCgroupControllers); len(m) > 0 {
+		return doctorResult(name, checkWarn, "cgroup %s is missing the %s controller(s), resource limits cannot be applied by the jailer",
+			version, strings.Join(m, ", "))
+	}
+	return doctorResult(name, checkPass, "cgroup %s with the controllers needed by the jailer", version)
+}
+
+// cgroupV1Controllers returns the controllers of the mounted cgroup v1
+// hierarchies
+func cgroupV1Controllers() ([]string, error) {
+	f, err := os.Open(procMountsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var controllers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// device mountpoint fstype options dump pass
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "cgroup" {
+			continue
+		}
+		for _, option := range strings.Split(fields[3], ",") {
+			if option != "rw" && option != "ro" && !strings.Contains(option, "=") {
+				controllers = append(controllers, option)
+			}
+		}
+	}
+	return controllers, scanner.Err()
+}
+
+func doctorHugepages() doctorCheck {
+	const name = "hugepages"
+
+	f, err := os.Open(procMeminfoPath)
+	if err != nil {
+		return doctorResult(name, checkWarn, "unable to read %s: %v", procMeminfoPath, err)
+	}
+	defer f.Close()
+
+	meminfo := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), ":"); ok {
+			meminfo[key] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return doctorResult(name, checkWarn, "unable to read %s: %v", procMeminfoPath, err)
+	}
+
+	total, _ := strconv.Atoi(meminfo["HugePages_Total"])
+	free, _ := strconv.Atoi(meminfo["HugePages_Free"])
+	switch {
+	case total == 0:
+		return doctorResult(name, checkWarn, "no hugepages are reserved, guest memory cannot be backed by hugepages")
+	case free == 0:
+		return doctorResult(name, checkWarn, "all %d hugepages of %s are in use", total, meminfo["Hugepagesize"])
+	}
+	return doctorResult(name, checkPass, "%d of %d hugepages of %s are free", free, total, meminfo["Hugepagesize"])
+}
+
+func (opts *options) doctorFirecracker() doctorCheck {
+	const name = "firecracker"
+
+	binary, err := opts.firecrackerBinary()
+	if err != nil {
+		return doctorResult(name, checkFail, "%v", err)
+	}
+	if err := checkBinary(binary); err != nil {
+		return doctorResult(name, checkFail, "%v", err)
+	}
+	version, err := firecrackerVersion(binary)
+	if err != nil {
+		return doctorResult(name, checkFail, "unable to get the version of %s: %v", binary, err)
+	}
+	if err := checkVersionSupported(version); err != nil {
+		return doctorResult(name, checkFail, "%s: %v", binary, err)
+	}
+	if err := checkVersionTested(version); err != nil {
+		return doctorResult(name, checkWarn, "%s: %v", binary, err)
+	}
+	return doctorResult(name, checkPass, "%s is version %s", binary, version)
+}
@@ -0,0 +1,165 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDoctorHostKernel(t *testing.T) {
+	cases := []struct {
+		release   string
+		outStatus checkStatus
+	}{
+		{release: "4.9.0-amd64", outStatus: checkFail},
+		{release: "4.14.35-1902.el7uek.x86_64", outStatus: checkWarn},
+		{release: "5.4.0-generic", outStatus: checkWarn},
+		{release: "5.10.0-19-amd64", outStatus: checkPass},
+		{release: "6.1.55", outStatus: checkPass},
+	}
+	for _, c := range cases {
+		t.Run(c.release, func(t *testing.T) {
+			if check := doctorHostKernel(c.release); check.status != c.outStatus {
+				t.Errorf("expected %s but got %s: %s", c.outStatus, check.status, check.message)
+			}
+		})
+	}
+}
+
+func TestDoctorCgroups(t *testing.T) {
+	cases := []struct {
+		name        string
+		controllers string
+		mounts      string
+		outStatus   checkStatus
+	}{
+		{
+			name:        "cgroup v2",
+			controllers: "cpuset cpu io memory pids\n",
+			outStatus:   checkPass,
+		},
+		{
+			name:        "cgroup v2 without pids",
+			controllers: "cpuset cpu memory\n",
+			outStatus:   checkWarn,
+		},
+		{
+			name: "cgroup v1",
+			mounts: "cgroup /sys/fs/cgroup/cpu cgroup rw,relatime,cpu 0 0\n" +
+				"cgroup /sys/fs/cgroup/cpuset cgroup rw,relatime,cpuset 0 0\n" +
+				"cgroup /sys/fs/cgroup/memory cgroup rw,relatime,memory 0 0\n" +
+				"cgroup /sys/fs/cgroup/pids cgroup rw,relatime,pids 0 0\n" +
+				"cgroup /sys/fs/cgroup/systemd cgroup rw,relatime,name=systemd 0 0\n",
+			outStatus: checkPass,
+		},
+		{
+			name:      "cgroup v1 without cpuset",
+			mounts:    "cgroup /sys/fs/cgroup/cpu cgroup rw,relatime,cpu 0 0\n",
+			outStatus: checkFail,
+		},
+		{
+			name:      "no cgroups",
+			mounts:    "proc /proc proc rw 0 0\n",
+			outStatus: checkFail,
+		},
+	}
+
+	oldRoot, oldMounts := cgroupRootPath, procMountsPath
+	defer func() {
+		cgroupRootPath, procMountsPath = oldRoot, oldMounts
+	}()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cgroupRootPath = dir
+			procMountsPath = filepath.Join(dir, "mounts")
+			if c.controllers != "" {
+				if err := os.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte(c.controllers), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(procMountsPath, []byte(c.mounts), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if check := doctorCgroups(); check.status != c.outStatus {
+				t.Errorf("expected %s but got %s: %s", c.outStatus, check.status, check.message)
+			}
+		})
+	}
+}
+
+func TestDoctorHugepages(t *testing.T) {
+	cases := []struct {
+		name      string
+		meminfo   string
+		outStatus checkStatus
+	}{
+		{
+			name:      "free hugepages",
+			meminfo:   "HugePages_Total:      16\nHugePages_Free:       8\nHugepagesize:       2048 kB\n",
+			outStatus: checkPass,
+		},
+		{
+			name:      "no free hugepages",
+			meminfo:   "HugePages_Total:      16\nHugePages_Free:       0\nHugepagesize:       2048 kB\n",
+			outStatus: checkWarn,
+		},
+		{
+			name:      "no hugepages",
+			meminfo:   "HugePages_Total:       0\nHugePages_Free:        0\n",
+			outStatus: checkWarn,
+		},
+	}
+
+	oldMeminfo := procMeminfoPath
+	defer func() {
+		procMeminfoPath = oldMeminfo
+	}()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			procMeminfoPath = filepath.Join(t.TempDir(), "meminfo")
+			if err := os.WriteFile(procMeminfoPath, []byte(c.meminfo), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if check := doctorHugepages(); check.status != c.outStatus {
+				t.Errorf("expected %s but got %s: %s", c.outStatus, check.status, check.message)
+			}
+		})
+	}
+}
+
+func TestRunDoctor(t *testing.T) {
+	result := func(status checkStatus) func() doctorCheck {
+		return func() doctorCheck {
+			return doctorResult("check", status, "message")
+		}
+	}
+
+	var out bytes.Buffer
+	if !runDoctor(&out, []func() doctorCheck{result(checkPass), result(checkWarn)}) {
+		t.Errorf("expected warnings not to fail the checks")
+	}
+	expected := "PASS  check            message\nWARN  check            message\n"
+	if out.String() != expected {
+		t.Errorf("expected %q but got %q", expected, out.String())
+	}
+
+	if runDoctor(&out, []func() doctorCheck{result(checkFail), result(checkPass)}) {
+		t.Errorf("expected a failed check to fail the checks")
+	}
+}
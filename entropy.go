@@ -0,0 +1,80 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// addEntropyDeviceHandlerName is the name of the handler adding the entropy
+// device to the machine
+const addEntropyDeviceHandlerName = "firectl.AddEntropyDevice"
+
+// entropyDeviceHandler adds a virtio-rng device to the guest. The entropy
+// device is newer than the SDK, so its API is called directly.
+var entropyDeviceHandler = firecracker.Handler{
+	Name: addEntropyDeviceHandlerName,
+	Fn: func(ctx context.Context, m *firecracker.Machine) error {
+		return putFirecrackerAPI(ctx, m.Cfg.SocketPath, "/entropy", struct{}{})
+	},
+}
+
+// putFirecrackerAPI sends a PUT request with body encoded as JSON to the
+// firecracker API listening on socketPath.
+func putFirecrackerAPI(ctx context.Context, socketPath, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://localhost"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		var fault struct {
+			FaultMessage string `json:"fault_message"`
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(msg, &fault) == nil && fault.FaultMessage != "" {
+			msg = []byte(fault.FaultMessage)
+		}
+		return fmt.Errorf("PUT %s failed with status %d: %s", path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPutFirecrackerAPI(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "firecracker.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotMethod, gotPath, gotBody string
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotMethod, gotPath, gotBody = r.Method, r.URL.Path, string(body)
+		if r.URL.Path == "/entropy" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"fault_message":"Invalid request method and/or path"}`)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	ctx := context.Background()
+	if err := putFirecrackerAPI(ctx, socketPath, "/entropy", struct{}{}); err != nil {
+		t.Fatalf("expected no error but got %v", err)
+	}
+	if gotMethod != http.MethodPut || gotPath != "/entropy" || gotBody != "{}" {
+		t.Errorf("unexpected request %s %s %q", gotMethod, gotPath, gotBody)
+	}
+
+	err = putFirecrackerAPI(ctx, socketPath, "/unknown", struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "Invalid request method and/or path") {
+		t.Errorf("expected the fault message in the error but got %v", err)
+	}
+}
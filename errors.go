@@ -13,7 +13,10 @@
 
 package main
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// Error parsing nic config
@@ -22,6 +25,8 @@ var (
 	// error parsing blockdevices
 	errInvalidDriveSpecificationNoSuffix = errors.New("invalid drive specification. Must have :rw or :ro suffix")
 	errInvalidDriveSpecificationNoPath   = errors.New("invalid drive specification. Must have path")
+	errMultipleRootDrives                = errors.New("only one drive can be the root device")
+	errRootPartitionWithoutRootDrive     = errors.New("root-partition requires a root drive")
 
 	// error parsing vsock
 	errUnableToParseVsockDevices = errors.New("unable to parse vsock devices")
@@ -30,6 +35,256 @@ var (
 	errConflictingLogOpts        = errors.New("vmm-log-fifo and firecracker-log cannot be used together")
 	errUnableToCreateFifoLogFile = errors.New("failed to create fifo log file")
 
+	// error setting up the console log
+	errUnableToCreateConsoleLog  = errors.New("failed to create console log")
+	errConsoleLogOnlyWithoutLog  = errors.New("console-log-only requires console-log to be set")
+	errInvalidConsoleLogRotation = errors.New("console-log-max-size and console-log-max-files cannot be negative")
+
+	// error setting up the console recording
+	errUnableToCreateRecording  = errors.New("failed to create console recording")
+	errRecordInputWithoutRecord = errors.New("record-input requires record to be set")
+
 	// error with firecracker config
 	errInvalidMetadata = errors.New("invalid metadata, unable to parse as json")
+
+	// error setting up the interactive console
+	errInvalidEscapeChar = errors.New("invalid escape character. Must be a single character or of the form ^X")
+	errNotATerminal      = errors.New("interactive mode requires stdin to be a terminal")
+
+	// error parsing or running console scripts
+	errScriptInteractive        = errors.New("script and interactive cannot be used together")
+	errInvalidCaptureName       = errors.New("capture requires a name which is a valid file name")
+	errNestedCapture            = errors.New("capture cannot be nested, use endcapture first")
+	errEndCaptureWithoutCapture = errors.New("endcapture without capture")
+	errUnterminatedCapture      = errors.New("capture is missing its endcapture")
+
+	// errors found by the preflight checks
+	errIsADirectory        = errors.New("is a directory")
+	errNoRootFSOrInitrd    = errors.New("a root drive or an initrd is required")
+	errDuplicateDrive      = errors.New("drive is attached more than once")
+	errDuplicateVsockPath  = errors.New("vsock path is used more than once")
+	errDuplicateVsockCID   = errors.New("vsock CID is used more than once")
+	errVsockPathExists     = errors.New("vsock path already exists")
+	errTapDeviceNotFound   = errors.New("tap device does not exist")
+	errInvalidVCPUCount    = errors.New("vCPU count must be between 1 and 32")
+	errOddVCPUCountWithSMT = errors.New("vCPU count must be 1 or even when SMT is enabled")
+	errInvalidMemorySize   = errors.New("memory size must be positive")
+	errMemoryExceedsHost   = errors.New("memory size exceeds the memory of the host")
+	errKVMUnavailable      = errors.New("KVM is not available")
+
+	// errors building the initrd
+	errInvalidInitrdAdd      = errors.New("invalid initrd entry. Must be of the form HOST:GUEST")
+	errInitrdConflict        = errors.New("initrd-path cannot be used with initrd-from-dir or initrd-add")
+	errInitrdCompressNoBuild = errors.New("initrd-compress requires initrd-from-dir or initrd-add")
+	errUnableToBuildInitrd   = errors.New("failed to build initrd")
+
+	// errors building ext4 images
+	errImageSource        = errors.New("exactly one of a directory or a tarball is required")
+	errInvalidImageSize   = errors.New("invalid size. Must be a number of bytes optionally suffixed with K, M, G or T")
+	errImageExists        = errors.New("image already exists")
+	errUnsafeTarPath      = errors.New("tarball entry escapes the root of the image")
+	errRootImageConflict  = errors.New("root-drive cannot be used with root-from-dir or root-from-tar")
+	errRootSizeNoBuild    = errors.New("root-size requires root-from-dir or root-from-tar")
+	errUnableToBuildImage = errors.New("failed to build ext4 image")
+
+	// errors cloning the root drive
+	errRootDriveCOWNoRoot = errors.New("root-drive-cow requires root-drive")
+	errKeepDiskNoCOW      = errors.New("keep-disk requires root-drive-cow")
+	errUnableToCloneDisk  = errors.New("failed to clone root drive")
+
+	// errors creating scratch disks
+	errInvalidScratchDisk        = errors.New("invalid scratch disk. Must be of the form size=SIZE[,fs=ext4][,label=LABEL]")
+	errUnableToCreateScratchDisk = errors.New("failed to create scratch disk")
+
+	// errors sharing host directories
+	errInvalidShare       = errors.New("invalid share. Must be of the form HOST:GUEST with an absolute GUEST path, optionally suffixed with :ro or :rw")
+	errUnableToBuildShare = errors.New("failed to build the image of a share")
+	errShareEscape        = errors.New("the path leaves the share")
+
+	// errors verifying the digests of artifacts
+	errInvalidDigest   = errors.New("invalid SHA-256 digest. Must be 64 hexadecimal characters")
+	errInvalidManifest = errors.New("invalid manifest")
+	errDigestMismatch  = errors.New("SHA-256 digest mismatch")
+
+	// errors resolving artifacts of the cache
+	errInvalidArtifactRef      = errors.New("invalid artifact reference. Must be of the form sha256:HEX")
+	errArtifactNotFound        = errors.New("artifact not found")
+	errAmbiguousArtifactRef    = errors.New("ambiguous artifact reference")
+	errCachedArtifactReadWrite = errors.New("cached artifacts are shared and can only be attached with :ro, or with root-drive-cow")
+	errUntrustedCachedFile     = errors.New("cached file cannot be trusted")
+
+	// errors configuring the jailer
+	errInvalidJailID        = errors.New("invalid jail ID. Must be 1 to 64 alphanumeric characters or hyphens")
+	errExecFileConflict     = errors.New("exec-file and firecracker-binary must be the same binary when using the jailer")
+	errRootJail             = errors.New("the jail would run firecracker as root. Give a uid with --uid, or allow it with --allow-root-jail")
+	errInvalidCgroupSetting = errors.New("invalid cgroup setting. Must be of the form FILE=VALUE, such as cpu.max=50000")
+	errInvalidParentCgroup  = errors.New("invalid parent cgroup. Must be a relative path without ..")
+	errInvalidResourceLimit = errors.New("invalid resource limit. Must be of the form fsize=N or no-file=N")
+	errJailerOptionNoJailer = errors.New("jailer options require the jailer")
+	errUnableToStageJail    = errors.New("failed to stage a file into the jail")
+	errGCFailed             = errors.New("failed to remove stale jails, sockets or FIFO directories")
+
+	// errors reading or checking lockfiles
+	errInvalidLock = errors.New("invalid lockfile")
+	errLockDrift   = errors.New("the microVM drifted from the lockfile")
+
+	// errors reading OCI runtime bundles
+	errInvalidOCISpec      = errors.New("invalid OCI runtime spec")
+	errOCIProcessArgs      = errors.New("the OCI runtime spec has no process args")
+	errOCIRootConflict     = errors.New("the root filesystem of an OCI bundle cannot be used with root-drive, root-from-dir or root-from-tar")
+	errOCIProcessNotFound  = errors.New("the command of the OCI process was not found in its rootfs")
+	errOCIProcessNeedsMMDS = errors.New("the working directory and user of the OCI process are published in MMDS, which requires a tap device")
+	errInvalidKernelParam  = errors.New("cannot be passed on the kernel command line")
+
+	// errors checking the kernel image
+	errUnknownKernelFormat     = errors.New("unknown kernel image format")
+	errUnsupportedKernelFormat = errors.New("unsupported kernel image format")
+	errUnableToExtractKernel   = errors.New("failed to extract vmlinux from bzImage")
+
+	// errors checking the firecracker version
+	errUnsupportedFirecracker = errors.New("unsupported firecracker")
+	errUnsupportedFeature     = errors.New("unsupported by firecracker")
+	errUntestedFirecracker    = errors.New("untested firecracker")
+	errSerialOutJailer        = errors.New("serial-out is not supported with the jailer")
 )
+
+// ConfigError is returned when an option is invalid
+type ConfigError struct {
+	// Field is the name of the option, as given on the command line
+	Field string
+	// Value is the offending value of the option
+	Value string
+	// Reason describes why the value is invalid
+	Reason string
+	// Err is the underlying error, usually one of the errors above
+	Err error
+}
+
+func newConfigError(field, value string, err error) *ConfigError {
+	return &ConfigError{
+		Field:  field,
+		Value:  value,
+		Reason: err.Error(),
+		Err:    err,
+	}
+}
+
+func (e *ConfigError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("invalid --%s: %s", e.Field, e.Reason)
+	}
+	return fmt.Sprintf("invalid --%s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// phases of the VMM lifecycle reported by VMMError
+const (
+	vmmPhaseBinary = "binary"
+	vmmPhaseCreate = "create"
+	vmmPhaseStart  = "start"
+	vmmPhaseWait   = "wait"
+)
+
+var vmmPhaseDescriptions = map[string]string{
+	vmmPhaseBinary: "failed to find firecracker binary",
+	vmmPhaseCreate: "failed creating machine",
+	vmmPhaseStart:  "failed to start machine",
+	vmmPhaseWait:   "failed waiting for machine",
+}
+
+// VMMError is returned when the VMM fails in one of the phases of its
+// lifecycle
+type VMMError struct {
+	Phase string
+	Err   error
+}
+
+func (e *VMMError) Error() string {
+	return fmt.Sprintf("%s: %v", vmmPhaseDescriptions[e.Phase], e.Err)
+}
+
+func (e *VMMError) Unwrap() error {
+	return e.Err
+}
+
+// HostError is returned when the host cannot run firecracker, such as when
+// KVM is not available
+type HostError struct {
+	Err error
+}
+
+func (e *HostError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+// error types reported with --error-format json
+const (
+	errorTypeConfig        = "config"
+	errorTypePreflight     = "preflight"
+	errorTypeVMM           = "vmm"
+	errorTypeHost          = "host"
+	errorTypeGuestFailure  = "guest_failure"
+	errorTypeScriptTimeout = "script_timeout"
+	errorTypeOther         = "error"
+)
+
+// errorOutput is the structured form of an error printed with
+// --error-format json
+type errorOutput struct {
+	Type     string `json:"type"`
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code"`
+	Field    string `json:"field,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Phase    string `json:"phase,omitempty"`
+	// Problems lists the problems found by the preflight checks
+	Problems []errorOutput `json:"problems,omitempty"`
+}
+
+func newErrorOutput(err error, code int) errorOutput {
+	out := errorOutput{
+		Type:     errorTypeOther,
+		Error:    err.Error(),
+		ExitCode: code,
+	}
+
+	var (
+		configErr  *ConfigError
+		vmmErr     *VMMError
+		guestErr   *guestFailureError
+		timeoutErr *scriptTimeoutError
+		preflight  *preflightError
+		hostErr    *HostError
+	)
+	switch {
+	case errors.As(err, &preflight):
+		out.Type = errorTypePreflight
+		for _, p := range preflight.problems {
+			out.Problems = append(out.Problems, newErrorOutput(p, exitCode(p, false)))
+		}
+	case errors.As(err, &guestErr):
+		out.Type = errorTypeGuestFailure
+		out.Reason = guestErr.reason
+	case errors.As(err, &timeoutErr):
+		out.Type = errorTypeScriptTimeout
+	case errors.As(err, &configErr):
+		out.Type = errorTypeConfig
+		out.Field = configErr.Field
+		out.Value = configErr.Value
+		out.Reason = configErr.Reason
+	case errors.As(err, &vmmErr):
+		out.Type = errorTypeVMM
+		out.Phase = vmmErr.Phase
+	case errors.As(err, &hostErr):
+		out.Type = errorTypeHost
+	}
+	return out
+}
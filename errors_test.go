@@ -0,0 +1,154 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestConfigError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		outMsg string
+		outIs  error
+	}{
+		{
+			name:   "with value",
+			err:    newConfigError("tap-device", "tap0", errInvalidNicConfig),
+			outMsg: `invalid --tap-device "tap0": NIC config wasn't of the form DEVICE/MACADDR`,
+			outIs:  errInvalidNicConfig,
+		},
+		{
+			name:   "without value",
+			err:    newConfigError("record-input", "", errRecordInputWithoutRecord),
+			outMsg: "invalid --record-input: record-input requires record to be set",
+			outIs:  errRecordInputWithoutRecord,
+		},
+		{
+			name: "wrapped sentinel",
+			err: newConfigError("console-log", "/log",
+				fmt.Errorf("%w: permission denied", errUnableToCreateConsoleLog)),
+			outMsg: `invalid --console-log "/log": failed to create console log: permission denied`,
+			outIs:  errUnableToCreateConsoleLog,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if msg := c.err.Error(); msg != c.outMsg {
+				t.Errorf("expected %q but got %q", c.outMsg, msg)
+			}
+			if !errors.Is(c.err, c.outIs) {
+				t.Errorf("expected %v to wrap %v", c.err, c.outIs)
+			}
+		})
+	}
+}
+
+func TestNewErrorOutput(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code int
+		out  errorOutput
+	}{
+		{
+			name: "config error",
+			err:  newConfigError("tap-device", "tap0", errInvalidNicConfig),
+			code: exitConfigError,
+			out: errorOutput{
+				Type:     errorTypeConfig,
+				Error:    `invalid --tap-device "tap0": NIC config wasn't of the form DEVICE/MACADDR`,
+				ExitCode: exitConfigError,
+				Field:    "tap-device",
+				Value:    "tap0",
+				Reason:   errInvalidNicConfig.Error(),
+			},
+		},
+		{
+			name: "vmm error",
+			err:  &VMMError{Phase: vmmPhaseStart, Err: errors.New("boom")},
+			code: exitStartFailure,
+			out: errorOutput{
+				Type:     errorTypeVMM,
+				Error:    "failed to start machine: boom",
+				ExitCode: exitStartFailure,
+				Phase:    vmmPhaseStart,
+			},
+		},
+		{
+			name: "guest failure",
+			err: &guestFailureError{
+				reason: guestFailureKernelPanic,
+				line:   "Kernel panic - not syncing: oops",
+			},
+			code: exitGuestFailure,
+			out: errorOutput{
+				Type:     errorTypeGuestFailure,
+				Error:    "guest failure: kernel panic: Kernel panic - not syncing: oops",
+				ExitCode: exitGuestFailure,
+				Reason:   guestFailureKernelPanic,
+			},
+		},
+		{
+			name: "preflight error",
+			err: &preflightError{problems: []error{
+				newConfigError("memory", "0", errInvalidMemorySize),
+				&HostError{Err: errKVMUnavailable},
+			}},
+			code: exitHostError,
+			out: errorOutput{
+				Type:     errorTypePreflight,
+				Error:    "preflight checks found 2 problem(s):\n  - invalid --memory \"0\": memory size must be positive\n  - KVM is not available",
+				ExitCode: exitHostError,
+				Problems: []errorOutput{
+					{
+						Type:     errorTypeConfig,
+						Error:    `invalid --memory "0": memory size must be positive`,
+						ExitCode: exitConfigError,
+						Field:    "memory",
+						Value:    "0",
+						Reason:   errInvalidMemorySize.Error(),
+					},
+					{
+						Type:     errorTypeHost,
+						Error:    "KVM is not available",
+						ExitCode: exitHostError,
+					},
+				},
+			},
+		},
+		{
+			name: "other error",
+			err:  errors.New("something went wrong"),
+			code: exitFailure,
+			out: errorOutput{
+				Type:     errorTypeOther,
+				Error:    "something went wrong",
+				ExitCode: exitFailure,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out := newErrorOutput(c.err, c.code)
+			if !reflect.DeepEqual(out, c.out) {
+				t.Errorf("expected %+v but got %+v", c.out, out)
+			}
+		})
+	}
+}
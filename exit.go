@@ -0,0 +1,265 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Exit statuses of firectl, these are documented in the README and must not
+// change.
+const (
+	// exitSuccess is the exit status when the guest shut down cleanly
+	exitSuccess = 0
+	// exitFailure is the exit status of errors which are not classified,
+	// such as firecracker exiting with an error
+	exitFailure = 1
+	// exitConfigError is the exit status when the options are invalid
+	exitConfigError = 2
+	// exitGuestFailure is the exit status when the guest kernel panicked or
+	// failed to boot, so that a bad image can be told apart from a host
+	// failure.
+	exitGuestFailure = 3
+	// exitBinaryNotFound is the exit status when the firecracker binary
+	// cannot be found or executed
+	exitBinaryNotFound = 4
+	// exitStartFailure is the exit status when the VMM failed to start
+	exitStartFailure = 5
+	// exitKilled is the exit status when the VMM was forcefully stopped, by
+	// a signal or because a script timed out
+	exitKilled = 6
+	// exitHostError is the exit status when the host cannot run firecracker,
+	// such as when KVM is not available
+	exitHostError = 7
+	// exitSignalBase is added to the number of the signal which made firectl
+	// shut the VM down, as shells do for processes killed by a signal
+	exitSignalBase = 128
+)
+
+// exitReasonSignal is the reason recorded in the exit report when the VM was
+// shut down because firectl received a signal
+const exitReasonSignal = "signal"
+
+// exitReasons are the reasons recorded in the exit report for each exit
+// status
+var exitReasons = map[int]string{
+	exitSuccess:        "shutdown",
+	exitFailure:        "error",
+	exitConfigError:    "config_error",
+	exitGuestFailure:   "guest_failure",
+	exitBinaryNotFound: "binary_not_found",
+	exitStartFailure:   "start_failure",
+	exitKilled:         "killed",
+	exitHostError:      "host_unavailable",
+}
+
+// preflightPrecedence orders the exit statuses of the problems found by the
+// preflight checks: the exit status of a preflight error is the first one
+// found among its problems, so that a missing binary or a host which cannot run
+// firecracker is not hidden by an unrelated invalid option.
+var preflightPrecedence = []int{exitBinaryNotFound, exitHostError, exitConfigError}
+
+// exitLogTailLines is the number of firecracker log lines kept for the exit
+// report
+const exitLogTailLines = 20
+
+// exitReport describes how a VM run ended, it is written as JSON to the path
+// given with --exit-report.
+type exitReport struct {
+	mu sync.Mutex
+
+	Reason    string    `json:"reason"`
+	ExitCode  int       `json:"exit_code"`
+	Error     string    `json:"error,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	// Duration is the run duration in seconds
+	Duration  float64  `json:"duration"`
+	LastState string   `json:"last_state,omitempty"`
+	LogTail   []string `json:"firecracker_log_tail,omitempty"`
+	// Signal is the name of the signal which made firectl stop the VM
+	Signal string `json:"signal,omitempty"`
+
+	// killedBy is set when the VMM is forcefully stopped
+	killedBy string
+	// signal is the first signal which made firectl stop the VM
+	signal  syscall.Signal
+	logTail *lineTail
+}
+
+func newExitReport(now time.Time) *exitReport {
+	return &exitReport{
+		StartTime: now,
+		logTail:   &lineTail{max: exitLogTailLines},
+	}
+}
+
+// setState records the last known state of the VM
+func (r *exitReport) setState(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.LastState = state
+}
+
+// setKilled records that the VMM is being forcefully stopped for the given
+// cause
+func (r *exitReport) setKilled(cause string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.killedBy == "" {
+		r.killedBy = cause
+	}
+}
+
+// setSignal records that the VM is being stopped because firectl received the
+// signal s
+func (r *exitReport) setSignal(s syscall.Signal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.signal == 0 {
+		r.signal = s
+	}
+}
+
+// finish completes the report with the result of the run and returns the exit
+// status of firectl.
+func (r *exitReport) finish(err error, now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ExitCode = exitCode(err, r.killedBy != "")
+	r.Reason = exitReasons[r.ExitCode]
+	if r.ExitCode == exitKilled && r.killedBy != "" {
+		r.Reason += ": " + r.killedBy
+	}
+	if r.signal != 0 {
+		r.Signal = unix.SignalName(r.signal)
+		// a clean shutdown requested by a signal is told apart from one
+		// initiated by the guest
+		if r.ExitCode == exitSuccess {
+			r.ExitCode = exitSignalBase + int(r.signal)
+			r.Reason = exitReasonSignal
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.Duration = now.Sub(r.StartTime).Seconds()
+	r.LogTail = r.logTail.lines()
+	return r.ExitCode
+}
+
+// write writes the report as JSON to path
+func (r *exitReport) write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// exitCode returns the exit status corresponding to the result of a run
+func exitCode(err error, killed bool) int {
+	var (
+		preflight  *preflightError
+		guestErr   *guestFailureError
+		timeoutErr *scriptTimeoutError
+		configErr  *ConfigError
+		vmmErr     *VMMError
+		hostErr    *HostError
+		processErr *exec.ExitError
+	)
+	switch {
+	case errors.As(err, &preflight):
+		codes := map[int]bool{}
+		for _, p := range preflight.problems {
+			codes[exitCode(p, false)] = true
+		}
+		for _, code := range preflightPrecedence {
+			if codes[code] {
+				return code
+			}
+		}
+		return exitFailure
+	case errors.As(err, &guestErr):
+		return exitGuestFailure
+	case errors.As(err, &timeoutErr):
+		return exitKilled
+	case errors.As(err, &configErr):
+		return exitConfigError
+	case errors.As(err, &vmmErr) && vmmErr.Phase == vmmPhaseBinary:
+		return exitBinaryNotFound
+	case errors.As(err, &vmmErr) && vmmErr.Phase != vmmPhaseWait:
+		return exitStartFailure
+	case errors.As(err, &hostErr):
+		return exitHostError
+	case killed:
+		return exitKilled
+	case errors.As(err, &processErr):
+		if status, ok := processErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return exitKilled
+		}
+		return exitFailure
+	case err != nil:
+		return exitFailure
+	}
+	return exitSuccess
+}
+
+// lineTail is an io.Writer keeping the last lines written to it
+type lineTail struct {
+	mu      sync.Mutex
+	max     int
+	tail    []string
+	partial string
+}
+
+func (t *lineTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := strings.Split(t.partial+string(p), "\n")
+	t.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		t.tail = append(t.tail, strings.TrimRight(line, "\r"))
+	}
+	if len(t.tail) > t.max {
+		t.tail = append([]string{}, t.tail[len(t.tail)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+func (t *lineTail) lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append([]string{}, t.tail...)
+	if t.partial != "" {
+		lines = append(lines, t.partial)
+	}
+	if len(lines) > t.max {
+		lines = lines[len(lines)-t.max:]
+	}
+	return lines
+}
@@ -0,0 +1,239 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	signaled := exec.Command("sh", "-c", "kill -TERM $$").Run()
+	failed := exec.Command("sh", "-c", "exit 3").Run()
+
+	cases := []struct {
+		name    string
+		err     error
+		killed  bool
+		outCode int
+	}{
+		{
+			name:    "clean shutdown",
+			err:     nil,
+			outCode: exitSuccess,
+		},
+		{
+			name:    "config error",
+			err:     newConfigError("tap-device", "tap0", errInvalidNicConfig),
+			outCode: exitConfigError,
+		},
+		{
+			name:    "binary not found",
+			err:     &VMMError{Phase: vmmPhaseBinary, Err: os.ErrNotExist},
+			outCode: exitBinaryNotFound,
+		},
+		{
+			name:    "start failure",
+			err:     &VMMError{Phase: vmmPhaseStart, Err: errors.New("boom")},
+			outCode: exitStartFailure,
+		},
+		{
+			name:    "wrapped guest failure",
+			err:     fmt.Errorf("boot: %w", &guestFailureError{reason: guestFailureKernelPanic}),
+			outCode: exitGuestFailure,
+		},
+		{
+			name:    "script timeout",
+			err:     &scriptTimeoutError{line: 1},
+			outCode: exitKilled,
+		},
+		{
+			name:    "stopped with escape sequence",
+			err:     fmt.Errorf("Wait returned an error %w", failed),
+			killed:  true,
+			outCode: exitKilled,
+		},
+		{
+			name:    "firecracker killed by a signal",
+			err:     &VMMError{Phase: vmmPhaseWait, Err: signaled},
+			outCode: exitKilled,
+		},
+		{
+			name:    "firecracker failed",
+			err:     &VMMError{Phase: vmmPhaseWait, Err: failed},
+			outCode: exitFailure,
+		},
+		{
+			name:    "KVM not available",
+			err:     &preflightError{problems: []error{&HostError{Err: errKVMUnavailable}}},
+			outCode: exitHostError,
+		},
+		{
+			name: "binary not found before config error",
+			err: &preflightError{problems: []error{
+				newConfigError("memory", "0", errInvalidMemorySize),
+				&VMMError{Phase: vmmPhaseBinary, Err: os.ErrNotExist},
+			}},
+			outCode: exitBinaryNotFound,
+		},
+		{
+			name: "host error before config error",
+			err: &preflightError{problems: []error{
+				newConfigError("memory", "0", errInvalidMemorySize),
+				&HostError{Err: errKVMUnavailable},
+			}},
+			outCode: exitHostError,
+		},
+		{
+			name: "config error among preflight problems",
+			err: &preflightError{problems: []error{
+				newConfigError("memory", "0", errInvalidMemorySize),
+				errors.New("something went wrong"),
+			}},
+			outCode: exitConfigError,
+		},
+		{
+			name:    "unclassified error",
+			err:     errors.New("something went wrong"),
+			outCode: exitFailure,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if code := exitCode(c.err, c.killed); code != c.outCode {
+				t.Errorf("expected exit code %d but got %d for %v", c.outCode, code, c.err)
+			}
+		})
+	}
+}
+
+func TestExitReport(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	report := newExitReport(start)
+	report.setState("Running")
+	report.setKilled("signal quit")
+	for i := 0; i < exitLogTailLines+5; i++ {
+		fmt.Fprintf(report.logTail, "line %d\n", i)
+	}
+	fmt.Fprint(report.logTail, "partial")
+
+	if code := report.finish(errors.New("stopped"), start.Add(90*time.Second)); code != exitKilled {
+		t.Errorf("expected exit code %d but got %d", exitKilled, code)
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := report.write(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"reason":     "killed: signal quit",
+		"exit_code":  float64(exitKilled),
+		"error":      "stopped",
+		"start_time": "2021-01-01T00:00:00Z",
+		"duration":   float64(90),
+		"last_state": "Running",
+	}
+	tail, _ := out["firecracker_log_tail"].([]interface{})
+	delete(out, "firecracker_log_tail")
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected %v but got %v", expected, out)
+	}
+	if len(tail) != exitLogTailLines || tail[0] != "line 6" || tail[len(tail)-1] != "partial" {
+		t.Errorf("unexpected log tail %v", tail)
+	}
+}
+
+func TestExitReportSignal(t *testing.T) {
+	cases := []struct {
+		name      string
+		signal    syscall.Signal
+		killed    bool
+		err       error
+		outCode   int
+		outReason string
+		outSignal string
+	}{
+		{
+			name:      "shut down by the guest",
+			outCode:   exitSuccess,
+			outReason: "shutdown",
+		},
+		{
+			name:      "shut down on SIGTERM",
+			signal:    syscall.SIGTERM,
+			outCode:   143,
+			outReason: exitReasonSignal,
+			outSignal: "SIGTERM",
+		},
+		{
+			name:      "shut down on SIGINT",
+			signal:    syscall.SIGINT,
+			outCode:   130,
+			outReason: exitReasonSignal,
+			outSignal: "SIGINT",
+		},
+		{
+			name:      "failed after SIGTERM",
+			signal:    syscall.SIGTERM,
+			err:       errors.New("boom"),
+			outCode:   exitFailure,
+			outReason: "error",
+			outSignal: "SIGTERM",
+		},
+		{
+			name:      "stopped on SIGQUIT",
+			signal:    syscall.SIGQUIT,
+			killed:    true,
+			outCode:   exitKilled,
+			outReason: "killed: signal quit",
+			outSignal: "SIGQUIT",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			report := newExitReport(time.Now())
+			if c.signal != 0 {
+				report.setSignal(c.signal)
+			}
+			if c.killed {
+				report.setKilled("signal quit")
+			}
+			if code := report.finish(c.err, time.Now()); code != c.outCode {
+				t.Errorf("expected exit code %d but got %d", c.outCode, code)
+			}
+			if report.Reason != c.outReason || report.Signal != c.outSignal {
+				t.Errorf("expected reason %q and signal %q but got %q and %q",
+					c.outReason, c.outSignal, report.Reason, report.Signal)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// gcGracePeriod is how long jails and FIFO directories are left alone after
+// they were modified, as they may belong to a microVM being started
+const gcGracePeriod = time.Minute
+
+var (
+	// procPath is the path of procfs
+	procPath = "/proc"
+	// cgroupRoot is the path of the cgroup filesystem
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// gcOptions are the options of the gc command
+type gcOptions struct {
+	DryRun bool `long:"dry-run" description:"Print what would be removed without removing it"`
+}
+
+// processes returns the IDs of the running processes
+func processes() ([]string, error) {
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	var pids []string
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err == nil {
+			pids = append(pids, entry.Name())
+		}
+	}
+	return pids, nil
+}
+
+// fileID identifies a file by its device and inode
+type fileID struct {
+	dev, ino uint64
+}
+
+// statFileID returns the ID of the file at path, following symlinks
+func statFileID(path string) (fileID, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return fileID{}, err
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, nil
+}
+
+// processRoots returns the IDs of the root directories of the running
+// processes, which are the jails of jailed processes. The path of the root
+// of a process which pivoted into its jail in its own mount namespace, as
+// the jailer does, is "/", so roots are compared by device and inode.
+func processRoots() (map[fileID]bool, error) {
+	pids, err := processes()
+	if err != nil {
+		return nil, err
+	}
+	roots := map[fileID]bool{}
+	for _, pid := range pids {
+		// processes may exit while they are listed
+		if root, err := statFileID(filepath.Join(procPath, pid, "root")); err == nil {
+			roots[root] = true
+		}
+	}
+	return roots, nil
+}
+
+// processFiles returns the paths of the files the running processes have
+// open
+func processFiles() (map[string]bool, error) {
+	pids, err := processes()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]bool{}
+	for _, pid := range pids {
+		fds, err := os.ReadDir(filepath.Join(procPath, pid, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if path, err := os.Readlink(filepath.Join(procPath, pid, "fd", fd.Name())); err == nil {
+				files[path] = true
+			}
+		}
+	}
+	return files, nil
+}
+
+// jailInUse reports whether a process runs in the jail root, or in one of
+// the cgroups of its microVM
+func jailInUse(root string, cgroups []string) (bool, error) {
+	roots, err := processRoots()
+	if err != nil {
+		return false, err
+	}
+	return jailRunning(root, cgroups, roots), nil
+}
+
+// jailRunning reports whether one of the processes with the given roots runs
+// in the jail root, or a process runs in one of the cgroups of its microVM
+func jailRunning(root string, cgroups []string, roots map[fileID]bool) bool {
+	if id, err := statFileID(root); err == nil && roots[id] {
+		return true
+	}
+	for _, cgroup := range cgroups {
+		procs, err := os.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+		if err == nil && len(strings.TrimSpace(string(procs))) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// jailCgroups returns the cgroups the jailer created for the microVM id in
+// parent, in the cgroup v2 hierarchy or in the hierarchy of each cgroup v1
+// controller
+func jailCgroups(parent, id string) []string {
+	var cgroups []string
+	for _, pattern := range []string{
+		filepath.Join(cgroupRoot, parent, id),
+		filepath.Join(cgroupRoot, "*", parent, id),
+	} {
+		matches, _ := filepath.Glob(pattern)
+		cgroups = append(cgroups, matches...)
+	}
+	return cgroups
+}
+
+// removeJail removes the jail dir and the cgroups of its microVM
+func removeJail(dir string, cgroups []string) error {
+	err := os.RemoveAll(dir)
+	for _, cgroup := range cgroups {
+		// cgroups are removed with rmdir, their files cannot be removed
+		if rmErr := os.Remove(cgroup); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
+
+// socketPID returns the ID of the firectl process which created the default
+// firecracker socket at path
+func socketPID(path string) (int, bool) {
+	fields := strings.Split(filepath.Base(path), "-")
+	if len(fields) != 3 {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(fields[1])
+	return pid, err == nil
+}
+
+// processRunning reports whether the process pid is running
+func processRunning(pid int) bool {
+	return unix.Kill(pid, 0) != unix.ESRCH
+}
+
+// recentlyModified reports whether path was modified within the grace period
+func recentlyModified(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) < gcGracePeriod
+}
+
+// runGC removes the jails, default firecracker sockets and FIFO directories
+// left behind by microVMs which are no longer running, writing what it
+// removes to w.
+func (opts *options) runGC(w io.Writer, gc *gcOptions) error {
+	roots, err := processRoots()
+	if err != nil {
+		return err
+	}
+	files, err := processFiles()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	remove := func(kind, path string, fn func() error) {
+		if gc.DryRun {
+			fmt.Fprintf(w, "would remove %s %s\n", kind, path)
+			return
+		}
+		if err := fn(); err != nil {
+			log.Errorf("Failed to remove %s %s: %v", kind, path, err)
+			failed++
+			return
+		}
+		fmt.Fprintf(w, "removed %s %s\n", kind, path)
+	}
+
+	// jails, as CHROOT_BASE/EXEC_FILE_NAME/ID/root
+	base := opts.ChrootBaseDir
+	if base == "" {
+		base = defaultChrootBaseDir
+	}
+	jails, err := filepath.Glob(filepath.Join(base, "*", "*", jailRootDir))
+	if err != nil {
+		return err
+	}
+	for _, root := range jails {
+		dir := filepath.Dir(root)
+		parent := opts.ParentCgroup
+		if parent == "" {
+			parent = filepath.Base(filepath.Dir(dir))
+		}
+		cgroups := jailCgroups(parent, filepath.Base(dir))
+		if jailRunning(root, cgroups, roots) || recentlyModified(dir) {
+			continue
+		}
+		remove("jail", dir, func() error {
+			return removeJail(dir, cgroups)
+		})
+	}
+
+	// default firecracker sockets, named after the firectl process
+	for i, dir := range []string{os.Getenv("HOME"), os.TempDir()} {
+		if dir == "" || (i > 0 && dir == os.Getenv("HOME")) {
+			continue
+		}
+		sockets, err := filepath.Glob(filepath.Join(dir, ".firecracker.sock-*"))
+		if err != nil {
+			return err
+		}
+		for _, socket := range sockets {
+			if pid, ok := socketPID(socket); !ok || processRunning(pid) {
+				continue
+			}
+			remove("socket", socket, func() error {
+				return os.Remove(socket)
+			})
+		}
+	}
+
+	// FIFO directories, which are in use while a process has a FIFO open
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), "fcfifo*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !checkExistsAndDir(dir) || recentlyModified(dir) {
+			continue
+		}
+		inUse := false
+		for file := range files {
+			if strings.HasPrefix(file, dir+string(filepath.Separator)) {
+				inUse = true
+				break
+			}
+		}
+		if inUse {
+			continue
+		}
+		remove("FIFO directory", dir, func() error {
+			return os.RemoveAll(dir)
+		})
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: %d paths could not be removed", errGCFailed, failed)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	dir := t.TempDir()
+	proc, cgroups, home, tmp := filepath.Join(dir, "proc"), filepath.Join(dir, "cgroup"), filepath.Join(dir, "home"), filepath.Join(dir, "tmp")
+	base := filepath.Join(dir, "jailer")
+	oldProc, oldCgroups := procPath, cgroupRoot
+	procPath, cgroupRoot = proc, cgroups
+	t.Cleanup(func() {
+		procPath, cgroupRoot = oldProc, oldCgroups
+	})
+	t.Setenv("HOME", home)
+	t.Setenv("TMPDIR", tmp)
+
+	old := time.Now().Add(-time.Hour)
+	mkdir := func(path string) string {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for _, d := range []string{home, tmp, filepath.Join(proc, "1", "fd"), filepath.Join(proc, "2"), filepath.Join(proc, "3")} {
+		mkdir(d)
+	}
+	liveJail := mkdir(filepath.Join(base, "firecracker", "live", jailRootDir))
+	pivotedJail := mkdir(filepath.Join(base, "firecracker", "pivoted", jailRootDir))
+	aliasedJail := mkdir(filepath.Join(base, "firecracker", "aliased", jailRootDir))
+	staleJail := mkdir(filepath.Join(base, "firecracker", "stale", jailRootDir))
+	newJail := mkdir(filepath.Join(base, "firecracker", "new", jailRootDir))
+	staleCgroup := mkdir(filepath.Join(cgroups, "firecracker", "stale"))
+	pivotedCgroup := mkdir(filepath.Join(cgroups, "firecracker", "pivoted"))
+	liveFifos := mkdir(filepath.Join(tmp, "fcfifo123"))
+	staleFifos := mkdir(filepath.Join(tmp, "fcfifo456"))
+	for _, d := range []string{filepath.Dir(liveJail), filepath.Dir(pivotedJail), filepath.Dir(aliasedJail), filepath.Dir(staleJail), liveFifos, staleFifos} {
+		if err := os.Chtimes(d, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a process runs in the live jail and has a FIFO of the live directory
+	// open
+	if err := os.Symlink(liveJail, filepath.Join(proc, "1", "root")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(liveFifos, "fc_fifo"), filepath.Join(proc, "1", "fd", "3")); err != nil {
+		t.Fatal(err)
+	}
+	// a process which pivoted into its jail has "/" as root, but runs in the
+	// cgroup of the microVM
+	if err := os.Symlink("/", filepath.Join(proc, "2", "root")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pivotedCgroup, "cgroup.procs"), []byte("2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a process whose root is the jail under another path, as through a
+	// bind mount
+	alias := filepath.Join(dir, "alias")
+	if err := os.Symlink(aliasedJail, alias); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(alias, filepath.Join(proc, "3", "root")); err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{liveJail, pivotedJail, aliasedJail} {
+		cgroups := jailCgroups("firecracker", filepath.Base(filepath.Dir(root)))
+		if inUse, err := jailInUse(root, cgroups); err != nil || !inUse {
+			t.Errorf("expected %s to be in use but got %v, %v", root, inUse, err)
+		}
+	}
+	liveSocket := filepath.Join(home, ".firecracker.sock-"+strconv.Itoa(os.Getpid())+"-1")
+	staleSocket := filepath.Join(home, ".firecracker.sock-999999999-1")
+	for _, socket := range []string{liveSocket, staleSocket} {
+		if err := os.WriteFile(socket, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &options{ChrootBaseDir: base}
+	var out bytes.Buffer
+	if err := opts.runGC(&out, &gcOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 {
+		t.Fatalf("expected 3 stale paths but got %q", out.String())
+	}
+	if _, err := os.Stat(staleJail); err != nil {
+		t.Fatalf("expected a dry run not to remove anything: %v", err)
+	}
+
+	out.Reset()
+	if err := opts.runGC(&out, &gcOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Dir(staleJail), staleCgroup, staleSocket, staleFifos} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed but got %v", path, err)
+		}
+	}
+	for _, path := range []string{liveJail, pivotedJail, pivotedCgroup, aliasedJail, newJail, liveSocket, liveFifos} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxDetectorLineLength bounds the size of the partial line kept by the
+// detector when the output contains no newline.
+const maxDetectorLineLength = 4096
+
+// reasons of guest failures
+const (
+	guestFailureRootFS      = "unable to mount root filesystem"
+	guestFailureInit        = "init failure"
+	guestFailureKernelPanic = "kernel panic"
+	guestFailureVCPU        = "vCPU failure"
+)
+
+// guestFailurePatterns are the console and firecracker log messages which
+// indicate that the guest failed, more specific patterns come first.
+var guestFailurePatterns = []struct {
+	re     *regexp.Regexp
+	reason string
+}{
+	{regexp.MustCompile(`VFS: Unable to mount root fs`), guestFailureRootFS},
+	{regexp.MustCompile(`VFS: Cannot open root device`), guestFailureRootFS},
+	{regexp.MustCompile(`No working init found`), guestFailureInit},
+	{regexp.MustCompile(`Requested init \S+ failed`), guestFailureInit},
+	{regexp.MustCompile(`Failed to execute \S+ \(error -?\d+\)`), guestFailureInit},
+	{regexp.MustCompile(`Attempted to kill init!`), guestFailureInit},
+	{regexp.MustCompile(`Kernel panic - not syncing`), guestFailureKernelPanic},
+	{regexp.MustCompile(`KVM_EXIT_(INTERNAL_ERROR|FAIL_ENTRY)`), guestFailureVCPU},
+}
+
+// guestFailureError is returned when the guest kernel panicked or failed to
+// boot.
+type guestFailureError struct {
+	reason string
+	// line is the output line the failure was detected from
+	line string
+}
+
+func (e *guestFailureError) Error() string {
+	return fmt.Sprintf("guest failure: %s: %s", e.reason, e.line)
+}
+
+// guestFailureDetector watches the guest console and the firecracker log for
+// messages indicating a guest failure, and records the first one.
+type guestFailureDetector struct {
+	mu  sync.Mutex
+	err *guestFailureError
+}
+
+// stream returns a writer to which a line oriented output, such as the
+// console or the firecracker log, is written.
+func (d *guestFailureDetector) stream() *guestFailureStream {
+	return &guestFailureStream{detector: d}
+}
+
+// failure returns the first failure detected, or nil
+func (d *guestFailureDetector) failure() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		return nil
+	}
+	return d.err
+}
+
+func (d *guestFailureDetector) scan(s *guestFailureStream, p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data := append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		d.check(data[:i])
+		data = data[i+1:]
+	}
+
+	if len(data) > maxDetectorLineLength {
+		d.check(data)
+		data = nil
+	}
+	s.partial = append([]byte{}, data...)
+}
+
+func (d *guestFailureDetector) check(line []byte) {
+	if d.err != nil {
+		return
+	}
+	for _, p := range guestFailurePatterns {
+		if p.re.Match(line) {
+			d.err = &guestFailureError{
+				reason: p.reason,
+				line:   strings.TrimSpace(string(line)),
+			}
+			return
+		}
+	}
+}
+
+// guestFailureStream is one of the outputs watched by a detector
+type guestFailureStream struct {
+	detector *guestFailureDetector
+	// partial is the last line, until its newline is written
+	partial []byte
+}
+
+func (s *guestFailureStream) Write(p []byte) (int, error) {
+	s.detector.scan(s, p)
+	return len(p), nil
+}
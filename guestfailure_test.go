@@ -0,0 +1,100 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestGuestFailureDetector(t *testing.T) {
+	cases := []struct {
+		name      string
+		console   []string
+		log       []string
+		outReason string
+		outLine   string
+	}{
+		{
+			name:    "clean boot",
+			console: []string{"[    0.000000] Linux version 4.14\r\n", "Welcome!\r\nlogin: "},
+		},
+		{
+			name: "missing root fs",
+			console: []string{
+				"[    0.512345] VFS: Cannot open root device \"vda\" or unknown-block(0,0): error -6\r\n",
+				"[    0.512346] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0)\r\n",
+			},
+			outReason: guestFailureRootFS,
+			outLine:   "[    0.512345] VFS: Cannot open root device \"vda\" or unknown-block(0,0): error -6",
+		},
+		{
+			name: "init failure split across writes",
+			console: []string{
+				"[    0.6] Kernel panic - not syn",
+				"cing: No working init found.  Try passing init= option to kernel.\r\n",
+			},
+			outReason: guestFailureInit,
+			outLine:   "[    0.6] Kernel panic - not syncing: No working init found.  Try passing init= option to kernel.",
+		},
+		{
+			name:      "generic panic",
+			console:   []string{"Kernel panic - not syncing: Fatal exception\r\n"},
+			outReason: guestFailureKernelPanic,
+			outLine:   "Kernel panic - not syncing: Fatal exception",
+		},
+		{
+			name:      "vcpu failure in firecracker log",
+			log:       []string{"[anonymous-instance:fc_vcpu 0] Unexpected exit reason on vcpu run: KVM_EXIT_INTERNAL_ERROR\n"},
+			outReason: guestFailureVCPU,
+			outLine:   "[anonymous-instance:fc_vcpu 0] Unexpected exit reason on vcpu run: KVM_EXIT_INTERNAL_ERROR",
+		},
+		{
+			name:    "lines are not mixed across streams",
+			console: []string{"Kernel panic"},
+			log:     []string{" - not syncing\n"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := &guestFailureDetector{}
+			console, log := d.stream(), d.stream()
+			for _, p := range c.console {
+				console.Write([]byte(p))
+			}
+			for _, p := range c.log {
+				log.Write([]byte(p))
+			}
+
+			err := d.failure()
+			if c.outReason == "" {
+				if err != nil {
+					t.Errorf("expected no failure but got %v", err)
+				}
+				return
+			}
+			failure, ok := err.(*guestFailureError)
+			if !ok {
+				t.Fatalf("expected a guest failure but got %v", err)
+			}
+			if failure.reason != c.outReason || failure.line != c.outLine {
+				t.Errorf("expected (%s, %q) but got (%s, %q)",
+					c.outReason,
+					c.outLine,
+					failure.reason,
+					failure.line)
+			}
+		})
+	}
+}
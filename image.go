@@ -0,0 +1,470 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mke2fsBinary  = "mke2fs"
+	debugfsBinary = "debugfs"
+
+	// imageBlockSize is the block size used to estimate the size of an image
+	imageBlockSize = 4096
+	// imageHeadroom is added to the estimated size of an image, for the
+	// journal, the metadata and some free space
+	imageHeadroom = 64 << 20
+)
+
+// inode types as stored in ext4, used to set the mode with debugfs
+const (
+	ext4ModeFifo    = 0010000
+	ext4ModeChar    = 0020000
+	ext4ModeDir     = 0040000
+	ext4ModeBlock   = 0060000
+	ext4ModeRegular = 0100000
+)
+
+// imageBuildOptions are the options of the image build command
+type imageBuildOptions struct {
+	FromDir string `long:"from-dir" description:"Build the image from the given directory"`
+	FromTar string `long:"from-tar" description:"Build the image from the given tarball, optionally gzipped, such as the output of docker export"`
+	Size    string `long:"size" description:"Size of the image, such as 512M or 2G. Defaults to the size of the content with some headroom"`
+	Output  string `long:"output" short:"o" description:"Path of the image" required:"true"`
+}
+
+// build builds the image described by the options of the image build command
+func (o *imageBuildOptions) build() error {
+	if (o.FromDir == "") == (o.FromTar == "") {
+		return newConfigError("from-dir", o.FromDir, errImageSource)
+	}
+	if o.FromDir != "" && !checkExistsAndDir(o.FromDir) {
+		return newConfigError("from-dir", o.FromDir, fmt.Errorf("%s is not a directory", o.FromDir))
+	}
+	if o.FromTar != "" {
+		if err := checkFile(o.FromTar, unix.R_OK); err != nil {
+			return newConfigError("from-tar", o.FromTar, err)
+		}
+	}
+	size, err := parseSize(o.Size)
+	if err != nil {
+		return newConfigError("size", o.Size, err)
+	}
+	if _, err := os.Lstat(o.Output); err == nil {
+		return newConfigError("output", o.Output, errImageExists)
+	}
+	if err := buildExt4Image(o.FromDir, o.FromTar, size, "", o.Output); err != nil {
+		return err
+	}
+	log.Infof("Built %s", o.Output)
+	return nil
+}
+
+// parseSize parses a size such as 512M or 2G, in bytes. An empty size is 0.
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(size), "B"), "I")
+	shift := 0
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return 0, errInvalidImageSize
+	}
+	return n << shift, nil
+}
+
+// imageTools returns the tools needed to build an image, debugfs being needed
+// to set the owners and device nodes of a tarball
+func imageTools(fromTar string) []string {
+	if fromTar != "" {
+		return []string{mke2fsBinary, debugfsBinary}
+	}
+	return []string{mke2fsBinary}
+}
+
+// buildExt4Image builds a sparse ext4 image at output from the directory
+// fromDir or the tarball fromTar, labelled with label if not empty. If size is
+// 0 the size of the image is estimated from its content.
+func buildExt4Image(fromDir, fromTar string, size int64, label, output string) error {
+	for _, tool := range imageTools(fromTar) {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%w: %s is required: %w", errUnableToBuildImage, tool, err)
+		}
+	}
+
+	var debugfsCommands []string
+	if fromTar != "" {
+		dir, err := os.MkdirTemp("", "firectl-rootfs-")
+		if err != nil {
+			return fmt.Errorf("%w: %w", errUnableToBuildImage, err)
+		}
+		defer os.RemoveAll(dir)
+
+		if debugfsCommands, err = extractTar(fromTar, dir); err != nil {
+			return fmt.Errorf("%w: extracting %s: %w", errUnableToBuildImage, fromTar, err)
+		}
+		fromDir = dir
+	}
+
+	if size == 0 {
+		var err error
+		if size, err = estimateImageSize(fromDir); err != nil {
+			return fmt.Errorf("%w: %w", errUnableToBuildImage, err)
+		}
+	}
+
+	// the image is built next to the output and renamed once complete, so
+	// that a failed build leaves nothing behind
+	tmp, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+".*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildImage, err)
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Truncate(size)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildImage, err)
+	}
+
+	args := []string{"-q", "-F", "-t", "ext4", "-d", fromDir}
+	if label != "" {
+		args = append(args, "-L", label)
+	}
+	if err := runImageTool(mke2fsBinary, nil, append(args, tmp.Name())...); err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildImage, err)
+	}
+	if len(debugfsCommands) > 0 {
+		script := strings.Join(debugfsCommands, "\n") + "\n"
+		if err := runImageTool(debugfsBinary, strings.NewReader(script), "-w", "-f", "-", tmp.Name()); err != nil {
+			return fmt.Errorf("%w: %w", errUnableToBuildImage, err)
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), output); err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildImage, err)
+	}
+	return nil
+}
+
+// runImageTool runs one of the e2fsprogs tools
+func runImageTool(name string, stdin io.Reader, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = stdin
+	return runToolCommand(cmd)
+}
+
+// runToolCommand runs the command of an image tool, logging its output or
+// returning it in the error if it fails
+func runToolCommand(cmd *exec.Cmd) error {
+	name := cmd.Args[0]
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(output.Bytes()))
+	}
+	log.Debugf("%s: %s", name, bytes.TrimSpace(output.Bytes()))
+	return nil
+}
+
+// estimateImageSize returns a size for an image holding the content of dir,
+// rounded up to a MiB.
+func estimateImageSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// every entry takes an inode and at least a block
+		total += imageBlockSize
+		if info.Mode().IsRegular() {
+			total += (info.Size() + imageBlockSize - 1) / imageBlockSize * imageBlockSize
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	size := total + total/4 + imageHeadroom
+	return (size + 1<<20 - 1) >> 20 << 20, nil
+}
+
+// extractTar extracts the tarball at tarPath into dir. The entries are
+// extracted with the permissions of the current user, the owners, modes and
+// device nodes which cannot be reproduced that way are returned as debugfs
+// commands to apply to the image built from dir.
+func extractTar(tarPath, dir string) ([]string, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	uid, gid := os.Geteuid(), os.Getegid()
+	var commands []string
+	// directories are extracted writable and their times are set once their
+	// content has been extracted
+	dirTimes := map[string]time.Time{}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name, target, err := tarEntryPath(dir, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "/" && hdr.Typeflag != tar.TypeDir {
+			return nil, fmt.Errorf("%w: %s", errUnsafeTarPath, hdr.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		// entries are extracted readable and writable by the current user,
+		// their permissions are fixed up in the image if they differ
+		perm := hdr.FileInfo().Mode().Perm()
+		var mode int64
+		var extracted fs.FileMode
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			mode = ext4ModeDir
+			// a symlink extracted earlier would make the directory the
+			// one it links to, possibly outside of dir
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				if info.Mode()&fs.ModeSymlink != 0 {
+					return nil, fmt.Errorf("%w: %s", errUnsafeTarPath, hdr.Name)
+				}
+				if err := os.Remove(target); err != nil {
+					return nil, err
+				}
+			}
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return nil, err
+			}
+			extracted = perm | 0700
+			if err := os.Chmod(target, extracted); err != nil {
+				return nil, err
+			}
+			dirTimes[target] = hdr.ModTime
+		case tar.TypeReg, tar.TypeRegA:
+			mode = ext4ModeRegular
+			extracted = perm | 0600
+			if err := writeTarFile(target, tr, extracted, hdr.ModTime); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			_, linkTarget, err := tarEntryPath(dir, hdr.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return nil, err
+			}
+			// the link shares the inode, which is fixed up with its target
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			// device nodes are only created in the image
+			if !debugfsPathOK(name) {
+				log.Warnf("Skipping %s, its name cannot be passed to %s", hdr.Name, debugfsBinary)
+				continue
+			}
+			// mknod creates the node in the current directory of debugfs
+			node := "p"
+			switch hdr.Typeflag {
+			case tar.TypeChar:
+				mode = ext4ModeChar
+				node = fmt.Sprintf("c %d %d", hdr.Devmajor, hdr.Devminor)
+			case tar.TypeBlock:
+				mode = ext4ModeBlock
+				node = fmt.Sprintf("b %d %d", hdr.Devmajor, hdr.Devminor)
+			default:
+				mode = ext4ModeFifo
+			}
+			commands = append(commands,
+				fmt.Sprintf("cd \"%s\"", path.Dir(name)),
+				fmt.Sprintf("mknod \"%s\" %s", path.Base(name), node),
+				"cd /")
+		default:
+			log.Warnf("Skipping %s of unsupported type %q", hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		// fix up what the extraction could not reproduce
+		if !debugfsPathOK(name) {
+			log.Warnf("The owner and mode of %s cannot be set, its name cannot be passed to %s", hdr.Name, debugfsBinary)
+			continue
+		}
+		// symlinks have no mode of their own, device nodes are created
+		// without permissions
+		if mode != 0 && (extracted == 0 || hdr.Mode&07777 != int64(extracted)) {
+			commands = append(commands, fmt.Sprintf("sif \"%s\" mode 0%o", name, mode|hdr.Mode&07777))
+		}
+		if hdr.Uid != uid {
+			commands = append(commands, fmt.Sprintf("sif \"%s\" uid %d", name, hdr.Uid))
+		}
+		if hdr.Gid != gid {
+			commands = append(commands, fmt.Sprintf("sif \"%s\" gid %d", name, hdr.Gid))
+		}
+	}
+
+	for target, mtime := range dirTimes {
+		if err := os.Chtimes(target, mtime, mtime); err != nil {
+			return nil, err
+		}
+	}
+	return commands, nil
+}
+
+// tarEntryPath returns the absolute path of a tarball entry in the image and
+// its path in dir. Entries escaping dir, either with .. or through a symlink
+// extracted earlier, are rejected.
+func tarEntryPath(dir, entry string) (string, string, error) {
+	for _, elem := range strings.Split(entry, "/") {
+		if elem == ".." {
+			return "", "", fmt.Errorf("%w: %s", errUnsafeTarPath, entry)
+		}
+	}
+	name := path.Clean("/" + entry)
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	for p := filepath.Dir(target); len(p) > len(dir); p = filepath.Dir(p) {
+		if info, err := os.Lstat(p); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return "", "", fmt.Errorf("%w: %s", errUnsafeTarPath, entry)
+		}
+	}
+	return name, target, nil
+}
+
+// debugfsPathOK reports whether name can be quoted in a debugfs command
+func debugfsPathOK(name string) bool {
+	return !strings.ContainsAny(name, "\"\n")
+}
+
+// writeTarFile writes the content of a regular file entry to target
+func writeTarFile(target string, r io.Reader, perm fs.FileMode, mtime time.Time) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// the umask may have cleared some of the permissions
+	if err := os.Chmod(target, perm); err != nil {
+		return err
+	}
+	return os.Chtimes(target, mtime, mtime)
+}
+
+// buildRootDrive builds the root drive given with --root-from-dir or
+// --root-from-tar into a temporary image, which is used as the root drive
+// and removed on exit.
+func (opts *options) buildRootDrive() error {
+	if opts.RootFromDir == "" && opts.RootFromTar == "" {
+		return nil
+	}
+	size, err := parseSize(opts.RootSize)
+	if err != nil {
+		return newConfigError("root-size", opts.RootSize, err)
+	}
+
+	dir, err := os.MkdirTemp("", "firectl-rootfs-")
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildImage, err)
+	}
+	opts.addCloser(func() error {
+		return os.RemoveAll(dir)
+	})
+	image := filepath.Join(dir, "rootfs.ext4")
+	if err := buildExt4Image(opts.RootFromDir, opts.RootFromTar, size, "", image); err != nil {
+		return err
+	}
+
+	log.Debugf("Built root drive %s", image)
+	opts.addCreatedFile(image)
+	opts.FcRootDrivePath = image
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTar writes a tarball of the given entries to path. Regular files
+// contain their name.
+func writeTar(t *testing.T, path string, entries []*tar.Header) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		var data []byte
+		if hdr.Typeflag == tar.TypeReg {
+			data = []byte(hdr.Name)
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		in     string
+		out    int64
+		outErr error
+	}{
+		{in: "", out: 0},
+		{in: "4096", out: 4096},
+		{in: "512K", out: 512 << 10},
+		{in: "64m", out: 64 << 20},
+		{in: "2G", out: 2 << 30},
+		{in: "2GiB", out: 2 << 30},
+		{in: "1TB", out: 1 << 40},
+		{in: "G", outErr: errInvalidImageSize},
+		{in: "0", outErr: errInvalidImageSize},
+		{in: "-1G", outErr: errInvalidImageSize},
+		{in: "1.5G", outErr: errInvalidImageSize},
+		{in: "2X", outErr: errInvalidImageSize},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			size, err := parseSize(c.in)
+			if size != c.out || !errors.Is(err, c.outErr) {
+				t.Errorf("expected %d, %v but got %d, %v", c.out, c.outErr, size, err)
+			}
+		})
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := t.TempDir()
+	tarball := filepath.Join(dir, "rootfs.tar")
+	writeTar(t, tarball, []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./etc/shadow", Typeflag: tar.TypeReg, Mode: 0400, Gid: 42},
+		{Name: "./usr/bin/sudo", Typeflag: tar.TypeReg, Mode: 04755},
+		{Name: "./home/user/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1234, Gid: 1234},
+		{Name: "./bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+		{Name: "./etc/gshadow", Typeflag: tar.TypeLink, Linkname: "./etc/shadow"},
+		{Name: "./dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	})
+
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	commands, err := extractTar(tarball, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"etc/shadow", "usr/bin/sudo", "etc/gshadow"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("expected %s to be extracted: %v", name, err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(root, "bin")); err != nil || target != "usr/bin" {
+		t.Errorf("expected bin to link to usr/bin but got %q, %v", target, err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "dev", "null")); !os.IsNotExist(err) {
+		t.Errorf("expected device nodes to only be created in the image")
+	}
+
+	script := strings.Join(commands, "\n")
+	for _, expected := range []string{
+		"sif \"/etc/shadow\" mode 0100400",
+		"sif \"/etc/shadow\" gid 42",
+		"sif \"/usr/bin/sudo\" mode 0104755",
+		"sif \"/home/user\" uid 1234",
+		"cd \"/dev\"\nmknod \"null\" c 1 3\ncd /",
+		"sif \"/dev/null\" mode 020666",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("expected %q in the debugfs commands:\n%s", expected, script)
+		}
+	}
+}
+
+func TestExtractTarUnsafe(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []*tar.Header
+	}{
+		{
+			name:    "parent directory",
+			entries: []*tar.Header{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}},
+		},
+		{
+			name: "through a symlink",
+			entries: []*tar.Header{
+				{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+				{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+		},
+		{
+			name: "directory through a symlink",
+			entries: []*tar.Header{
+				{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+				{Name: "x/", Typeflag: tar.TypeDir, Mode: 0777},
+			},
+		},
+		{
+			name:    "hard link",
+			entries: []*tar.Header{{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// a host directory next to the extraction root
+			outside := filepath.Join(dir, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			tarball := filepath.Join(dir, "rootfs.tar")
+			writeTar(t, tarball, c.entries)
+			root := filepath.Join(dir, "root")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := extractTar(tarball, root); !errors.Is(err, errUnsafeTarPath) {
+				t.Errorf("expected %v but got %v", errUnsafeTarPath, err)
+			}
+			info, err := os.Stat(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0755 {
+				t.Errorf("expected the directory outside of the root to be left unchanged but got %v", info.Mode())
+			}
+		})
+	}
+}
+
+func TestBuildExt4Image(t *testing.T) {
+	for _, tool := range []string{mke2fsBinary, debugfsBinary} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %v", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("fc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tarball := filepath.Join(dir, "rootfs.tar")
+	writeTar(t, tarball, []*tar.Header{
+		{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1234},
+	})
+
+	cases := []struct {
+		name string
+		opts imageBuildOptions
+		size int64
+	}{
+		{name: "directory", opts: imageBuildOptions{FromDir: root, Size: "16M"}, size: 16 << 20},
+		{name: "tarball", opts: imageBuildOptions{FromTar: tarball}, size: imageHeadroom + 3<<20},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.opts.Output = filepath.Join(dir, c.name+".ext4")
+			if err := c.opts.build(); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(c.opts.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() > c.size {
+				t.Errorf("expected at most %d bytes but got %d", c.size, info.Size())
+			}
+
+			out, err := exec.Command(debugfsBinary, "-R", "stat /etc/hostname", c.opts.Output).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(out), "Type: regular") {
+				t.Errorf("expected /etc/hostname in the image but got %s", out)
+			}
+
+			if err := c.opts.build(); !errors.Is(err, errImageExists) {
+				t.Errorf("expected %v but got %v", errImageExists, err)
+			}
+		})
+	}
+}
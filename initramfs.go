@@ -0,0 +1,239 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newc cpio format, see Documentation/driver-api/early-userspace/buffer-format.rst
+// in the kernel tree
+const (
+	cpioNewcMagic = "070701"
+	cpioTrailer   = "TRAILER!!!"
+
+	cpioModeDir     = 0040000
+	cpioModeRegular = 0100000
+	cpioModeSymlink = 0120000
+)
+
+// cpioWriter writes a newc cpio archive, as used for initramfs. Files are
+// owned by root in the archive, whoever owns them on the host.
+type cpioWriter struct {
+	w   io.Writer
+	ino uint32
+	// dirs are the directories already written to the archive
+	dirs map[string]bool
+}
+
+func newCPIOWriter(w io.Writer) *cpioWriter {
+	return &cpioWriter{
+		w:    w,
+		dirs: map[string]bool{},
+	}
+}
+
+// writeEntry writes a header, followed by the entry's data
+func (c *cpioWriter) writeEntry(name string, mode uint32, mtime time.Time, data []byte) error {
+	nlink := 1
+	if mode&cpioModeDir == cpioModeDir {
+		nlink = 2
+	}
+	c.ino++
+
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioNewcMagic,
+		c.ino,
+		mode,
+		0, // uid
+		0, // gid
+		nlink,
+		mtime.Unix(),
+		len(data),
+		0, 0, // device of the file
+		0, 0, // device of a device node
+		len(name)+1,
+		0, // checksum, unused in newc
+	)
+	// the name and the data are both padded to a multiple of 4 bytes
+	record := header + name + "\x00"
+	record += strings.Repeat("\x00", cpioPadding(len(record)))
+	if _, err := io.WriteString(c.w, record); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	_, err := c.w.Write(make([]byte, cpioPadding(len(data))))
+	return err
+}
+
+func cpioPadding(n int) int {
+	return (4 - n%4) % 4
+}
+
+// addParents writes the missing parent directories of name, with a fixed
+// modification time so that the archive is reproducible
+func (c *cpioWriter) addParents(name string) error {
+	dir := path.Dir(name)
+	if dir == "." || c.dirs[dir] {
+		return nil
+	}
+	if err := c.addParents(dir); err != nil {
+		return err
+	}
+	c.dirs[dir] = true
+	return c.writeEntry(dir, cpioModeDir|0755, time.Unix(0, 0), nil)
+}
+
+// addPath adds the file, symlink or directory tree at hostPath to the archive
+// as name.
+func (c *cpioWriter) addPath(hostPath, name string) error {
+	return filepath.WalkDir(hostPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(hostPath, p)
+		if err != nil {
+			return err
+		}
+		entry := path.Join(name, filepath.ToSlash(rel))
+		if entry == "." {
+			return nil
+		}
+		if err := c.addParents(entry); err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		perm := uint32(info.Mode().Perm())
+		switch {
+		case info.Mode().IsDir():
+			if c.dirs[entry] {
+				return nil
+			}
+			c.dirs[entry] = true
+			return c.writeEntry(entry, cpioModeDir|perm, info.ModTime(), nil)
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return c.writeEntry(entry, cpioModeRegular|perm, info.ModTime(), data)
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return c.writeEntry(entry, cpioModeSymlink|0777, info.ModTime(), []byte(target))
+		}
+		log.Warnf("Skipping %s, only directories, regular files and symlinks are added to the initrd", p)
+		return nil
+	})
+}
+
+// Close writes the trailer of the archive
+func (c *cpioWriter) Close() error {
+	return c.writeEntry(cpioTrailer, 0, time.Unix(0, 0), nil)
+}
+
+// parseInitrdAdd parses an entry of the form HOST:GUEST and returns the host
+// path and the name of the entry in the archive.
+func parseInitrdAdd(entry string) (string, string, error) {
+	i := strings.LastIndex(entry, ":")
+	if i <= 0 || i == len(entry)-1 {
+		return "", "", newConfigError("initrd-add", entry, errInvalidInitrdAdd)
+	}
+	name := path.Clean(strings.TrimLeft(entry[i+1:], "/"))
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", "", newConfigError("initrd-add", entry, errInvalidInitrdAdd)
+	}
+	return entry[:i], name, nil
+}
+
+// buildInitrd packs the directory given with --initrd-from-dir and the
+// entries given with --initrd-add into a temporary cpio archive, which is
+// used as the initrd and removed on exit.
+func (opts *options) buildInitrd() error {
+	if opts.InitrdFromDir == "" && len(opts.InitrdAdd) == 0 {
+		return nil
+	}
+
+	pattern := "firectl-initrd-*.cpio"
+	if opts.InitrdCompress {
+		pattern += ".gz"
+	}
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildInitrd, err)
+	}
+	opts.addCloser(func() error {
+		return os.Remove(f.Name())
+	})
+	defer f.Close()
+
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if opts.InitrdCompress {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+
+	archive := newCPIOWriter(w)
+	if opts.InitrdFromDir != "" {
+		if err := archive.addPath(opts.InitrdFromDir, "."); err != nil {
+			return newConfigError("initrd-from-dir", opts.InitrdFromDir,
+				fmt.Errorf("%w: %w", errUnableToBuildInitrd, err))
+		}
+	}
+	for _, entry := range opts.InitrdAdd {
+		hostPath, name, err := parseInitrdAdd(entry)
+		if err != nil {
+			return err
+		}
+		if err := archive.addPath(hostPath, name); err != nil {
+			return newConfigError("initrd-add", entry,
+				fmt.Errorf("%w: %w", errUnableToBuildInitrd, err))
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildInitrd, err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("%w: %w", errUnableToBuildInitrd, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildInitrd, err)
+	}
+
+	log.Debugf("Built initrd %s", f.Name())
+	opts.addCreatedFile(f.Name())
+	opts.FcInitrd = f.Name()
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type cpioEntry struct {
+	mode uint32
+	data string
+}
+
+// readCPIO parses a newc cpio archive
+func readCPIO(t *testing.T, data []byte) map[string]cpioEntry {
+	entries := map[string]cpioEntry{}
+	for len(data) > 0 {
+		if len(data) < 110 || string(data[:6]) != cpioNewcMagic {
+			t.Fatalf("invalid cpio header %q", data)
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(data[6+i*8:6+(i+1)*8]), 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int(v)
+		}
+		mode, size, nameSize := field(1), field(6), field(11)
+		nameEnd := 110 + nameSize
+		name := string(data[110 : nameEnd-1])
+		dataStart := nameEnd + cpioPadding(nameEnd)
+		content := string(data[dataStart : dataStart+size])
+		data = data[dataStart+size+cpioPadding(size):]
+
+		if name == cpioTrailer {
+			if len(data) != 0 {
+				t.Errorf("unexpected data after the trailer")
+			}
+			break
+		}
+		entries[name] = cpioEntry{mode: uint32(mode), data: content}
+	}
+	return entries
+}
+
+func TestBuildInitrd(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "init"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../init", filepath.Join(root, "bin", "init")); err != nil {
+		t.Fatal(err)
+	}
+	extra := filepath.Join(dir, "test.conf")
+	if err := os.WriteFile(extra, []byte("key=value"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]cpioEntry{
+		"bin":                {mode: cpioModeDir | 0755},
+		"bin/init":           {mode: cpioModeSymlink | 0777, data: "../init"},
+		"init":               {mode: cpioModeRegular | 0755, data: "#!/bin/sh\n"},
+		"etc":                {mode: cpioModeDir | 0755},
+		"etc/test":           {mode: cpioModeDir | 0755},
+		"etc/test/test.conf": {mode: cpioModeRegular | 0600, data: "key=value"},
+	}
+
+	for _, compress := range []bool{false, true} {
+		t.Run("compress="+strconv.FormatBool(compress), func(t *testing.T) {
+			opts := &options{
+				InitrdFromDir:  root,
+				InitrdAdd:      []string{extra + ":/etc/test/test.conf"},
+				InitrdCompress: compress,
+			}
+			defer opts.Close()
+			if err := opts.buildInitrd(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(opts.FcInitrd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compress {
+				r, err := gzip.NewReader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data, err = io.ReadAll(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if entries := readCPIO(t, data); !reflect.DeepEqual(entries, expected) {
+				t.Errorf("expected %v but got %v", expected, entries)
+			}
+
+			opts.Close()
+			if _, err := os.Stat(opts.FcInitrd); !os.IsNotExist(err) {
+				t.Errorf("expected the initrd to be removed on close")
+			}
+		})
+	}
+}
+
+func TestBuildInitrdReproducible(t *testing.T) {
+	extra := filepath.Join(t.TempDir(), "test.conf")
+	if err := os.WriteFile(extra, []byte("key=value"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	build := func() []byte {
+		opts := &options{InitrdAdd: []string{extra + ":/etc/test/test.conf"}, InitrdCompress: true}
+		defer opts.Close()
+		if err := opts.buildInitrd(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(opts.FcInitrd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	first := build()
+	if second := build(); !bytes.Equal(first, second) {
+		t.Errorf("expected two builds of the same initrd to be identical")
+	}
+	// the parent directories are synthesized, as they are not on the host
+	r, err := gzip.NewReader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := bytes.Index(data, []byte("etc\x00")) - 110
+	if header < 0 {
+		t.Fatalf("expected the etc directory in the initrd")
+	}
+	// the modification time is the sixth field of the header
+	if mtime := string(data[header+6+5*8 : header+6+6*8]); mtime != "00000000" {
+		t.Errorf("expected a fixed modification time of the etc directory but got %s", mtime)
+	}
+}
+
+func TestParseInitrdAdd(t *testing.T) {
+	cases := []struct {
+		in      string
+		outHost string
+		outName string
+		outErr  error
+	}{
+		{in: "./init:/init", outHost: "./init", outName: "init"},
+		{in: "bin:usr/local/bin/", outHost: "bin", outName: "usr/local/bin"},
+		{in: "init", outErr: errInvalidInitrdAdd},
+		{in: "init:", outErr: errInvalidInitrdAdd},
+		{in: ":/init", outErr: errInvalidInitrdAdd},
+		{in: "init:/", outErr: errInvalidInitrdAdd},
+		{in: "init:../init", outErr: errInvalidInitrdAdd},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			host, name, err := parseInitrdAdd(c.in)
+			if host != c.outHost || name != c.outName || !errors.Is(err, c.outErr) {
+				t.Errorf("expected %q, %q, %v but got %q, %q, %v", c.outHost, c.outName, c.outErr, host, name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,452 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultChrootBaseDir is the chroot base directory of the jailer when
+	// none is given
+	defaultChrootBaseDir = "/srv/jailer"
+	// jailRootDir is the directory of the jail the jailer chroots into
+	jailRootDir = "root"
+
+	// linkJailFilesHandlerName is the name of the handler staging the files
+	// of the microVM into the jail
+	linkJailFilesHandlerName = "firectl.LinkJailFiles"
+	// removeJailHandlerName is the name of the handler removing the jail
+	// once a daemonized microVM exits
+	removeJailHandlerName = "firectl.RemoveJail"
+
+	// jailerSocketPath is the path of the firecracker socket in the jail,
+	// which the SDK uses when no socket path is given
+	jailerSocketPath = "/run/firecracker.socket"
+)
+
+// jailIDPattern matches the IDs the jailer accepts
+var jailIDPattern = regexp.MustCompile(`^[a-zA-Z0-9-]{1,64}$`)
+
+// applyJailerDefaults fills in the jailer options which were not given: the
+// ID is generated and the exec file is the firecracker binary.
+func (opts *options) applyJailerDefaults() {
+	if opts.JailerBinary == "" {
+		return
+	}
+	if opts.Id == "" {
+		opts.Id = fmt.Sprintf("firectl-%d-%06x", os.Getpid(), rand.Intn(1<<24))
+		log.Debugf("Generated jail ID %s", opts.Id)
+	}
+	if opts.ExecFile == "" {
+		// a missing binary is reported by the preflight checks
+		opts.ExecFile, _ = opts.firecrackerBinary()
+	}
+}
+
+// checkJailer returns the problems with the jailer options
+func (opts *options) checkJailer() []error {
+	if opts.JailerBinary == "" {
+		return nil
+	}
+	var problems []error
+	if !jailIDPattern.MatchString(opts.Id) {
+		problems = append(problems, newConfigError("id", opts.Id, errInvalidJailID))
+	}
+	if opts.FcBinary != "" && opts.ExecFile != opts.FcBinary {
+		problems = append(problems, newConfigError("exec-file", opts.ExecFile, errExecFileConflict))
+	}
+	if opts.Uid == 0 && !opts.AllowRootJail {
+		problems = append(problems, newConfigError("uid", "0", errRootJail))
+	}
+	return problems
+}
+
+// logJailSummary prints the effective settings of the jail
+func (opts *options) logJailSummary() {
+	if opts.JailerBinary == "" {
+		return
+	}
+	jailer := &firecracker.JailerConfig{ID: opts.Id, ExecFile: opts.ExecFile, ChrootBaseDir: opts.ChrootBaseDir}
+	cgroupVersion := opts.CgroupVersion
+	if cgroupVersion == "" {
+		cgroupVersion = "1"
+	}
+	log.Infof("Jail %s: %s runs %s as uid %d gid %d on NUMA node %d in %s",
+		opts.Id, opts.JailerBinary, opts.ExecFile, opts.Uid, opts.Gid, opts.NumaNode, filepath.Join(jailDir(jailer), jailRootDir))
+	log.Infof("Jail %s: cgroup version %s, daemonize %t, new PID namespace %t", opts.Id, cgroupVersion, opts.Daemonize, opts.NewPidNS)
+	if opts.ParentCgroup != "" {
+		log.Infof("Jail %s: parent cgroup %s", opts.Id, opts.ParentCgroup)
+	}
+	for _, setting := range opts.Cgroups {
+		log.Infof("Jail %s: cgroup %s", opts.Id, setting)
+	}
+	for _, limit := range opts.ResourceLimits {
+		log.Infof("Jail %s: resource limit %s", opts.Id, limit)
+	}
+	if opts.NetNS != "" {
+		log.Infof("Jail %s: network namespace %s", opts.Id, opts.NetNS)
+	}
+	if opts.Uid == 0 {
+		log.Warnf("Jail %s runs firecracker as root", opts.Id)
+	}
+}
+
+// cgroupSettingPattern matches a cgroup setting of the form FILE=VALUE, such
+// as cpu.max=50000 100000
+var cgroupSettingPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*\.[a-z0-9_.]+=\S.*$`)
+
+// jailerResourceLimits are the resource limits the jailer can set
+var jailerResourceLimits = map[string]bool{"fsize": true, "no-file": true}
+
+// parseResourceLimits parses resource limits given as NAME=VALUE, separated
+// by commas, and returns them as NAME=VALUE.
+func parseResourceLimits(entries []string) ([]string, error) {
+	var limits []string
+	for _, entry := range entries {
+		for _, limit := range strings.Split(entry, ",") {
+			name, value, ok := strings.Cut(limit, "=")
+			if !ok || !jailerResourceLimits[name] {
+				return nil, newConfigError("resource-limit", entry, errInvalidResourceLimit)
+			}
+			if _, err := strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, newConfigError("resource-limit", entry, errInvalidResourceLimit)
+			}
+			limits = append(limits, limit)
+		}
+	}
+	return limits, nil
+}
+
+// jailerArgs returns the arguments of the jailer options the SDK does not
+// support
+func (opts *options) jailerArgs() ([]string, error) {
+	var args []string
+	for _, setting := range opts.Cgroups {
+		if !cgroupSettingPattern.MatchString(setting) {
+			return nil, newConfigError("cgroup", setting, errInvalidCgroupSetting)
+		}
+		args = append(args, "--cgroup", setting)
+	}
+	if opts.ParentCgroup != "" {
+		if filepath.IsAbs(opts.ParentCgroup) || strings.Contains("/"+opts.ParentCgroup+"/", "/../") {
+			return nil, newConfigError("parent-cgroup", opts.ParentCgroup, errInvalidParentCgroup)
+		}
+		args = append(args, "--parent-cgroup", opts.ParentCgroup)
+	}
+	limits, err := parseResourceLimits(opts.ResourceLimits)
+	if err != nil {
+		return nil, err
+	}
+	for _, limit := range limits {
+		args = append(args, "--resource-limit", limit)
+	}
+	if opts.NewPidNS {
+		args = append(args, "--new-pid-ns")
+	}
+	return args, nil
+}
+
+// jailerCommand builds the jailer command the SDK would build for cfg, with
+// the extra jailer arguments args
+func jailerCommand(ctx context.Context, cfg firecracker.Config, args []string) *exec.Cmd {
+	jailer := cfg.JailerCfg
+	fcArgs := []string{"--no-seccomp"}
+	if cfg.Seccomp.Enabled {
+		fcArgs = nil
+		if cfg.Seccomp.Filter != "" {
+			fcArgs = []string{"--seccomp-filter", cfg.Seccomp.Filter}
+		}
+	}
+	socketPath := cfg.SocketPath
+	if socketPath == "" {
+		socketPath = jailerSocketPath
+	}
+	fcArgs = append(fcArgs, "--api-sock", socketPath)
+
+	builder := firecracker.NewJailerCommandBuilder().
+		WithID(jailer.ID).
+		WithUID(firecracker.IntValue(jailer.UID)).
+		WithGID(firecracker.IntValue(jailer.GID)).
+		WithNumaNode(firecracker.IntValue(jailer.NumaNode)).
+		WithExecFile(jailer.ExecFile).
+		WithChrootBaseDir(jailer.ChrootBaseDir).
+		WithDaemonize(jailer.Daemonize).
+		WithCgroupVersion(jailer.CgroupVersion).
+		WithNetNS(cfg.NetNS).
+		WithFirecrackerArgs(fcArgs...)
+	if jailer.JailerBinary != "" {
+		builder = builder.WithBin(jailer.JailerBinary)
+	}
+
+	// the jailer arguments come before the firecracker arguments
+	builderArgs := builder.Args()
+	for i, arg := range builderArgs {
+		if arg == "--" {
+			builderArgs = append(builderArgs[:i:i], append(args, builderArgs[i:]...)...)
+			break
+		}
+	}
+	cmd := exec.CommandContext(ctx, builder.Bin(), builderArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = jailer.Stdin, jailer.Stdout, jailer.Stderr
+	return cmd
+}
+
+// jailDir returns the directory of the jail described by cfg, which the
+// jailer creates as CHROOT_BASE/EXEC_FILE_NAME/ID
+func jailDir(cfg *firecracker.JailerConfig) string {
+	base := cfg.ChrootBaseDir
+	if base == "" {
+		base = defaultChrootBaseDir
+	}
+	return filepath.Join(base, filepath.Base(cfg.ExecFile), cfg.ID)
+}
+
+// jailChrootStrategy stages every file the microVM uses into the jail: the
+// kernel, the initrd, the drives and the FIFOs are hard-linked, or copied
+// when they are on another filesystem. As a hard link shares its owner with
+// the original file, only the files firectl created and the copies are owned
+// by the jailer uid and gid. Other files are copied when their permissions
+// do not let the jail read them, or write them for read-write drives. The
+// vsock sockets are created in the jail and linked from their host path.
+type jailChrootStrategy struct {
+	// parentCgroup is the cgroup the jailer creates the cgroup of the
+	// microVM in
+	parentCgroup string
+	// daemonize is set when the jailer is daemonized, the jail is then also
+	// removed by the SDK once the microVM exits
+	daemonize bool
+	// createdFiles are the files firectl created for the microVM, by
+	// absolute path, which are chowned rather than copied
+	createdFiles map[string]bool
+
+	// dir is the directory of the jail, once files have been staged into it
+	dir string
+	// cgroups are the cgroups the jailer created for the microVM
+	cgroups []string
+	// hostLinks are the symlinks created on the host to the sockets in the
+	// jail
+	hostLinks []string
+
+	removeOnce sync.Once
+	removeErr  error
+}
+
+// AdaptHandlers stages the files once the jailer has created the jail and
+// the log files have been created
+func (s *jailChrootStrategy) AdaptHandlers(handlers *firecracker.Handlers) error {
+	if !handlers.FcInit.Has(firecracker.CreateLogFilesHandlerName) {
+		return firecracker.ErrRequiredHandlerMissing
+	}
+	handlers.FcInit = handlers.FcInit.AppendAfter(firecracker.CreateLogFilesHandlerName, firecracker.Handler{
+		Name: linkJailFilesHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return s.stage(&m.Cfg)
+		},
+	})
+	if s.daemonize {
+		handlers.FcInit = handlers.FcInit.AppendAfter(linkJailFilesHandlerName, firecracker.Handler{
+			Name: removeJailHandlerName,
+			Fn: func(ctx context.Context, m *firecracker.Machine) error {
+				go func() {
+					m.Wait(context.Background())
+					if err := s.removeJail(); err != nil {
+						log.Errorf("Failed to remove the jail: %v", err)
+					}
+				}()
+				return nil
+			},
+		})
+	}
+	return nil
+}
+
+// stage stages the files of cfg into its jail and rewrites their paths to be
+// relative to the root of the jail
+func (s *jailChrootStrategy) stage(cfg *firecracker.Config) error {
+	if cfg.JailerCfg == nil {
+		return firecracker.ErrMissingJailerConfig
+	}
+	s.dir = jailDir(cfg.JailerCfg)
+	root := filepath.Join(s.dir, jailRootDir)
+	parent := s.parentCgroup
+	if parent == "" {
+		parent = filepath.Base(cfg.JailerCfg.ExecFile)
+	}
+	s.cgroups = jailCgroups(parent, cfg.JailerCfg.ID)
+	uid, gid := firecracker.IntValue(cfg.JailerCfg.UID), firecracker.IntValue(cfg.JailerCfg.GID)
+
+	// stage links or copies the file at *path into the jail as name, the
+	// jail writing to it if writable
+	stage := func(path *string, name string, writable bool) error {
+		target := filepath.Join(root, name)
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", errUnableToStageJail, *path, err)
+		}
+		info, err := os.Stat(abs)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", errUnableToStageJail, *path, err)
+		}
+		created := s.createdFiles[abs]
+		copied := !created && !jailCanAccess(info, uid, gid, writable)
+		if copied {
+			log.Debugf("The jail uid %d and gid %d cannot access %s, copying it", uid, gid, *path)
+		} else if err := os.Link(abs, target); err != nil {
+			log.Debugf("Failed to link %s into the jail, copying it: %v", *path, err)
+			copied = true
+		}
+		if copied {
+			if writable {
+				log.Warnf("The microVM writes to a copy of %s, which is removed with the jail", *path)
+			}
+			if err := copyIntoJail(abs, target); err != nil {
+				return fmt.Errorf("%w: %s: %w", errUnableToStageJail, *path, err)
+			}
+		}
+		if created || copied {
+			if err := os.Chown(target, uid, gid); err != nil {
+				return fmt.Errorf("%w: %s: %w", errUnableToStageJail, *path, err)
+			}
+		}
+		log.Debugf("Staged %s into the jail as %s", *path, name)
+		*path = name
+		return nil
+	}
+
+	if err := stage(&cfg.KernelImagePath, "kernel", false); err != nil {
+		return err
+	}
+	if cfg.InitrdPath != "" {
+		if err := stage(&cfg.InitrdPath, "initrd", false); err != nil {
+			return err
+		}
+	}
+	for i, drive := range cfg.Drives {
+		path := firecracker.StringValue(drive.PathOnHost)
+		if err := stage(&path, "drive-"+firecracker.StringValue(drive.DriveID), !firecracker.BoolValue(drive.IsReadOnly)); err != nil {
+			return err
+		}
+		cfg.Drives[i].PathOnHost = firecracker.String(path)
+	}
+	// FIFOs are created by the SDK and read by firectl from their host
+	// path, so they are linked and owned by the jail
+	for _, fifo := range []struct {
+		path *string
+		name string
+	}{
+		{&cfg.LogFifo, "log.fifo"},
+		{&cfg.MetricsFifo, "metrics.fifo"},
+	} {
+		if *fifo.path == "" {
+			continue
+		}
+		target := filepath.Join(root, fifo.name)
+		if err := os.Link(*fifo.path, target); err != nil {
+			return fmt.Errorf("%w: %s must be on the filesystem of the jail: %w", errUnableToStageJail, *fifo.path, err)
+		}
+		if err := os.Chown(target, uid, gid); err != nil {
+			return fmt.Errorf("%w: %s: %w", errUnableToStageJail, *fifo.path, err)
+		}
+		log.Debugf("Staged %s into the jail as %s", *fifo.path, fifo.name)
+		*fifo.path = fifo.name
+	}
+
+	// firecracker creates the vsock sockets in the jail, they are linked
+	// from their host path so that they can still be connected to there
+	for i, vsock := range cfg.VsockDevices {
+		name := fmt.Sprintf("vsock-%d.sock", i)
+		if err := os.Symlink(filepath.Join(root, name), vsock.Path); err != nil {
+			log.Warnf("Failed to link %s to the vsock socket in the jail, connect to %s instead: %v",
+				vsock.Path, filepath.Join(root, name), err)
+		} else {
+			s.hostLinks = append(s.hostLinks, vsock.Path)
+		}
+		cfg.VsockDevices[i].Path = name
+	}
+	return nil
+}
+
+// jailCanAccess reports whether the permissions of the file of info let the
+// jail uid and gid read it, and write it if writable
+func jailCanAccess(info os.FileInfo, uid, gid int, writable bool) bool {
+	if uid == 0 {
+		return true
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	need := os.FileMode(04)
+	if writable {
+		need |= 02
+	}
+	perm := info.Mode().Perm()
+	switch {
+	case int(stat.Uid) == uid:
+		perm >>= 6
+	case int(stat.Gid) == gid:
+		perm >>= 3
+	}
+	return perm&need == need
+}
+
+// copyIntoJail copies the file at path to the new file target
+func copyIntoJail(path, target string) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	_, err = cloneFile(path, target)
+	return err
+}
+
+// removeJail removes the jail the files were staged into, its cgroups and
+// the host links to its sockets, once. Jails which were never staged may
+// belong to another microVM, and jails still used by a process, such as a
+// daemonized firecracker which outlived the jailer, are left in place for
+// firectl gc.
+func (s *jailChrootStrategy) removeJail() error {
+	s.removeOnce.Do(func() {
+		for _, link := range s.hostLinks {
+			if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+				log.Warnf("Failed to remove %s: %v", link, err)
+			}
+		}
+		if s.dir == "" {
+			return
+		}
+		if inUse, err := jailInUse(filepath.Join(s.dir, jailRootDir), s.cgroups); err != nil || inUse {
+			log.Warnf("The jail %s is still in use, leaving it for firectl gc", s.dir)
+			return
+		}
+		log.Debugf("Removing the jail %s", s.dir)
+		s.removeErr = removeJail(s.dir, s.cgroups)
+	})
+	return s.removeErr
+}
@@ -0,0 +1,407 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"golang.org/x/sys/unix"
+)
+
+func TestJailChrootStrategy(t *testing.T) {
+	dir := t.TempDir()
+	host := filepath.Join(dir, "host")
+	jailer := &firecracker.JailerConfig{
+		ID:            "vm",
+		ExecFile:      "/usr/bin/firecracker",
+		ChrootBaseDir: filepath.Join(dir, "jailer"),
+		UID:           firecracker.Int(os.Getuid()),
+		GID:           firecracker.Int(os.Getgid()),
+	}
+	root := filepath.Join(dir, "jailer", "firecracker", "vm", jailRootDir)
+	oldCgroups := cgroupRoot
+	cgroupRoot = filepath.Join(dir, "cgroup")
+	t.Cleanup(func() {
+		cgroupRoot = oldCgroups
+	})
+	cgroup := filepath.Join(cgroupRoot, "firecracker", "vm")
+	for _, d := range []string{host, root, cgroup} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"vmlinux", "initrd.cpio", "rootfs.ext4", "data.ext4"} {
+		if err := os.WriteFile(filepath.Join(host, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unix.Mkfifo(filepath.Join(host, "fc.fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := firecracker.Config{
+		KernelImagePath: filepath.Join(host, "vmlinux"),
+		InitrdPath:      filepath.Join(host, "initrd.cpio"),
+		LogFifo:         filepath.Join(host, "fc.fifo"),
+		Drives: []models.Drive{
+			{DriveID: firecracker.String("1"), PathOnHost: firecracker.String(filepath.Join(host, "rootfs.ext4"))},
+			{DriveID: firecracker.String("2"), PathOnHost: firecracker.String(filepath.Join(host, "data.ext4"))},
+		},
+		VsockDevices: []firecracker.VsockDevice{{Path: filepath.Join(host, "v.sock"), CID: 3}},
+		JailerCfg:    jailer,
+	}
+	strategy := &jailChrootStrategy{}
+	if err := strategy.stage(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, staged := range []struct{ path, name, host string }{
+		{cfg.KernelImagePath, "kernel", "vmlinux"},
+		{cfg.InitrdPath, "initrd", "initrd.cpio"},
+		{cfg.LogFifo, "log.fifo", "fc.fifo"},
+		{firecracker.StringValue(cfg.Drives[0].PathOnHost), "drive-1", "rootfs.ext4"},
+		{firecracker.StringValue(cfg.Drives[1].PathOnHost), "drive-2", "data.ext4"},
+	} {
+		if staged.path != staged.name {
+			t.Errorf("expected %s to be rewritten to %s but got %s", staged.host, staged.name, staged.path)
+		}
+		a, err := os.Stat(filepath.Join(root, staged.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(filepath.Join(host, staged.host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(a, b) {
+			t.Errorf("expected %s to be linked into the jail", staged.host)
+		}
+	}
+	if cfg.VsockDevices[0].Path != "vsock-0.sock" {
+		t.Errorf("expected the vsock path to be rewritten but got %s", cfg.VsockDevices[0].Path)
+	}
+	if target, err := os.Readlink(filepath.Join(host, "v.sock")); err != nil || target != filepath.Join(root, "vsock-0.sock") {
+		t.Errorf("expected the host vsock path to link to the jail but got %s, %v", target, err)
+	}
+
+	if err := strategy.removeJail(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Dir(root), cgroup, filepath.Join(host, "v.sock")} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed but got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(host, "rootfs.ext4")); err != nil {
+		t.Errorf("expected the drives to be left on the host: %v", err)
+	}
+}
+
+func TestJailChrootStrategyOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chowning into the jail requires root")
+	}
+	const jailUID, jailGID = 1000, 1000
+	dir := t.TempDir()
+	host := filepath.Join(dir, "host")
+	jailer := &firecracker.JailerConfig{
+		ID:            "vm",
+		ExecFile:      "/usr/bin/firecracker",
+		ChrootBaseDir: filepath.Join(dir, "jailer"),
+		UID:           firecracker.Int(jailUID),
+		GID:           firecracker.Int(jailGID),
+	}
+	root := filepath.Join(dir, "jailer", "firecracker", "vm", jailRootDir)
+	for _, d := range []string{host, root} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, mode := range map[string]os.FileMode{
+		"vmlinux":      0644,
+		"private.ext4": 0600,
+		"data.ext4":    0644,
+		"shared.ext4":  0666,
+		"scratch.img":  0600,
+	} {
+		path := filepath.Join(host, name)
+		if err := os.WriteFile(path, []byte(name), mode); err != nil {
+			t.Fatal(err)
+		}
+		// the umask may have cleared permissions
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := unix.Mkfifo(filepath.Join(host, "fc.fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	drive := func(id, name string, readOnly bool) models.Drive {
+		return models.Drive{
+			DriveID:    firecracker.String(id),
+			PathOnHost: firecracker.String(filepath.Join(host, name)),
+			IsReadOnly: firecracker.Bool(readOnly),
+		}
+	}
+	cfg := firecracker.Config{
+		KernelImagePath: filepath.Join(host, "vmlinux"),
+		LogFifo:         filepath.Join(host, "fc.fifo"),
+		Drives: []models.Drive{
+			drive("private", "private.ext4", true),
+			drive("data", "data.ext4", false),
+			drive("shared", "shared.ext4", false),
+			drive("scratch", "scratch.img", false),
+		},
+		JailerCfg: jailer,
+	}
+	strategy := &jailChrootStrategy{createdFiles: map[string]bool{filepath.Join(host, "scratch.img"): true}}
+	if err := strategy.stage(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name, host string
+		linked     bool
+		uid        int
+	}{
+		// inputs the jail can access are linked and keep their owner
+		{"kernel", "vmlinux", true, 0},
+		{"drive-shared", "shared.ext4", true, 0},
+		// the others are copied and the copies owned by the jail
+		{"drive-private", "private.ext4", false, jailUID},
+		{"drive-data", "data.ext4", false, jailUID},
+		// files created by firectl are linked and owned by the jail
+		{"drive-scratch", "scratch.img", true, jailUID},
+		{"log.fifo", "fc.fifo", true, jailUID},
+	} {
+		staged, err := os.Stat(filepath.Join(root, c.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		original, err := os.Stat(filepath.Join(host, c.host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(staged, original) != c.linked {
+			t.Errorf("expected %s to be linked %v", c.host, c.linked)
+		}
+		if uid := int(staged.Sys().(*syscall.Stat_t).Uid); uid != c.uid {
+			t.Errorf("expected %s to be owned by %d but got %d", c.name, c.uid, uid)
+		}
+		if !c.linked && original.Sys().(*syscall.Stat_t).Uid != 0 {
+			t.Errorf("expected the owner of %s to be left unchanged", c.host)
+		}
+	}
+}
+
+// fakeFileInfo is the os.FileInfo of a file with the given permissions and
+// owner
+type fakeFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+	stat *syscall.Stat_t
+}
+
+func (f fakeFileInfo) Mode() os.FileMode { return f.mode }
+func (f fakeFileInfo) Sys() interface{}  { return f.stat }
+
+func TestJailCanAccess(t *testing.T) {
+	cases := []struct {
+		name     string
+		mode     os.FileMode
+		uid, gid uint32
+		writable bool
+		out      bool
+	}{
+		{name: "world readable", mode: 0644, uid: 0, gid: 0, out: true},
+		{name: "private", mode: 0600, uid: 0, gid: 0},
+		{name: "owned", mode: 0600, uid: 1000, gid: 0, writable: true, out: true},
+		{name: "owned read-only", mode: 0400, uid: 1000, gid: 0, writable: true},
+		{name: "group writable", mode: 0660, uid: 0, gid: 1000, writable: true, out: true},
+		{name: "group denied", mode: 0604, uid: 0, gid: 1000},
+		{name: "world writable", mode: 0666, uid: 0, gid: 0, writable: true, out: true},
+		{name: "not world writable", mode: 0664, uid: 0, gid: 0, writable: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			info := fakeFileInfo{mode: c.mode, stat: &syscall.Stat_t{Uid: c.uid, Gid: c.gid}}
+			if out := jailCanAccess(info, 1000, 1000, c.writable); out != c.out {
+				t.Errorf("expected %v but got %v", c.out, out)
+			}
+		})
+	}
+}
+
+func TestJailerArgs(t *testing.T) {
+	cases := []struct {
+		name   string
+		opts   options
+		out    []string
+		outErr error
+	}{
+		{
+			name: "no options",
+		},
+		{
+			name: "every option",
+			opts: options{
+				Cgroups:        []string{"cpu.max=50000 100000", "memory.max=1073741824"},
+				ParentCgroup:   "firectl/tests",
+				ResourceLimits: []string{"fsize=1024,no-file=64"},
+				NewPidNS:       true,
+			},
+			out: []string{
+				"--cgroup", "cpu.max=50000 100000",
+				"--cgroup", "memory.max=1073741824",
+				"--parent-cgroup", "firectl/tests",
+				"--resource-limit", "fsize=1024",
+				"--resource-limit", "no-file=64",
+				"--new-pid-ns",
+			},
+		},
+		{
+			name:   "cgroup without value",
+			opts:   options{Cgroups: []string{"cpu.max="}},
+			outErr: errInvalidCgroupSetting,
+		},
+		{
+			name:   "cgroup without controller",
+			opts:   options{Cgroups: []string{"max=10"}},
+			outErr: errInvalidCgroupSetting,
+		},
+		{
+			name:   "parent cgroup outside of the hierarchy",
+			opts:   options{ParentCgroup: "firectl/../.."},
+			outErr: errInvalidParentCgroup,
+		},
+		{
+			name:   "unknown resource limit",
+			opts:   options{ResourceLimits: []string{"nproc=10"}},
+			outErr: errInvalidResourceLimit,
+		},
+		{
+			name:   "negative resource limit",
+			opts:   options{ResourceLimits: []string{"fsize=-1"}},
+			outErr: errInvalidResourceLimit,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args, err := c.opts.jailerArgs()
+			if !errors.Is(err, c.outErr) {
+				t.Fatalf("expected %v but got %v", c.outErr, err)
+			}
+			if strings.Join(args, "|") != strings.Join(c.out, "|") {
+				t.Errorf("expected %q but got %q", c.out, args)
+			}
+		})
+	}
+}
+
+func TestJailerCommand(t *testing.T) {
+	cfg := firecracker.Config{
+		NetNS: "/var/run/netns/vm",
+		JailerCfg: &firecracker.JailerConfig{
+			ID:            "vm",
+			UID:           firecracker.Int(123),
+			GID:           firecracker.Int(456),
+			NumaNode:      firecracker.Int(0),
+			ExecFile:      "/usr/bin/firecracker",
+			JailerBinary:  "/usr/bin/jailer",
+			CgroupVersion: "2",
+		},
+	}
+	cmd := jailerCommand(context.Background(), cfg, []string{"--new-pid-ns"})
+	// the SDK adds cpuset cgroups for the NUMA node when the host has one
+	var args []string
+	for i := 0; i < len(cmd.Args); i++ {
+		if cmd.Args[i] == "--cgroup" && strings.HasPrefix(cmd.Args[i+1], "cpuset.") {
+			i++
+			continue
+		}
+		args = append(args, cmd.Args[i])
+	}
+	expected := "/usr/bin/jailer --id vm --uid 123 --gid 456 --exec-file /usr/bin/firecracker " +
+		"--cgroup-version 2 --netns /var/run/netns/vm --new-pid-ns -- --no-seccomp --api-sock /run/firecracker.socket"
+	if got := strings.Join(args, " "); got != expected {
+		t.Errorf("expected %q but got %q", expected, got)
+	}
+}
+
+func TestApplyJailerDefaults(t *testing.T) {
+	opts := &options{JailerBinary: "/usr/bin/jailer", FcBinary: "/usr/bin/firecracker"}
+	opts.applyJailerDefaults()
+	if !jailIDPattern.MatchString(opts.Id) {
+		t.Errorf("expected a valid generated ID but got %q", opts.Id)
+	}
+	if opts.ExecFile != opts.FcBinary {
+		t.Errorf("expected the exec file to default to %s but got %s", opts.FcBinary, opts.ExecFile)
+	}
+
+	opts = &options{JailerBinary: "/usr/bin/jailer", Id: "vm0", ExecFile: "/opt/firecracker"}
+	opts.applyJailerDefaults()
+	if opts.Id != "vm0" || opts.ExecFile != "/opt/firecracker" {
+		t.Errorf("expected the given ID and exec file to be kept but got %q, %q", opts.Id, opts.ExecFile)
+	}
+}
+
+func TestCheckJailer(t *testing.T) {
+	cases := []struct {
+		name string
+		opts options
+		out  []error
+	}{
+		{
+			name: "valid",
+			opts: options{Id: "vm-0", ExecFile: "/usr/bin/firecracker", Uid: 1000},
+		},
+		{
+			name: "root allowed",
+			opts: options{Id: "vm-0", ExecFile: "/usr/bin/firecracker", AllowRootJail: true},
+		},
+		{
+			name: "root",
+			opts: options{Id: "vm-0", ExecFile: "/usr/bin/firecracker"},
+			out:  []error{errRootJail},
+		},
+		{
+			name: "invalid ID and conflicting binaries",
+			opts: options{Id: "vm_0", ExecFile: "/usr/bin/firecracker", FcBinary: "/opt/firecracker", Uid: 1000},
+			out:  []error{errInvalidJailID, errExecFileConflict},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.opts.JailerBinary = "/usr/bin/jailer"
+			problems := c.opts.checkJailer()
+			if len(problems) != len(c.out) {
+				t.Fatalf("expected %v but got %v", c.out, problems)
+			}
+			for i, err := range c.out {
+				if !errors.Is(problems[i], err) {
+					t.Errorf("expected %v but got %v", err, problems[i])
+				}
+			}
+		})
+	}
+}
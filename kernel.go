@@ -0,0 +1,315 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// kernel image formats
+const (
+	kernelFormatELF     = "ELF vmlinux"
+	kernelFormatBzImage = "x86 bzImage"
+	kernelFormatArm64   = "arm64 Image"
+	kernelFormatPE      = "PE/EFI application"
+)
+
+// offsets of the x86 boot protocol setup header, see
+// Documentation/x86/boot.rst in the kernel tree
+const (
+	bzImageSetupSectsOffset    = 0x1f1
+	bzImageBootFlagOffset      = 0x1fe
+	bzImageHeaderOffset        = 0x202
+	bzImagePayloadOffsetOffset = 0x248
+	bzImagePayloadLengthOffset = 0x24c
+
+	// arm64Image magic is at this offset of the arm64 Image header, see
+	// Documentation/arm64/booting.rst in the kernel tree
+	arm64ImageMagicOffset = 0x38
+)
+
+var (
+	elfMagic        = []byte("\x7fELF")
+	bzImageMagic    = []byte("HdrS")
+	bzImageBootFlag = []byte{0x55, 0xaa}
+	arm64ImageMagic = []byte("ARM\x64")
+	peMagic         = []byte("MZ")
+	gzipMagic       = []byte{0x1f, 0x8b}
+	xzMagic         = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic       = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4LegacyMagic  = []byte{0x02, 0x21, 0x4c, 0x18}
+)
+
+// kernelHeaderSize is the size of the header read to detect the kernel format
+const kernelHeaderSize = 0x400
+
+// extractedKernelsDir is the directory of the artifact cache recording the
+// digest of the vmlinux extracted from a bzImage, in a file named after the
+// digest of the bzImage
+const extractedKernelsDir = "kernels"
+
+// supportedKernelFormats are the formats firecracker boots on each
+// architecture
+var supportedKernelFormats = map[string]string{
+	"amd64": kernelFormatELF,
+	"arm64": kernelFormatArm64,
+}
+
+// kernelPayloadDecompressors decompress the payload of a bzImage, gzip is
+// handled natively while the other formats rely on the usual tools.
+var kernelPayloadDecompressors = []struct {
+	name    string
+	magic   []byte
+	command []string
+}{
+	{name: "gzip", magic: gzipMagic},
+	{name: "xz", magic: xzMagic, command: []string{"xz", "-dc"}},
+	{name: "zstd", magic: zstdMagic, command: []string{"zstd", "-dc"}},
+	{name: "lz4", magic: lz4LegacyMagic, command: []string{"lz4", "-dc"}},
+}
+
+// detectKernelFormat identifies the format of a kernel image from its
+// header.
+func detectKernelFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, kernelHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	at := func(offset int, magic []byte) bool {
+		return len(header) >= offset+len(magic) && bytes.Equal(header[offset:offset+len(magic)], magic)
+	}
+	// bzImages and arm64 Images with an EFI stub also start with the PE
+	// magic, so they are identified first.
+	switch {
+	case at(0, elfMagic):
+		return kernelFormatELF, nil
+	case at(bzImageHeaderOffset, bzImageMagic) && at(bzImageBootFlagOffset, bzImageBootFlag):
+		return kernelFormatBzImage, nil
+	case at(arm64ImageMagicOffset, arm64ImageMagic):
+		return kernelFormatArm64, nil
+	case at(0, peMagic):
+		return kernelFormatPE, nil
+	}
+	return "", errUnknownKernelFormat
+}
+
+// checkKernelFormat returns an error if firecracker cannot boot the kernel
+// image on this architecture. A bzImage is accepted when its vmlinux is to be
+// extracted.
+func checkKernelFormat(path string, extract bool) error {
+	format, err := detectKernelFormat(path)
+	if err != nil {
+		return err
+	}
+	supported, ok := supportedKernelFormats[runtime.GOARCH]
+	if !ok || format == supported {
+		return nil
+	}
+	if format == kernelFormatBzImage && supported == kernelFormatELF {
+		if extract {
+			return nil
+		}
+		return fmt.Errorf("%w: %s, use --extract-kernel to boot the vmlinux embedded in it",
+			errUnsupportedKernelFormat, format)
+	}
+	return fmt.Errorf("%w: %s, firecracker on %s boots an %s",
+		errUnsupportedKernelFormat, format, runtime.GOARCH, supported)
+}
+
+// prepareKernel replaces a bzImage kernel with the vmlinux extracted from it
+// when --extract-kernel is given.
+func (opts *options) prepareKernel() error {
+	if !opts.ExtractKernel {
+		return nil
+	}
+	format, err := detectKernelFormat(opts.FcKernelImage)
+	if err != nil {
+		return newConfigError("kernel", opts.FcKernelImage, err)
+	}
+	if format != kernelFormatBzImage {
+		return nil
+	}
+
+	cache, err := opts.artifactCache()
+	if err != nil {
+		return newConfigError("kernel", opts.FcKernelImage,
+			fmt.Errorf("%w: %w", errUnableToExtractKernel, err))
+	}
+	vmlinux, err := extractVmlinux(opts.FcKernelImage, cache)
+	if err != nil {
+		return newConfigError("kernel", opts.FcKernelImage,
+			fmt.Errorf("%w: %w", errUnableToExtractKernel, err))
+	}
+	log.Debugf("Using vmlinux %s extracted from %s", vmlinux, opts.FcKernelImage)
+	opts.FcKernelImage = vmlinux
+	return nil
+}
+
+// extractVmlinux extracts the vmlinux embedded in the bzImage at path into
+// the artifact cache and returns its path. The digest of the vmlinux is
+// recorded for the bzImage, so that it is only extracted once, and the
+// vmlinux is verified against it whenever it is reused.
+func extractVmlinux(path string, cache *artifactCache) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(data)
+	record := filepath.Join(cache.dir, extractedKernelsDir, hex.EncodeToString(digest[:]))
+	vmlinux, err := extractedVmlinux(cache, record)
+	if err == nil {
+		return vmlinux, touch(vmlinux)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("Extracting the vmlinux of %s again: %v", path, err)
+	}
+
+	payload, err := bzImagePayload(data)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(record), 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(record), artifactTempPrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := decompressKernelPayload(tmp, payload); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if format, err := detectKernelFormat(tmp.Name()); err != nil || format != kernelFormatELF {
+		return "", fmt.Errorf("the payload of %s is not an ELF vmlinux", path)
+	}
+	vmlinuxDigest, err := cache.add(tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	if vmlinux, err = cache.verify(vmlinuxDigest); err != nil {
+		return "", err
+	}
+
+	// the record is written atomically, so that it is never seen partially
+	// written
+	if err := os.WriteFile(tmp.Name(), []byte(vmlinuxDigest+"\n"), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), record); err != nil {
+		return "", err
+	}
+	return vmlinux, nil
+}
+
+// extractedVmlinux returns the path of the vmlinux whose digest is recorded
+// at record, once the record and the vmlinux were checked to be trusted
+func extractedVmlinux(cache *artifactCache, record string) (string, error) {
+	if err := checkOwnedFile(record); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(record)
+	if err != nil {
+		return "", err
+	}
+	digest := strings.TrimSpace(string(data))
+	if err := checkDigest(digest); err != nil {
+		return "", fmt.Errorf("%w: %s: %w", errUntrustedCachedFile, record, err)
+	}
+	return cache.verify(digest)
+}
+
+// bzImagePayload returns the compressed kernel embedded in a bzImage
+func bzImagePayload(data []byte) ([]byte, error) {
+	if len(data) < bzImagePayloadLengthOffset+4 {
+		return nil, fmt.Errorf("bzImage is truncated")
+	}
+	setupSects := int(data[bzImageSetupSectsOffset])
+	if setupSects == 0 {
+		setupSects = 4
+	}
+	// the payload offset is relative to the protected-mode code, which
+	// follows the boot sector and the setup sectors
+	offset := (setupSects+1)*512 + int(binary.LittleEndian.Uint32(data[bzImagePayloadOffsetOffset:]))
+	length := int(binary.LittleEndian.Uint32(data[bzImagePayloadLengthOffset:]))
+	if length == 0 || offset+length > len(data) {
+		return nil, fmt.Errorf("bzImage payload at %d of %d bytes is out of bounds", offset, length)
+	}
+	return data[offset : offset+length], nil
+}
+
+// decompressKernelPayload writes the decompressed payload to w
+func decompressKernelPayload(w io.Writer, payload []byte) error {
+	for _, d := range kernelPayloadDecompressors {
+		if !bytes.HasPrefix(payload, d.magic) {
+			continue
+		}
+		if d.command == nil {
+			r, err := gzip.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return err
+			}
+			// the payload is followed by the decompressed size, which
+			// is not part of the gzip stream
+			r.Multistream(false)
+			_, err = io.Copy(w, r)
+			return err
+		}
+
+		if _, err := exec.LookPath(d.command[0]); err != nil {
+			return fmt.Errorf("%s is required to decompress the %s kernel payload: %w", d.command[0], d.name, err)
+		}
+		cmd := exec.Command(d.command[0], d.command[1:]...)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Stdout = w
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		// like the kernel's extract-vmlinux script, a complaint about the
+		// data trailing the compressed stream is ignored, the output is
+		// checked to be an ELF vmlinux instead.
+		if err := cmd.Run(); err != nil {
+			log.Debugf("%s exited with %v while decompressing the kernel: %s",
+				d.command[0], err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported compression of the kernel payload")
+}
@@ -0,0 +1,263 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// fakeKernel returns a kernel image header of the given format
+func fakeKernel(format string) []byte {
+	image := make([]byte, kernelHeaderSize)
+	switch format {
+	case kernelFormatELF:
+		copy(image, elfMagic)
+	case kernelFormatBzImage:
+		copy(image, peMagic)
+		copy(image[bzImageBootFlagOffset:], bzImageBootFlag)
+		copy(image[bzImageHeaderOffset:], bzImageMagic)
+	case kernelFormatArm64:
+		copy(image, peMagic)
+		copy(image[arm64ImageMagicOffset:], arm64ImageMagic)
+	case kernelFormatPE:
+		copy(image, peMagic)
+	}
+	return image
+}
+
+// fakeBzImage returns a bzImage embedding the given payload
+func fakeBzImage(payload []byte) []byte {
+	const setupSects = 1
+	image := fakeKernel(kernelFormatBzImage)
+	image[bzImageSetupSectsOffset] = setupSects
+	binary.LittleEndian.PutUint32(image[bzImagePayloadOffsetOffset:], 0x10)
+	binary.LittleEndian.PutUint32(image[bzImagePayloadLengthOffset:], uint32(len(payload)))
+
+	start := (setupSects+1)*512 + 0x10
+	image = append(image, make([]byte, start-len(image))...)
+	return append(image, payload...)
+}
+
+// supportedKernel returns a kernel image header firecracker boots on this
+// architecture
+func supportedKernel() []byte {
+	if format, ok := supportedKernelFormats[runtime.GOARCH]; ok {
+		return fakeKernel(format)
+	}
+	return fakeKernel(kernelFormatELF)
+}
+
+func TestDetectKernelFormat(t *testing.T) {
+	cases := []struct {
+		name      string
+		image     []byte
+		outFormat string
+		outErr    error
+	}{
+		{name: "ELF", image: fakeKernel(kernelFormatELF), outFormat: kernelFormatELF},
+		{name: "bzImage", image: fakeKernel(kernelFormatBzImage), outFormat: kernelFormatBzImage},
+		{name: "arm64 Image", image: fakeKernel(kernelFormatArm64), outFormat: kernelFormatArm64},
+		{name: "PE", image: fakeKernel(kernelFormatPE), outFormat: kernelFormatPE},
+		{name: "unknown", image: []byte("#!/bin/sh\n"), outErr: errUnknownKernelFormat},
+		{name: "empty", image: nil, outErr: errUnknownKernelFormat},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "kernel")
+			if err := os.WriteFile(path, c.image, 0644); err != nil {
+				t.Fatal(err)
+			}
+			format, err := detectKernelFormat(path)
+			if format != c.outFormat {
+				t.Errorf("expected format %q but got %q", c.outFormat, format)
+			}
+			if !errors.Is(err, c.outErr) {
+				t.Errorf("expected error %v but got %v", c.outErr, err)
+			}
+		})
+	}
+}
+
+func TestCheckKernelFormat(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("bzImage extraction only applies to x86_64")
+	}
+
+	path := filepath.Join(t.TempDir(), "bzImage")
+	if err := os.WriteFile(path, fakeKernel(kernelFormatBzImage), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKernelFormat(path, false); !errors.Is(err, errUnsupportedKernelFormat) {
+		t.Errorf("expected a bzImage to be rejected but got %v", err)
+	}
+	if err := checkKernelFormat(path, true); err != nil {
+		t.Errorf("expected a bzImage to be accepted for extraction but got %v", err)
+	}
+}
+
+func TestExtractVmlinux(t *testing.T) {
+	vmlinux := append(fakeKernel(kernelFormatELF), []byte("kernel")...)
+	// the decompressed size trails the compressed payload of a bzImage
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(vmlinux)))
+
+	compressors := []struct {
+		name     string
+		compress func(t *testing.T, data []byte) []byte
+	}{
+		{
+			name: "gzip",
+			compress: func(t *testing.T, data []byte) []byte {
+				var b bytes.Buffer
+				w := gzip.NewWriter(&b)
+				w.Write(data)
+				w.Close()
+				return b.Bytes()
+			},
+		},
+		{
+			name: "xz",
+			compress: func(t *testing.T, data []byte) []byte {
+				if _, err := exec.LookPath("xz"); err != nil {
+					t.Skip("xz is not installed")
+				}
+				cmd := exec.Command("xz", "-c", "--check=crc32")
+				cmd.Stdin = bytes.NewReader(data)
+				out, err := cmd.Output()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return out
+			},
+		},
+	}
+	for _, c := range compressors {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "bzImage")
+			payload := append(c.compress(t, vmlinux), size...)
+			if err := os.WriteFile(path, fakeBzImage(payload), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cache := &artifactCache{dir: filepath.Join(dir, "cache")}
+			extracted, err := extractVmlinux(path, cache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(extracted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, vmlinux) {
+				t.Errorf("extracted vmlinux does not match")
+			}
+
+			cached, err := extractVmlinux(path, cache)
+			if err != nil || cached != extracted {
+				t.Errorf("expected the cached vmlinux %s but got %s, %v", extracted, cached, err)
+			}
+		})
+	}
+}
+
+func TestExtractVmlinuxTampered(t *testing.T) {
+	vmlinux := append(fakeKernel(kernelFormatELF), []byte("kernel")...)
+	var payload bytes.Buffer
+	w := gzip.NewWriter(&payload)
+	w.Write(vmlinux)
+	w.Close()
+
+	cases := []struct {
+		name   string
+		tamper func(t *testing.T, record, extracted string)
+	}{
+		{
+			name: "vmlinux replaced",
+			tamper: func(t *testing.T, record, extracted string) {
+				if err := os.Chmod(extracted, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(extracted, fakeKernel(kernelFormatELF), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "record writable by other users",
+			tamper: func(t *testing.T, record, extracted string) {
+				if err := os.Chmod(record, 0666); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "record pointing to another artifact",
+			tamper: func(t *testing.T, record, extracted string) {
+				other := filepath.Join(t.TempDir(), "other")
+				if err := os.WriteFile(other, fakeKernel(kernelFormatELF), 0644); err != nil {
+					t.Fatal(err)
+				}
+				digest, err := fileSHA256(other)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(record, []byte(digest), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(other, filepath.Join(filepath.Dir(extracted), digest)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "bzImage")
+			if err := os.WriteFile(path, fakeBzImage(append(payload.Bytes(), 0, 0, 0, 0)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cache := &artifactCache{dir: filepath.Join(dir, "cache")}
+			extracted, err := extractVmlinux(path, cache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, err := filepath.Glob(filepath.Join(cache.dir, extractedKernelsDir, "*"))
+			if err != nil || len(records) != 1 {
+				t.Fatalf("expected the digest of the vmlinux to be recorded but got %v, %v", records, err)
+			}
+
+			c.tamper(t, records[0], extracted)
+			reused, err := extractVmlinux(path, cache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := os.ReadFile(reused); err != nil || !bytes.Equal(data, vmlinux) {
+				t.Errorf("expected the vmlinux to be extracted again but got %v", err)
+			}
+			if err := checkOwnedFile(records[0]); err != nil {
+				t.Errorf("expected the record to be written again: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// lockVersion is the version of the lockfile format
+const lockVersion = 1
+
+// sources of the artifacts firectl builds, named after the option they are
+// built from
+const (
+	lockSourceInitrdDir = "initrd-from-dir"
+	lockSourceInitrdAdd = "initrd-add"
+	lockSourceRootDir   = "root-from-dir"
+	lockSourceRootTar   = "root-from-tar"
+)
+
+// lockedFile is an artifact recorded in a lockfile. The path and digest of an
+// artifact built by firectl are those of its source, the directory or
+// tarball of the root drive, or of the built initrd, which is reproducible.
+type lockedFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Source string `json:"source,omitempty"`
+}
+
+// lockedDrive is a drive recorded in a lockfile
+type lockedDrive struct {
+	lockedFile
+	ReadOnly bool `json:"read_only"`
+	Root     bool `json:"root,omitempty"`
+}
+
+// lockedMachine is the machine configuration recorded in a lockfile
+type lockedMachine struct {
+	VcpuCount   int64  `json:"vcpu_count"`
+	MemSizeMib  int64  `json:"mem_size_mib"`
+	Smt         bool   `json:"smt"`
+	CPUTemplate string `json:"cpu_template,omitempty"`
+}
+
+// vmLock records what a microVM was launched with, so that a later run can
+// be checked to launch exactly the same microVM. Drives generated by firectl,
+// such as scratch disks and shares, differ on every run and are not recorded.
+// KernelArgs is the complete kernel command line, KernelOpts the one given
+// with --kernel-opts.
+type vmLock struct {
+	Version            int           `json:"version"`
+	FirectlVersion     string        `json:"firectl_version"`
+	FirecrackerVersion string        `json:"firecracker_version"`
+	Firecracker        lockedFile    `json:"firecracker"`
+	Jailer             *lockedFile   `json:"jailer,omitempty"`
+	Kernel             lockedFile    `json:"kernel"`
+	Initrd             *lockedFile   `json:"initrd,omitempty"`
+	Drives             []lockedDrive `json:"drives,omitempty"`
+	KernelArgs         string        `json:"kernel_args"`
+	KernelOpts         string        `json:"kernel_opts,omitempty"`
+	MachineConfig      lockedMachine `json:"machine_config"`
+	MetadataSHA256     string        `json:"mmds_sha256,omitempty"`
+}
+
+// lockArtifacts returns a lock recording the firecracker version and the
+// digests of the binaries, kernel, initrd and drives given in the options.
+// It is called once the initrd and root drive are built, before firectl
+// generates any other drive. The digests computed by verifyDigests are
+// reused.
+func (opts *options) lockArtifacts() (*vmLock, error) {
+	// the binary run as firecracker is the exec file when using the jailer
+	binary := opts.ExecFile
+	if opts.JailerBinary == "" {
+		var err error
+		if binary, err = opts.firecrackerBinary(); err != nil {
+			return nil, &VMMError{Phase: vmmPhaseBinary, Err: err}
+		}
+	}
+	version, err := firecrackerVersion(binary)
+	if err != nil {
+		return nil, &VMMError{Phase: vmmPhaseBinary, Err: err}
+	}
+
+	lock := &vmLock{
+		Version:            lockVersion,
+		FirectlVersion:     Version,
+		FirecrackerVersion: version,
+		Firecracker:        lockedFile{Path: binary},
+		Kernel:             lockedFile{Path: opts.FcKernelImage},
+	}
+	files := []*lockedFile{&lock.Firecracker, &lock.Kernel}
+	if opts.JailerBinary != "" {
+		lock.Jailer = &lockedFile{Path: opts.JailerBinary}
+		files = append(files, lock.Jailer)
+	}
+	if opts.FcInitrd != "" {
+		lock.Initrd = &lockedFile{Path: opts.FcInitrd}
+		switch {
+		case len(opts.InitrdAdd) > 0:
+			lock.Initrd.Source = lockSourceInitrdAdd
+		case opts.InitrdFromDir != "":
+			lock.Initrd.Source = lockSourceInitrdDir
+		}
+		files = append(files, lock.Initrd)
+	}
+	if opts.FcRootDrivePath != "" {
+		path, readOnly := parseDevice(opts.FcRootDrivePath)
+		root := lockedDrive{lockedFile: lockedFile{Path: path}, ReadOnly: readOnly, Root: true}
+		// the images built by mke2fs differ on every run, unlike their
+		// source
+		switch {
+		case opts.RootFromDir != "":
+			root.Path, root.Source = opts.RootFromDir, lockSourceRootDir
+		case opts.RootFromTar != "":
+			root.Path, root.Source = opts.RootFromTar, lockSourceRootTar
+		}
+		lock.Drives = append(lock.Drives, root)
+	}
+	for _, entry := range opts.FcAdditionalDrives {
+		path, readOnly, isRoot, err := parseDriveEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		lock.Drives = append(lock.Drives, lockedDrive{lockedFile: lockedFile{Path: path}, ReadOnly: readOnly, Root: isRoot})
+	}
+	for i := range lock.Drives {
+		files = append(files, &lock.Drives[i].lockedFile)
+	}
+
+	var (
+		paths   []string
+		pending []*lockedFile
+	)
+	for _, f := range files {
+		if f.Path, err = filepath.Abs(f.Path); err != nil {
+			return nil, err
+		}
+		if f.Source == lockSourceRootDir {
+			if f.SHA256, err = dirSHA256(f.Path); err != nil {
+				return nil, err
+			}
+		} else if digest, ok := opts.digests[f.Path]; ok {
+			f.SHA256 = digest
+		} else {
+			paths, pending = append(paths, f.Path), append(pending, f)
+		}
+	}
+	digests, errs := hashFiles(paths)
+	for i, f := range pending {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		f.SHA256 = digests[i]
+	}
+	return lock, nil
+}
+
+// setConfig records the kernel command line, the machine configuration and
+// the digest of the MMDS document of cfg in the lock
+func (l *vmLock) setConfig(cfg firecracker.Config, metadata interface{}) error {
+	l.KernelArgs = cfg.KernelArgs
+	l.MachineConfig = lockedMachine{
+		VcpuCount:   firecracker.Int64Value(cfg.MachineCfg.VcpuCount),
+		MemSizeMib:  firecracker.Int64Value(cfg.MachineCfg.MemSizeMib),
+		Smt:         firecracker.BoolValue(cfg.MachineCfg.Smt),
+		CPUTemplate: string(cfg.MachineCfg.CPUTemplate),
+	}
+	l.MetadataSHA256 = ""
+	if metadata != nil {
+		// the document is hashed in its canonical form, with sorted keys
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(data)
+		l.MetadataSHA256 = hex.EncodeToString(digest[:])
+	}
+	return nil
+}
+
+// readLock reads the lockfile at path
+func readLock(path string) (*vmLock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var lock vmLock
+	if err := dec.Decode(&lock); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidLock, err)
+	}
+	if lock.Version != lockVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidLock, lock.Version)
+	}
+	return &lock, nil
+}
+
+// write writes the lock to the file at path
+func (l *vmLock) write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// drift returns an error for every difference between the lock and the
+// locked one, other than the paths of the artifacts and the firectl version
+func (l *vmLock) drift(locked *vmLock) []error {
+	var problems []error
+	check := func(what string, value, expected interface{}) {
+		if value != expected {
+			problems = append(problems, fmt.Errorf("%w: %s is %v, locked %v", errLockDrift, what, value, expected))
+		}
+	}
+	digest := func(f *lockedFile) string {
+		if f == nil {
+			return "none"
+		}
+		return f.SHA256
+	}
+	source := func(f *lockedFile) string {
+		if f == nil || f.Source == "" {
+			return "a file"
+		}
+		return f.Source
+	}
+
+	check("firecracker version", l.FirecrackerVersion, locked.FirecrackerVersion)
+	check("firecracker digest", l.Firecracker.SHA256, locked.Firecracker.SHA256)
+	check("jailer digest", digest(l.Jailer), digest(locked.Jailer))
+	check("kernel digest", l.Kernel.SHA256, locked.Kernel.SHA256)
+	check("initrd digest", digest(l.Initrd), digest(locked.Initrd))
+	if l.Initrd != nil && locked.Initrd != nil {
+		check("source of the initrd", source(l.Initrd), source(locked.Initrd))
+	}
+	check("number of drives", len(l.Drives), len(locked.Drives))
+	for i := 0; i < len(l.Drives) && i < len(locked.Drives); i++ {
+		d, expected := l.Drives[i], locked.Drives[i]
+		check(fmt.Sprintf("source of drive %d", i), source(&d.lockedFile), source(&expected.lockedFile))
+		check(fmt.Sprintf("digest of drive %d", i), d.SHA256, expected.SHA256)
+		check(fmt.Sprintf("read-only of drive %d", i), d.ReadOnly, expected.ReadOnly)
+		check(fmt.Sprintf("root of drive %d", i), d.Root, expected.Root)
+	}
+	check("kernel command line", fmt.Sprintf("%q", l.KernelArgs), fmt.Sprintf("%q", locked.KernelArgs))
+	check("machine config", l.MachineConfig, locked.MachineConfig)
+	check("MMDS digest", l.MetadataSHA256, locked.MetadataSHA256)
+	return problems
+}
+
+// checkLock refuses to start the microVM if it drifted from the lockfile
+// given with --lock, reporting every difference.
+func (opts *options) checkLock(lock *vmLock) error {
+	locked, err := readLock(opts.Lock)
+	if err != nil {
+		return newConfigError("lock", opts.Lock, err)
+	}
+	var problems []error
+	for _, err := range lock.drift(locked) {
+		problems = append(problems, newConfigError("lock", opts.Lock, err))
+	}
+	if len(problems) > 0 {
+		return &preflightError{problems: problems}
+	}
+	return nil
+}
+
+// applyLock fills in the options which were not given on the command line
+// from the lockfile given with --lock, so that the locked microVM is run
+// again with --lock alone: the binaries, the kernel and its command line, the
+// initrd and drives and their sources, and the machine configuration. The
+// initrd and drives are only filled in when none is given, and drives not
+// for an OCI bundle, which has its own rootfs.
+func (opts *options) applyLock() error {
+	if opts.Lock == "" || opts.optionGiven == nil {
+		return nil
+	}
+	locked, err := readLock(opts.Lock)
+	if err != nil {
+		return newConfigError("lock", opts.Lock, err)
+	}
+	given := func(names ...string) bool {
+		for _, name := range names {
+			if opts.optionGiven(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if locked.Jailer != nil {
+		if !given("jailer") {
+			opts.JailerBinary = locked.Jailer.Path
+		}
+		if !given("exec-file") {
+			opts.ExecFile = locked.Firecracker.Path
+		}
+	} else if !given("firecracker-binary") {
+		opts.FcBinary = locked.Firecracker.Path
+	}
+	if !given("kernel") {
+		opts.FcKernelImage = locked.Kernel.Path
+	}
+	if !given("kernel-opts") && locked.KernelOpts != "" {
+		opts.FcKernelCmdLine = locked.KernelOpts
+	}
+
+	if locked.Initrd != nil && !given("initrd-path", "initrd-from-dir", "initrd-add") {
+		switch locked.Initrd.Source {
+		case "":
+			opts.FcInitrd = locked.Initrd.Path
+		case lockSourceInitrdDir:
+			opts.InitrdFromDir = locked.Initrd.Path
+		}
+	}
+
+	if opts.ociBundle == "" && !given("root-drive", "root-from-dir", "root-from-tar", "add-drive") {
+		for i, d := range locked.Drives {
+			suffix := rwDeviceSuffix
+			if d.ReadOnly {
+				suffix = roDeviceSuffix
+			}
+			if i == 0 && d.Root {
+				switch d.Source {
+				case lockSourceRootDir:
+					opts.RootFromDir = d.Path
+				case lockSourceRootTar:
+					opts.RootFromTar = d.Path
+				default:
+					opts.FcRootDrivePath = d.Path + suffix
+				}
+				continue
+			}
+			if d.Root {
+				suffix += rootDeviceSuffix
+			}
+			opts.FcAdditionalDrives = append(opts.FcAdditionalDrives, d.Path+suffix)
+		}
+	}
+
+	if !given("ncpus") {
+		opts.FcCPUCount = locked.MachineConfig.VcpuCount
+	}
+	if !given("memory") {
+		opts.FcMemSz = locked.MachineConfig.MemSizeMib
+	}
+	if !given("disable-smt") {
+		opts.FcDisableSmt = !locked.MachineConfig.Smt
+	}
+	if !given("cpu-template") {
+		opts.FcCPUTemplate = locked.MachineConfig.CPUTemplate
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// lockOptions locks the microVM described by opts
+func lockOptions(t *testing.T, opts *options, metadata interface{}) *vmLock {
+	lock, err := opts.lockArtifacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := firecracker.Config{
+		KernelArgs: opts.FcKernelCmdLine,
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  firecracker.Int64(opts.FcCPUCount),
+			MemSizeMib: firecracker.Int64(opts.FcMemSz),
+			Smt:        firecracker.Bool(!opts.FcDisableSmt),
+		},
+	}
+	if err := lock.setConfig(cfg, metadata); err != nil {
+		t.Fatal(err)
+	}
+	return lock
+}
+
+func TestCheckLock(t *testing.T) {
+	cases := []struct {
+		name     string
+		setup    func(opts *options)
+		metadata interface{}
+		drifts   int
+	}{
+		{
+			name:  "same microVM",
+			setup: func(opts *options) {},
+		},
+		{
+			name: "artifacts moved",
+			setup: func(opts *options) {
+				moved := opts.FcKernelImage + ".moved"
+				if err := os.Rename(opts.FcKernelImage, moved); err != nil {
+					t.Fatal(err)
+				}
+				opts.FcKernelImage = moved
+			},
+		},
+		{
+			name: "kernel changed",
+			setup: func(opts *options) {
+				if err := os.WriteFile(opts.FcKernelImage, []byte("changed"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			drifts: 1,
+		},
+		{
+			name: "drive added and memory changed",
+			setup: func(opts *options) {
+				opts.FcAdditionalDrives = []string{filepath.Join(filepath.Dir(opts.FcRootDrivePath), "data") + roDeviceSuffix}
+				opts.FcMemSz = 1024
+			},
+			drifts: 2,
+		},
+		{
+			name: "root drive built from a changed directory",
+			setup: func(opts *options) {
+				// the image built from the directory differs on every run
+				opts.RootFromDir = filepath.Join(filepath.Dir(opts.FcRootDrivePath), "rootfs-dir")
+				if err := os.WriteFile(filepath.Join(opts.RootFromDir, "init"), []byte("changed"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				opts.FcRootDrivePath = filepath.Join(t.TempDir(), "rootfs.ext4")
+			},
+			drifts: 1,
+		},
+		{
+			name: "root drive built from a copy of the directory",
+			setup: func(opts *options) {
+				copied := filepath.Join(t.TempDir(), "copy")
+				if err := os.Mkdir(copied, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(copied, "init"), []byte("init"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				opts.RootFromDir = copied
+			},
+		},
+		{
+			name:     "metadata and command line changed",
+			setup:    func(opts *options) { opts.FcKernelCmdLine += " quiet" },
+			metadata: map[string]interface{}{"key": "value"},
+			drifts:   2,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := setupPreflight(t)
+			opts.FcKernelCmdLine = "console=ttyS0"
+			// a root drive built by firectl from a directory
+			opts.RootFromDir = filepath.Join(filepath.Dir(opts.FcRootDrivePath), "rootfs-dir")
+			if err := os.Mkdir(opts.RootFromDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(opts.RootFromDir, "init"), []byte("init"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			opts.Lock = filepath.Join(t.TempDir(), "vm.lock.json")
+			if err := lockOptions(t, opts, nil).write(opts.Lock); err != nil {
+				t.Fatal(err)
+			}
+
+			c.setup(opts)
+			err := opts.checkLock(lockOptions(t, opts, c.metadata))
+			var preflight *preflightError
+			if c.drifts == 0 {
+				if err != nil {
+					t.Errorf("expected no drift but got %v", err)
+				}
+			} else if !errors.As(err, &preflight) || len(preflight.problems) != c.drifts || !errors.Is(err, errLockDrift) {
+				t.Errorf("expected %d drifts but got %v", c.drifts, err)
+			} else if code := exitCode(err, false); code != exitConfigError {
+				t.Errorf("expected exit code %d but got %d", exitConfigError, code)
+			}
+		})
+	}
+}
+
+func TestLockReusesDigests(t *testing.T) {
+	opts := setupPreflight(t)
+	opts.KernelSHA256 = strings.Repeat("0", 64)
+	// verifyDigests hashes the pinned kernel, which then changes
+	if err := opts.verifyDigests(); !errors.Is(err, errDigestMismatch) {
+		t.Fatalf("expected a digest mismatch but got %v", err)
+	}
+	verified := opts.digests[opts.FcKernelImage]
+	if err := os.WriteFile(opts.FcKernelImage, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := opts.lockArtifacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified == "" || lock.Kernel.SHA256 != verified {
+		t.Errorf("expected the lock to reuse the verified digest %q but got %q", verified, lock.Kernel.SHA256)
+	}
+}
+
+func TestApplyLock(t *testing.T) {
+	locked := &vmLock{
+		Version:       lockVersion,
+		Firecracker:   lockedFile{Path: "/opt/firecracker"},
+		Kernel:        lockedFile{Path: "/images/vmlinux"},
+		Initrd:        &lockedFile{Path: "/images/initrd", Source: lockSourceInitrdDir},
+		KernelOpts:    "console=ttyS0",
+		MachineConfig: lockedMachine{VcpuCount: 4, MemSizeMib: 1024, Smt: true},
+		Drives: []lockedDrive{
+			{lockedFile: lockedFile{Path: "/images/rootfs", Source: lockSourceRootDir}, ReadOnly: true, Root: true},
+			{lockedFile: lockedFile{Path: "/images/data.ext4"}, ReadOnly: false},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "vm.lock.json")
+	if err := locked.write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &options{
+		Lock:            path,
+		FcKernelImage:   "./vmlinux",
+		FcKernelCmdLine: "ro console=ttyS0 noapic reboot=k panic=1 pci=off nomodules",
+		FcCPUCount:      1,
+		FcMemSz:         2048,
+		FcDisableSmt:    true,
+		optionGiven: func(name string) bool {
+			return name == "memory"
+		},
+	}
+	if err := opts.applyLock(); err != nil {
+		t.Fatal(err)
+	}
+	expected := &options{
+		Lock:               path,
+		FcBinary:           "/opt/firecracker",
+		FcKernelImage:      "/images/vmlinux",
+		FcKernelCmdLine:    "console=ttyS0",
+		InitrdFromDir:      "/images/initrd",
+		RootFromDir:        "/images/rootfs",
+		FcAdditionalDrives: []string{"/images/data.ext4" + rwDeviceSuffix},
+		FcCPUCount:         4,
+		FcMemSz:            2048,
+	}
+	opts.optionGiven = nil
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("expected %+v but got %+v", expected, opts)
+	}
+}
+
+func TestReadLock(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name   string
+		lock   string
+		outErr error
+	}{
+		{name: "valid", lock: `{"version": 1, "kernel": {"path": "/vmlinux", "sha256": "00"}}`},
+		{name: "unknown version", lock: `{"version": 2}`, outErr: errInvalidLock},
+		{name: "unknown field", lock: `{"version": 1, "kernel_sha256": "00"}`, outErr: errInvalidLock},
+		{name: "not json", lock: `version: 1`, outErr: errInvalidLock},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, "vm.lock.json")
+			if err := os.WriteFile(path, []byte(c.lock), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readLock(path); !errors.Is(err, c.outErr) {
+				t.Errorf("expected %v but got %v", c.outErr, err)
+			}
+		})
+	}
+}
@@ -15,13 +15,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
 	"syscall"
+	"time"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	flags "github.com/jessevdk/go-flags"
 	log "github.com/sirupsen/logrus"
 )
@@ -32,17 +35,85 @@ const (
 	executableMask = 0111
 
 	firecrackerDefaultPath = "firecracker"
+
+	errorFormatJSON = "json"
+
+	// stateUpdateInterval is how often the VM state is queried for the exit
+	// report
+	stateUpdateInterval = time.Second
 )
 
 func main() {
 	opts := newOptions()
 	p := flags.NewParser(opts, flags.Default)
+	p.SubcommandsOptional = true
+	p.AddCommand("run", "Run a microVM (default)",
+		"Run a microVM with the given options. This is the default when no command is given.",
+		&struct{}{})
+	p.AddCommand("doctor", "Check that the host can run Firecracker",
+		"Check that the host can run Firecracker, printing pass, warn or fail for each check. "+
+			"Exits with a nonzero status if any check failed.",
+		&struct{}{})
+	imageBuild := &imageBuildOptions{}
+	image, err := p.AddCommand("image", "Build disk images",
+		"Build disk images for use as drives of a microVM.",
+		&struct{}{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := image.AddCommand("build", "Build an ext4 image from a directory or a tarball",
+		"Build a sparse ext4 image from a directory or a tarball, such as the output of docker export, "+
+			"which can be used with --root-drive or --add-drive. Requires mke2fs, and debugfs for tarballs "+
+			"whose owners or device nodes cannot be reproduced by the current user.",
+		imageBuild); err != nil {
+		log.Fatal(err)
+	}
+	ociRun := &ociRunOptions{}
+	oci, err := p.AddCommand("oci", "Run OCI runtime bundles",
+		"Run OCI runtime bundles as microVMs.",
+		&struct{}{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := oci.AddCommand("run", "Run an OCI runtime bundle as a microVM",
+		"Run the process of an OCI runtime bundle as the init of a microVM booted from its rootfs. "+
+			"The rootfs is built into an ext4 root drive, and the memory and CPU limits of the bundle "+
+			"size the microVM. All application options apply.",
+		ociRun); err != nil {
+		log.Fatal(err)
+	}
+	artifactAdd, artifactGC := &artifactAddOptions{}, &artifactGCOptions{}
+	artifact, err := p.AddCommand("artifact", "Manage the artifact cache",
+		"Manage the local cache of kernels, initrds, drives and binaries, addressed by their SHA-256 digest. "+
+			"Cached artifacts can be given in place of a path as sha256:HEX.",
+		&struct{}{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range []struct {
+		name, short, long string
+		data              interface{}
+	}{
+		{"add", "Add files to the cache", "Add files to the cache and print their reference.", artifactAdd},
+		{"ls", "List the cached artifacts", "List the cached artifacts with their size and when they were last used.", &struct{}{}},
+		{"gc", "Remove unused artifacts", "Remove the artifacts which were not used recently.", artifactGC},
+	} {
+		if _, err := artifact.AddCommand(c.name, c.short, c.long, c.data); err != nil {
+			log.Fatal(err)
+		}
+	}
+	gc := &gcOptions{}
+	if _, err := p.AddCommand("gc", "Remove stale jails, sockets and FIFO directories",
+		"Remove the jails, default firecracker sockets and FIFO directories left behind by microVMs which are no longer running.",
+		gc); err != nil {
+		log.Fatal(err)
+	}
 	// if no args just print help
 	if len(os.Args) == 1 {
 		p.WriteHelp(os.Stderr)
 		os.Exit(0)
 	}
-	_, err := p.ParseArgs(os.Args)
+	_, err = p.ParseArgs(os.Args[1:])
 	if err != nil {
 		// ErrHelp indicates that the help message was printed so we
 		// can exit
@@ -50,7 +121,7 @@ func main() {
 			os.Exit(0)
 		}
 		p.WriteHelp(os.Stderr)
-		os.Exit(1)
+		os.Exit(exitConfigError)
 	}
 
 	if opts.Version {
@@ -59,19 +130,196 @@ func main() {
 		os.Exit(0)
 	}
 
-	defer opts.Close()
+	if p.Active != nil && p.Active.Name == "doctor" {
+		if !runDoctor(os.Stdout, opts.doctorChecks()) {
+			os.Exit(exitFailure)
+		}
+		os.Exit(exitSuccess)
+	}
+
+	if p.Active != nil && p.Active.Name == "image" {
+		exitCommand(opts.ErrorFormat, imageBuild.build())
+	}
+
+	if p.Active != nil && p.Active.Name == "artifact" {
+		exitCommand(opts.ErrorFormat, opts.runArtifactCommand(os.Stdout, p.Active.Active.Name, artifactAdd, artifactGC))
+	}
+
+	if p.Active != nil && p.Active.Name == "gc" {
+		exitCommand(opts.ErrorFormat, opts.runGC(os.Stdout, gc))
+	}
+
+	if p.Active != nil && p.Active.Name == "oci" {
+		opts.ociBundle = ociRun.Args.Bundle
+	}
+	opts.optionGiven = func(name string) bool {
+		option := p.FindOptionByLongName(name)
+		return option != nil && option.IsSet() && !option.IsSetDefault()
+	}
+
+	report := newExitReport(time.Now())
+	err = runVMM(context.Background(), opts, report)
+	// os.Exit does not run deferred calls, so the closers are run explicitly
+	// to ensure logs and recordings are flushed and closed.
+	opts.Close()
+
+	code := report.finish(err, time.Now())
+	if err != nil {
+		printError(opts.ErrorFormat, err, code)
+	}
+	if opts.ExitReport != "" {
+		if err := report.write(opts.ExitReport); err != nil {
+			log.Errorf("Failed to write exit report: %v", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// exitCommand exits once a command other than run has completed, printing
+// its error if it failed
+func exitCommand(format string, err error) {
+	if err != nil {
+		code := exitCode(err, false)
+		printError(format, err, code)
+		os.Exit(code)
+	}
+	os.Exit(exitSuccess)
+}
 
-	if err := runVMM(context.Background(), opts); err != nil {
-		log.Fatalf(err.Error())
+// printError prints the error which caused firectl to fail, either as a log
+// message or as a single line of JSON on stderr.
+func printError(format string, err error, code int) {
+	if format != errorFormatJSON {
+		// log each preflight problem on its own line
+		var preflight *preflightError
+		if errors.As(err, &preflight) {
+			for _, p := range preflight.problems {
+				log.Errorf("Preflight check failed: %v", p)
+			}
+			return
+		}
+		log.Error(err)
+		return
+	}
+	data, jsonErr := json.Marshal(newErrorOutput(err, code))
+	if jsonErr != nil {
+		log.Error(err)
+		return
 	}
+	fmt.Fprintf(os.Stderr, "%s\n", data)
 }
 
 // Run a vmm with a given set of options
-func runVMM(ctx context.Context, opts *options) error {
+func runVMM(ctx context.Context, opts *options, report *exitReport) error {
+	if err := opts.applyLock(); err != nil {
+		return err
+	}
+	// the kernel command line is extended with the OCI process and the
+	// shares, the lock also records it as given
+	kernelOpts := opts.FcKernelCmdLine
+	if err := opts.applyOCIBundle(); err != nil {
+		return err
+	}
+	if err := opts.resolveArtifacts(); err != nil {
+		return err
+	}
+	opts.applyJailerDefaults()
+	// report every problem with the options or the host before anything is
+	// set up
+	if err := opts.preflight(); err != nil {
+		return err
+	}
+	opts.logJailSummary()
+	if err := opts.verifyDigests(); err != nil {
+		return err
+	}
+	if err := opts.prepareKernel(); err != nil {
+		return err
+	}
+	if err := opts.buildInitrd(); err != nil {
+		return err
+	}
+	if err := opts.buildRootDrive(); err != nil {
+		return err
+	}
+	// the artifacts are locked once the initrd and root drive are built,
+	// before firectl generates the drives which differ on every run
+	var lock *vmLock
+	if opts.Lock != "" || opts.WriteLock != "" {
+		var err error
+		if lock, err = opts.lockArtifacts(); err != nil {
+			return err
+		}
+		lock.KernelOpts = kernelOpts
+	}
+	if err := opts.cloneRootDrive(); err != nil {
+		return err
+	}
+	if err := opts.createScratchDisks(); err != nil {
+		return err
+	}
+	if err := opts.buildShares(); err != nil {
+		return err
+	}
+
+	var console *interactiveConsole
+	if opts.Interactive {
+		escape, err := parseEscapeChar(opts.EscapeChar)
+		if err != nil {
+			return newConfigError("escape-char", opts.EscapeChar, err)
+		}
+		if console, err = newInteractiveConsole(os.Stdin, escape); err != nil {
+			return newConfigError("interactive", "", err)
+		}
+		defer func() {
+			if err := console.Close(); err != nil {
+				log.Errorf("An error occurred while restoring the terminal: %v", err)
+			}
+		}()
+		opts.stdin = console.guest
+	}
+
+	var (
+		runner *scriptRunner
+		steps  []scriptStep
+	)
+	if opts.Script != "" {
+		if opts.Interactive {
+			return newConfigError("script", opts.Script, errScriptInteractive)
+		}
+		var err error
+		if steps, err = loadScript(opts.Script); err != nil {
+			return newConfigError("script", opts.Script, err)
+		}
+		if runner, err = newScriptRunner(); err != nil {
+			return err
+		}
+		opts.stdin = runner.guest
+		opts.consoleWatchers = append(opts.consoleWatchers, runner)
+	}
+
+	detector := &guestFailureDetector{}
+	opts.consoleWatchers = append(opts.consoleWatchers, detector.stream())
+
 	// convert options to a firecracker config
 	fcCfg, err := opts.getFirecrackerConfig()
 	if err != nil {
-		log.Errorf("Error: %s", err)
+		return err
+	}
+	if lock != nil {
+		if err := lock.setConfig(fcCfg, opts.validMetadata); err != nil {
+			return err
+		}
+		if opts.Lock != "" {
+			if err := opts.checkLock(lock); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the firecracker log is scanned for guest failures and its last lines
+	// are kept for the exit report
+	if err := opts.captureFirecrackerLog(&fcCfg, report.logTail, detector.stream()); err != nil {
 		return err
 	}
 	logger := log.New()
@@ -88,29 +336,9 @@ func runVMM(ctx context.Context, opts *options) error {
 		firecracker.WithLogger(log.NewEntry(logger)),
 	}
 
-	var firecrackerBinary string
-	if len(opts.FcBinary) != 0 {
-		firecrackerBinary = opts.FcBinary
-	} else {
-		firecrackerBinary, err = exec.LookPath(firecrackerDefaultPath)
-		if err != nil {
-			return err
-		}
-	}
-
-	finfo, err := os.Stat(firecrackerBinary)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("Binary %q does not exist: %v", firecrackerBinary, err)
-	}
-
+	firecrackerBinary, err := opts.firecrackerBinary()
 	if err != nil {
-		return fmt.Errorf("Failed to stat binary, %q: %v", firecrackerBinary, err)
-	}
-
-	if finfo.IsDir() {
-		return fmt.Errorf("Binary, %q, is a directory", firecrackerBinary)
-	} else if finfo.Mode()&executableMask == 0 {
-		return fmt.Errorf("Binary, %q, is not executable. Check permissions of binary", firecrackerBinary)
+		return &VMMError{Phase: vmmPhaseBinary, Err: err}
 	}
 
 	// if the jailer is used, the final command will be built in NewMachine()
@@ -118,21 +346,42 @@ func runVMM(ctx context.Context, opts *options) error {
 		cmd := firecracker.VMCommandBuilder{}.
 			WithBin(firecrackerBinary).
 			WithSocketPath(fcCfg.SocketPath).
-			WithStdin(os.Stdin).
-			WithStdout(os.Stdout).
-			WithStderr(os.Stderr).
+			WithStdin(opts.stdin).
+			WithStdout(opts.stdout).
+			WithStderr(opts.stderr).
 			Build(ctx)
 
 		machineOpts = append(machineOpts, firecracker.WithProcessRunner(cmd))
+	} else {
+		// the SDK does not support every jailer option, the jailer command
+		// is built here when one of them is used
+		args, err := opts.jailerArgs()
+		if err != nil {
+			return err
+		}
+		if len(args) > 0 {
+			machineOpts = append(machineOpts, firecracker.WithProcessRunner(jailerCommand(ctx, fcCfg, args)))
+		}
 	}
 
 	m, err := firecracker.NewMachine(vmmCtx, fcCfg, machineOpts...)
 	if err != nil {
-		return fmt.Errorf("Failed creating machine: %s", err)
+		return &VMMError{Phase: vmmPhaseCreate, Err: err}
+	}
+	if opts.EntropyDevice {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.AddVsocksHandlerName, entropyDeviceHandler)
+	}
+	if opts.SerialOut != "" {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.AddVsocksHandlerName, serialOutputHandler(opts.SerialOut))
 	}
 
+	report.setState(models.InstanceInfoStateNotStarted)
 	if err := m.Start(vmmCtx); err != nil {
-		return fmt.Errorf("Failed to start machine: %v", err)
+		// a guest failure can also prevent the machine from starting
+		if err := detector.failure(); err != nil {
+			return err
+		}
+		return &VMMError{Phase: vmmPhaseStart, Err: err}
 	}
 	defer func() {
 		if err := m.StopVMM(); err != nil {
@@ -146,18 +395,80 @@ func runVMM(ctx context.Context, opts *options) error {
 		}
 	}
 
-	installSignalHandlers(vmmCtx, m)
+	installSignalHandlers(vmmCtx, m, report)
+	if console != nil {
+		log.Printf("Interactive console attached, type %s ? for help", formatEscapeChar(console.filter.escape))
+		console.serve(vmmCtx, m, report)
+	}
+	if opts.ExitReport != "" {
+		watchState(vmmCtx, m, report)
+	}
+
+	var scriptResult <-chan error
+	scriptCtx, scriptCancel := context.WithCancel(vmmCtx)
+	defer scriptCancel()
+	if runner != nil {
+		scriptResult = runner.drive(scriptCtx, m, steps)
+	}
 
 	// wait for the VMM to exit
-	if err := m.Wait(vmmCtx); err != nil {
-		return fmt.Errorf("Wait returned an error %s", err)
+	waitErr := m.Wait(vmmCtx)
+
+	var scriptErr error
+	if runner != nil {
+		scriptCancel()
+		if scriptErr = <-scriptResult; scriptErr != nil {
+			fmt.Fprintf(os.Stderr, "Console transcript:\n%s\n", runner.Transcript())
+		} else if opts.ScriptCaptureDir != "" {
+			if err := writeCaptures(opts.ScriptCaptureDir, runner.Captures()); err != nil {
+				return fmt.Errorf("Failed to write script captures: %w", err)
+			}
+		}
+	}
+
+	// a guest failure explains why the script or the VMM failed, so it is
+	// reported first
+	if err := detector.failure(); err != nil {
+		return err
+	}
+	if scriptErr != nil {
+		return scriptErr
+	}
+
+	if waitErr != nil {
+		return &VMMError{Phase: vmmPhaseWait, Err: waitErr}
+	}
+	if opts.WriteLock != "" {
+		if err := lock.write(opts.WriteLock); err != nil {
+			return fmt.Errorf("Failed to write the lockfile: %w", err)
+		}
+		log.Infof("Wrote lockfile %s", opts.WriteLock)
 	}
 	log.Printf("Start machine was happy")
 	return nil
 }
 
+// watchState periodically records the state of the VM in the exit report
+// until ctx is done.
+func watchState(ctx context.Context, m *firecracker.Machine, report *exitReport) {
+	go func() {
+		ticker := time.NewTicker(stateUpdateInterval)
+		defer ticker.Stop()
+		for {
+			if info, err := m.DescribeInstanceInfo(ctx); err == nil && info.State != nil {
+				report.setState(*info.State)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
 // Install custom signal handlers:
-func installSignalHandlers(ctx context.Context, m *firecracker.Machine) {
+func installSignalHandlers(ctx context.Context, m *firecracker.Machine, report *exitReport) {
 	go func() {
 		// Clear some default handlers installed by the firecracker SDK:
 		signal.Reset(os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
@@ -165,7 +476,11 @@ func installSignalHandlers(ctx context.Context, m *firecracker.Machine) {
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 
 		for {
-			switch s := <-c; {
+			s := <-c
+			if sig, ok := s.(syscall.Signal); ok {
+				report.setSignal(sig)
+			}
+			switch {
 			case s == syscall.SIGTERM || s == os.Interrupt:
 				log.Printf("Caught signal: %s, requesting clean shutdown", s.String())
 				if err := m.Shutdown(ctx); err != nil {
@@ -173,6 +488,7 @@ func installSignalHandlers(ctx context.Context, m *firecracker.Machine) {
 				}
 			case s == syscall.SIGQUIT:
 				log.Printf("Caught signal: %s, forcing shutdown", s.String())
+				report.setKilled("signal " + s.String())
 				if err := m.StopVMM(); err != nil {
 					log.Errorf("An error occurred while stopping Firecracker VMM: %v", err)
 				}
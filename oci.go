@@ -0,0 +1,351 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ociConfigFile is the runtime spec of an OCI bundle
+	ociConfigFile = "config.json"
+	// ociMetadataKey is the key of the MMDS metadata the process of an OCI
+	// bundle is published under
+	ociMetadataKey = "oci"
+	// ociDefaultCPUPeriod is the CFS period assumed when the spec only has a
+	// quota
+	ociDefaultCPUPeriod = 100000
+	// ociDefaultPath is the PATH the command of the process is looked up in
+	// when the spec does not set one, as runc does
+	ociDefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// ociMaxSymlinks is the number of symlinks followed resolving a path of
+	// the rootfs
+	ociMaxSymlinks = 40
+)
+
+// ociRunOptions are the options of the oci run command
+type ociRunOptions struct {
+	Args struct {
+		Bundle string `positional-arg-name:"bundle-dir" description:"Directory of the OCI runtime bundle"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// ociSpec is the subset of the OCI runtime spec used to run a bundle, see
+// https://github.com/opencontainers/runtime-spec/blob/main/config.md
+type ociSpec struct {
+	Process  *ociProcess `json:"process"`
+	Root     *ociRoot    `json:"root"`
+	Hostname string      `json:"hostname,omitempty"`
+	Linux    *ociLinux   `json:"linux"`
+}
+
+type ociProcess struct {
+	Terminal bool     `json:"terminal,omitempty"`
+	User     ociUser  `json:"user"`
+	Args     []string `json:"args"`
+	Env      []string `json:"env,omitempty"`
+	Cwd      string   `json:"cwd"`
+}
+
+type ociUser struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+type ociRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type ociLinux struct {
+	Resources *struct {
+		Memory *struct {
+			Limit *int64 `json:"limit"`
+		} `json:"memory"`
+		CPU *struct {
+			Quota  *int64  `json:"quota"`
+			Period *uint64 `json:"period"`
+			Cpus   string  `json:"cpus"`
+		} `json:"cpu"`
+	} `json:"resources"`
+}
+
+// loadOCISpec reads the runtime spec of the bundle in dir
+func loadOCISpec(dir string) (*ociSpec, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ociConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	var spec ociSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidOCISpec, err)
+	}
+	if spec.Root == nil || spec.Root.Path == "" {
+		return nil, fmt.Errorf("%w: root.path is required", errInvalidOCISpec)
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return nil, errOCIProcessArgs
+	}
+	return &spec, nil
+}
+
+// applyOCIBundle configures the microVM to run the bundle given to the oci
+// run command: its rootfs is built into the root drive, its process is run as
+// init through the kernel command line and its resource limits size the
+// machine.
+func (opts *options) applyOCIBundle() error {
+	if opts.ociBundle == "" {
+		return nil
+	}
+	spec, err := loadOCISpec(opts.ociBundle)
+	if err != nil {
+		return newConfigError("bundle", opts.ociBundle, err)
+	}
+
+	// root filesystem
+	if opts.FcRootDrivePath != "" || opts.RootFromDir != "" || opts.RootFromTar != "" {
+		return newConfigError("bundle", opts.ociBundle, errOCIRootConflict)
+	}
+	opts.RootFromDir = spec.Root.Path
+	if !filepath.IsAbs(opts.RootFromDir) {
+		opts.RootFromDir = filepath.Join(opts.ociBundle, opts.RootFromDir)
+	}
+
+	// process, the kernel runs init with the parameters it does not
+	// recognize as its environment and those after -- as its arguments
+	params := []string{opts.FcKernelCmdLine}
+	if spec.Root.Readonly {
+		params = append(params, "ro")
+	} else {
+		params = append(params, "rw")
+	}
+	command, err := spec.Process.lookPath(opts.RootFromDir)
+	if err != nil {
+		return newConfigError("bundle", opts.ociBundle, err)
+	}
+	init, err := kernelParam("init=" + command)
+	if err != nil {
+		return newConfigError("bundle", opts.ociBundle, err)
+	}
+	params = append(params, init)
+	for _, env := range spec.Process.Env {
+		param, err := kernelParam(env)
+		if err != nil {
+			return newConfigError("bundle", opts.ociBundle, err)
+		}
+		params = append(params, param)
+	}
+	if len(spec.Process.Args) > 1 {
+		params = append(params, "--")
+		for _, arg := range spec.Process.Args[1:] {
+			param, err := kernelParam(arg)
+			if err != nil {
+				return newConfigError("bundle", opts.ociBundle, err)
+			}
+			params = append(params, param)
+		}
+	}
+	opts.FcKernelCmdLine = strings.Join(params, " ")
+
+	// the working directory, user and hostname cannot be given to init by
+	// the kernel, they are published in MMDS for an init which applies them
+	if err := opts.addOCIMetadata(spec); err != nil {
+		return newConfigError("metadata", opts.FcMetadata, err)
+	}
+
+	// resources
+	if spec.Linux == nil || spec.Linux.Resources == nil {
+		return nil
+	}
+	if memory := spec.Linux.Resources.Memory; memory != nil && memory.Limit != nil && *memory.Limit > 0 {
+		opts.FcMemSz = (*memory.Limit + 1<<20 - 1) >> 20
+	}
+	if cpu := spec.Linux.Resources.CPU; cpu != nil {
+		var vcpus int64
+		if cpu.Quota != nil && *cpu.Quota > 0 {
+			period := int64(ociDefaultCPUPeriod)
+			if cpu.Period != nil && *cpu.Period > 0 {
+				period = int64(*cpu.Period)
+			}
+			vcpus = (*cpu.Quota + period - 1) / period
+		} else if cpu.Cpus != "" {
+			if vcpus, err = countCPUs(cpu.Cpus); err != nil {
+				return newConfigError("bundle", opts.ociBundle, fmt.Errorf("%w: linux.resources.cpu.cpus: %w", errInvalidOCISpec, err))
+			}
+		}
+		// firecracker requires an even vCPU count with SMT
+		if vcpus > 1 && vcpus%2 != 0 && runtime.GOARCH == "amd64" && !opts.FcDisableSmt {
+			log.Debugf("Rounding the %d CPUs of the OCI bundle up to %d vCPUs as SMT is enabled", vcpus, vcpus+1)
+			vcpus++
+		}
+		if vcpus > 0 {
+			opts.FcCPUCount = vcpus
+		}
+	}
+	return nil
+}
+
+// addOCIMetadata publishes the process and hostname of the spec in MMDS,
+// merged with the metadata given with --metadata. MMDS is only reachable
+// through a network interface, so nothing is published without one. As the
+// process would then run as root in /, a working directory or a user is
+// refused without one.
+func (opts *options) addOCIMetadata(spec *ociSpec) error {
+	if len(opts.FcNicConfig) == 0 {
+		if spec.Process.Cwd != "" && spec.Process.Cwd != "/" || spec.Process.User != (ociUser{}) {
+			return errOCIProcessNeedsMMDS
+		}
+		if spec.Hostname != "" {
+			log.Warnf("The hostname of the OCI bundle is only published in MMDS, which requires a tap device")
+		}
+		return nil
+	}
+
+	metadata := map[string]interface{}{}
+	if opts.FcMetadata != "" {
+		if err := json.Unmarshal([]byte(opts.FcMetadata), &metadata); err != nil {
+			return fmt.Errorf("%w: the metadata of an OCI bundle must be an object: %w", errInvalidMetadata, err)
+		}
+	}
+	metadata[ociMetadataKey] = struct {
+		Process  *ociProcess `json:"process"`
+		Hostname string      `json:"hostname,omitempty"`
+	}{spec.Process, spec.Hostname}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	opts.FcMetadata = string(data)
+	return nil
+}
+
+// lookPath returns the path of the command of the process in the rootfs at
+// root. Like runc, a command without a slash is looked up in the PATH of the
+// process environment, while a relative path is relative to its working
+// directory.
+func (p *ociProcess) lookPath(root string) (string, error) {
+	command := p.Args[0]
+	if path.IsAbs(command) {
+		return command, nil
+	}
+	if strings.Contains(command, "/") {
+		return path.Join("/", p.Cwd, command), nil
+	}
+
+	dirs := ociDefaultPath
+	for _, env := range p.Env {
+		if value, ok := strings.CutPrefix(env, "PATH="); ok {
+			dirs = value
+		}
+	}
+	for _, dir := range filepath.SplitList(dirs) {
+		// relative entries of the PATH are relative to the working directory
+		candidate := path.Join(dir, command)
+		if !path.IsAbs(dir) {
+			candidate = path.Join("/", p.Cwd, dir, command)
+		}
+		resolved, err := resolveRootfsPath(root, candidate)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(root, resolved)); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s in %s", errOCIProcessNotFound, command, dirs)
+}
+
+// resolveRootfsPath resolves the symlinks of the absolute path p of the
+// rootfs at root as the guest would, without leaving the rootfs, and returns
+// the resolved path within the rootfs
+func resolveRootfsPath(root, p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(p, "/")
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > ociMaxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return resolved, nil
+}
+
+// kernelParam quotes s as a single kernel command line parameter
+func kernelParam(s string) (string, error) {
+	if s == "" || strings.ContainsAny(s, "\"\n") {
+		return "", fmt.Errorf("%q %w", s, errInvalidKernelParam)
+	}
+	if strings.ContainsAny(s, " \t") {
+		return `"` + s + `"`, nil
+	}
+	return s, nil
+}
+
+// countCPUs returns the number of CPUs in a cpuset list such as 0-3,6
+func countCPUs(cpus string) (int64, error) {
+	var count int64
+	for _, r := range strings.Split(cpus, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(r), "-")
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+				return 0, err
+			}
+		}
+		if end < start {
+			return 0, fmt.Errorf("invalid range %q", r)
+		}
+		count += end - start + 1
+	}
+	return count, nil
+}
@@ -0,0 +1,250 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+const testOCISpec = `{
+	"ociVersion": "1.0.2",
+	"process": {
+		"user": {"uid": 1000, "gid": 1000},
+		"args": ["/bin/sh", "-c", "echo hello world"],
+		"env": ["PATH=/usr/bin:/bin", "GREETING=hello world"],
+		"cwd": "/work"
+	},
+	"root": {"path": "rootfs", "readonly": true},
+	"hostname": "bundle",
+	"linux": {
+		"resources": {
+			"memory": {"limit": 268435456},
+			"cpu": {"quota": 150000, "period": 100000}
+		}
+	}
+}`
+
+func TestApplyOCIBundle(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ociConfigFile), []byte(testOCISpec), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &options{
+		FcKernelCmdLine: "console=ttyS0",
+		FcCPUCount:      1,
+		FcMemSz:         512,
+		FcDisableSmt:    true,
+		FcNicConfig:     []string{"tap0/06:00:c0:a8:00:02"},
+		FcMetadata:      `{"foo":"bar"}`,
+		ociBundle:       dir,
+	}
+	if err := opts.applyOCIBundle(); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := filepath.Join(dir, "rootfs"); opts.RootFromDir != expected {
+		t.Errorf("expected the root drive to be built from %s but got %s", expected, opts.RootFromDir)
+	}
+	expectedCmdLine := `console=ttyS0 ro init=/bin/sh PATH=/usr/bin:/bin "GREETING=hello world" -- -c "echo hello world"`
+	if opts.FcKernelCmdLine != expectedCmdLine {
+		t.Errorf("expected kernel command line %q but got %q", expectedCmdLine, opts.FcKernelCmdLine)
+	}
+	if opts.FcMemSz != 256 {
+		t.Errorf("expected 256 MiB of memory but got %d", opts.FcMemSz)
+	}
+	if opts.FcCPUCount != 2 {
+		t.Errorf("expected 2 vCPUs but got %d", opts.FcCPUCount)
+	}
+
+	var metadata struct {
+		Foo string `json:"foo"`
+		OCI struct {
+			Process  ociProcess `json:"process"`
+			Hostname string     `json:"hostname"`
+		} `json:"oci"`
+	}
+	if err := json.Unmarshal([]byte(opts.FcMetadata), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Foo != "bar" || metadata.OCI.Process.Cwd != "/work" ||
+		metadata.OCI.Process.User.UID != 1000 || metadata.OCI.Hostname != "bundle" {
+		t.Errorf("unexpected metadata %s", opts.FcMetadata)
+	}
+}
+
+func TestApplyOCIBundleErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		spec   string
+		opts   options
+		outErr error
+	}{
+		{
+			name:   "no process",
+			spec:   `{"root": {"path": "rootfs"}}`,
+			outErr: errOCIProcessArgs,
+		},
+		{
+			name:   "no root",
+			spec:   `{"process": {"args": ["/init"]}}`,
+			outErr: errInvalidOCISpec,
+		},
+		{
+			name:   "invalid json",
+			spec:   `{"process":`,
+			outErr: errInvalidOCISpec,
+		},
+		{
+			name:   "root drive",
+			spec:   `{"process": {"args": ["/init"]}, "root": {"path": "rootfs"}}`,
+			opts:   options{FcRootDrivePath: "rootfs.ext4"},
+			outErr: errOCIRootConflict,
+		},
+		{
+			name:   "quoted argument",
+			spec:   `{"process": {"args": ["/init", "\"quoted\""]}, "root": {"path": "rootfs"}}`,
+			outErr: errInvalidKernelParam,
+		},
+		{
+			name:   "command not in rootfs",
+			spec:   `{"process": {"args": ["sh"]}, "root": {"path": "rootfs"}}`,
+			outErr: errOCIProcessNotFound,
+		},
+		{
+			name:   "user without tap device",
+			spec:   `{"process": {"args": ["/init"], "user": {"uid": 1000}}, "root": {"path": "rootfs"}}`,
+			outErr: errOCIProcessNeedsMMDS,
+		},
+		{
+			name:   "working directory without tap device",
+			spec:   `{"process": {"args": ["/init"], "cwd": "/work"}, "root": {"path": "rootfs"}}`,
+			outErr: errOCIProcessNeedsMMDS,
+		},
+		{
+			name:   "invalid cpus",
+			spec:   `{"process": {"args": ["/init"]}, "root": {"path": "rootfs"}, "linux": {"resources": {"cpu": {"cpus": "3-1"}}}}`,
+			outErr: errInvalidOCISpec,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, ociConfigFile), []byte(c.spec), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c.opts.ociBundle = dir
+			err := c.opts.applyOCIBundle()
+			if !errors.Is(err, c.outErr) {
+				t.Errorf("expected %v but got %v", c.outErr, err)
+			}
+			if code := exitCode(err, false); code != exitConfigError {
+				t.Errorf("expected exit code %d but got %d", exitConfigError, code)
+			}
+		})
+	}
+}
+
+func TestOCILookPath(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"usr/bin", "opt/app/bin", "work"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, mode := range map[string]os.FileMode{"usr/bin/sh": 0755, "usr/bin/data": 0644, "opt/app/bin/app": 0755} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// merged /usr, and a link escaping the rootfs which the guest resolves
+	// within it
+	if err := os.Symlink("usr/bin", filepath.Join(root, "bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/../../opt/app/bin", filepath.Join(root, "work", "bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		process ociProcess
+		out     string
+		outErr  error
+	}{
+		{name: "absolute", process: ociProcess{Args: []string{"/missing"}}, out: "/missing"},
+		{name: "relative to cwd", process: ociProcess{Args: []string{"./run"}, Cwd: "/work"}, out: "/work/run"},
+		{name: "default path", process: ociProcess{Args: []string{"sh"}}, out: "/usr/bin/sh"},
+		{name: "path of the env", process: ociProcess{Args: []string{"sh"}, Env: []string{"PATH=/bin"}}, out: "/bin/sh"},
+		{name: "relative path entry", process: ociProcess{Args: []string{"app"}, Env: []string{"PATH=bin"}, Cwd: "/work"}, out: "/work/bin/app"},
+		{name: "not executable", process: ociProcess{Args: []string{"data"}}, outErr: errOCIProcessNotFound},
+		{name: "not found", process: ociProcess{Args: []string{"app"}}, outErr: errOCIProcessNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			command, err := c.process.lookPath(root)
+			if !errors.Is(err, c.outErr) {
+				t.Fatalf("expected %v but got %v", c.outErr, err)
+			}
+			if command != c.out {
+				t.Errorf("expected %s but got %s", c.out, command)
+			}
+		})
+	}
+}
+
+func TestCountCPUs(t *testing.T) {
+	cases := []struct {
+		in    string
+		out   int64
+		isErr bool
+	}{
+		{in: "0", out: 1},
+		{in: "0-3", out: 4},
+		{in: "0-3,6,8-9", out: 7},
+		{in: "3-1", isErr: true},
+		{in: "a", isErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			count, err := countCPUs(c.in)
+			if count != c.out || (err != nil) != c.isErr {
+				t.Errorf("expected %d but got %d, %v", c.out, count, err)
+			}
+		})
+	}
+}
+
+func TestApplyOCIBundleSMT(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("SMT only constrains the vCPU count on x86_64")
+	}
+	dir := t.TempDir()
+	spec := `{"process": {"args": ["/init"]}, "root": {"path": "rootfs"}, "linux": {"resources": {"cpu": {"cpus": "0-2"}}}}`
+	if err := os.WriteFile(filepath.Join(dir, ociConfigFile), []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{ociBundle: dir}
+	if err := opts.applyOCIBundle(); err != nil {
+		t.Fatal(err)
+	}
+	if opts.FcCPUCount != 4 {
+		t.Errorf("expected 3 CPUs to be rounded up to 4 vCPUs but got %d", opts.FcCPUCount)
+	}
+}
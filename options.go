@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
@@ -31,17 +32,35 @@ import (
 func newOptions() *options {
 	return &options{
 		createFifoFileLogs: createFifoFileLogs,
+		stdin:              os.Stdin,
+		stdout:             os.Stdout,
+		stderr:             os.Stderr,
 	}
 }
 
 type options struct {
 	FcBinary           string   `long:"firecracker-binary" description:"Path to firecracker binary"`
+	FirecrackerSHA256  string   `long:"firecracker-sha256" description:"Expected SHA-256 digest of the firecracker binary, or of the exec file with the jailer"`
+	Manifest           string   `long:"manifest" description:"File of expected SHA-256 digests in the format of sha256sum, checked for the kernel, initrd, drives and binaries it lists"`
 	FcKernelImage      string   `long:"kernel" description:"Path to the kernel image" default:"./vmlinux"`
+	ExtractKernel      bool     `long:"extract-kernel" description:"Boot the vmlinux extracted from a bzImage kernel, the extracted kernel is kept in the artifact cache"`
+	KernelSHA256       string   `long:"kernel-sha256" description:"Expected SHA-256 digest of the kernel image"`
 	FcKernelCmdLine    string   `long:"kernel-opts" description:"Kernel commandline" default:"ro console=ttyS0 noapic reboot=k panic=1 pci=off nomodules"`
 	FcInitrd           string   `long:"initrd-path" description:"Path to initrd"`
-	FcRootDrivePath    string   `long:"root-drive" description:"Path to root disk image"`
+	InitrdSHA256       string   `long:"initrd-sha256" description:"Expected SHA-256 digest of the initrd"`
+	InitrdFromDir      string   `long:"initrd-from-dir" description:"Build the initrd from the given directory"`
+	InitrdAdd          []string `long:"initrd-add" description:"Add a file or directory to the built initrd, specified as HOST:GUEST, can be specified multiple times"`
+	InitrdCompress     bool     `long:"initrd-compress" description:"Compress the built initrd with gzip"`
+	FcRootDrivePath    string   `long:"root-drive" description:"Path to root disk image, optionally suffixed with :ro or :rw and :sha256=HEX to pin its digest"`
+	RootDriveCOW       bool     `long:"root-drive-cow" description:"Boot from a copy-on-write clone of the root drive, removed on exit"`
+	KeepDisk           bool     `long:"keep-disk" description:"Keep the clone of the root drive made with root-drive-cow on exit"`
+	RootFromDir        string   `long:"root-from-dir" description:"Build an ext4 root drive from the given directory, removed on exit"`
+	RootFromTar        string   `long:"root-from-tar" description:"Build an ext4 root drive from the given tarball, removed on exit"`
+	RootSize           string   `long:"root-size" description:"Size of the root drive built with root-from-dir or root-from-tar, such as 2G"`
 	FcRootPartUUID     string   `long:"root-partition" description:"Root partition UUID"`
-	FcAdditionalDrives []string `long:"add-drive" description:"Path to additional drive, suffixed with :ro or :rw, can be specified multiple times"`
+	FcAdditionalDrives []string `long:"add-drive" description:"Path to additional drive, suffixed with :ro or :rw, optionally :root to boot from it and :sha256=HEX to pin its digest, can be specified multiple times"`
+	ScratchDisks       []string `long:"scratch-disk" description:"Create a read-write drive removed on exit, specified as size=SIZE[,fs=ext4][,label=LABEL], can be specified multiple times"`
+	Shares             []string `long:"share" description:"Share a host directory with the guest through a generated drive, specified as HOST:GUEST optionally suffixed with :ro or :rw, can be specified multiple times"`
 	FcNicConfig        []string `long:"tap-device" description:"NIC info, specified as DEVICE/MAC, can be specified multiple times"`
 	FcVsockDevices     []string `long:"vsock-device" description:"Vsock interface, specified as PATH:CID. Multiple OK"`
 	FcLogFifo          string   `long:"vmm-log-fifo" description:"FIFO for firecracker logs"`
@@ -52,26 +71,81 @@ type options struct {
 	FcCPUTemplate      string   `long:"cpu-template" description:"Firecracker CPU Template (C3 or T2)"`
 	FcMemSz            int64    `long:"memory" short:"m" description:"VM memory, in MiB" default:"512"`
 	FcMetadata         string   `long:"metadata" description:"Firecracker Metadata for MMDS (json)"`
+	MmdsVersion        string   `long:"mmds-version" description:"MMDS version" choice:"V1" choice:"V2"`
+	IoEngine           string   `long:"io-engine" description:"Block device IO engine, Async uses io_uring" choice:"Sync" choice:"Async"`
+	EntropyDevice      bool     `long:"entropy-device" description:"Add a virtio-rng entropy device to the guest"`
+	SerialOut          string   `long:"serial-out" description:"Make firecracker write the guest serial console to the given file"`
+	SkipVersionCheck   bool     `long:"skip-version-check" description:"Do not check the version of the firecracker binary and the features it supports"`
+	AllowUnsupported   bool     `long:"allow-unsupported" description:"Run a firecracker version outside of the supported range with a warning"`
 	FcFifoLogFile      string   `long:"firecracker-log" short:"l" description:"pipes the fifo contents to the specified file"`
 	FcSocketPath       string   `long:"socket-path" short:"s" description:"path to use for firecracker socket, defaults to a unique file in in the first existing directory from {$HOME, $TMPDIR, or /tmp}"`
 	Debug              bool     `long:"debug" short:"d" description:"Enable debug output"`
 	Version            bool     `long:"version" description:"Outputs the version of the application"`
+	Interactive        bool     `long:"interactive" description:"Put the terminal in raw mode and forward all input to the guest console"`
+	EscapeChar         string   `long:"escape-char" description:"Escape character of the interactive console, specified as ^X" default:"^]"`
 
-	Id           string `long:"id" description:"Jailer VMM id"`
-	ExecFile     string `long:"exec-file" description:"Jailer executable"`
+	ConsoleLog           string `long:"console-log" description:"Path to a file the guest console output is written to"`
+	ConsoleLogTimestamps bool   `long:"console-log-timestamps" description:"Prefix each line of the console log with a timestamp"`
+	ConsoleLogMaxSize    int64  `long:"console-log-max-size" description:"Rotate the console log once it grows beyond the given size, in MiB. 0 disables rotation"`
+	ConsoleLogMaxFiles   int    `long:"console-log-max-files" description:"Number of rotated console logs to keep" default:"5"`
+	ConsoleLogOnly       bool   `long:"console-log-only" description:"Only write the guest console output to the console log, not to stdout"`
+
+	Record      string `long:"record" description:"Record the guest console session to the given file in asciicast v2 format"`
+	RecordInput bool   `long:"record-input" description:"Also record the keystrokes sent to the guest console"`
+
+	Script           string `long:"script" description:"Drive the guest console with the given expect-style script, then shut the VM down"`
+	ScriptCaptureDir string `long:"script-capture-dir" description:"Directory the output captured by the script is written to, as NAME.txt"`
+
+	ExitReport  string `long:"exit-report" description:"Write a JSON report describing how the VM exited to the given file"`
+	WriteLock   string `long:"write-lock" description:"After a successful run, write a lockfile recording the firecracker version, the digests of the artifacts and the configuration of the microVM"`
+	Lock        string `long:"lock" description:"Refuse to start unless the microVM is the one recorded in the given lockfile, which fills in the options not given"`
+	CacheDir    string `long:"cache-dir" description:"Directory of the artifact cache, defaults to $XDG_CACHE_HOME/firectl or ~/.cache/firectl"`
+	ErrorFormat string `long:"error-format" description:"Format of the error printed when firectl fails" choice:"text" choice:"json" default:"text"`
+
+	Id           string `long:"id" description:"Jailer VMM id, generated when not given"`
+	ExecFile     string `long:"exec-file" description:"Jailer executable, defaults to the firecracker binary"`
 	JailerBinary string `long:"jailer" description:"Jailer binary"`
+	JailerSHA256 string `long:"jailer-sha256" description:"Expected SHA-256 digest of the jailer binary"`
 
-	Uid      int `long:"uid" description:"Jailer uid for dropping privileges"`
-	Gid      int `long:"gid" description:"Jailer gid for dropping privileges"`
-	NumaNode int `long:"node" description:"Jailer numa node"`
+	Uid           int  `long:"uid" description:"Jailer uid for dropping privileges"`
+	Gid           int  `long:"gid" description:"Jailer gid for dropping privileges"`
+	AllowRootJail bool `long:"allow-root-jail" description:"Allow the jailer to run firecracker as uid 0"`
+	NumaNode      int  `long:"node" description:"Jailer numa node"`
 
 	ChrootBaseDir string `long:"chroot-base-dir" description:"Jailer chroot base directory"`
 	Daemonize     bool   `long:"daemonize" description:"Run jailer as daemon"`
 
+	Cgroups        []string `long:"cgroup" description:"Jailer cgroup setting, specified as FILE=VALUE such as cpu.max=50000, can be specified multiple times"`
+	CgroupVersion  string   `long:"cgroup-version" description:"Jailer cgroup version" choice:"1" choice:"2"`
+	ParentCgroup   string   `long:"parent-cgroup" description:"Jailer parent cgroup the cgroup of the microVM is created in"`
+	NetNS          string   `long:"netns" description:"Path to the network namespace the microVM is run in, such as /var/run/netns/NAME"`
+	ResourceLimits []string `long:"resource-limit" description:"Jailer resource limit, specified as fsize=N or no-file=N separated by commas, can be specified multiple times"`
+	NewPidNS       bool     `long:"new-pid-ns" description:"Run the jailer in a new PID namespace"`
+
 	closers       []func() error
 	validMetadata interface{}
+	// createdFiles are the drives and initrds firectl created for the
+	// microVM, which it may chown into the jail
+	createdFiles map[string]bool
+
+	// ociBundle is the bundle given to the oci run command
+	ociBundle string
+	// optionGiven reports whether the option with the given long name was
+	// given on the command line, rather than defaulted
+	optionGiven func(name string) bool
+	// digests are the digests of the artifacts hashed by verifyDigests, by
+	// absolute path
+	digests map[string]string
 
 	createFifoFileLogs func(fifoPath string) (*os.File, error)
+
+	// stdio of the firecracker or jailer process
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	// consoleWatchers are written the guest console output wherever it is
+	// written to, even when it is only written to the console log
+	consoleWatchers []io.Writer
 }
 
 // Converts options to a usable firecracker config
@@ -79,7 +153,8 @@ func (opts *options) getFirecrackerConfig() (firecracker.Config, error) {
 	// validate metadata json
 	if opts.FcMetadata != "" {
 		if err := json.Unmarshal([]byte(opts.FcMetadata), &opts.validMetadata); err != nil {
-			return firecracker.Config{}, fmt.Errorf("%s: %v", errInvalidMetadata.Error(), err)
+			return firecracker.Config{}, newConfigError("metadata", opts.FcMetadata,
+				fmt.Errorf("%w: %w", errInvalidMetadata, err))
 		}
 	}
 	//setup NICs
@@ -105,12 +180,28 @@ func (opts *options) getFirecrackerConfig() (firecracker.Config, error) {
 		return firecracker.Config{}, err
 	}
 
+	// console log
+	if err := opts.handleConsoleLog(); err != nil {
+		return firecracker.Config{}, err
+	}
+
+	// console recording
+	if err := opts.handleRecording(); err != nil {
+		return firecracker.Config{}, err
+	}
+	opts.watchConsole()
+
 	var (
 		socketPath string
 		jail       *firecracker.JailerConfig
 	)
 
 	if opts.JailerBinary != "" {
+		strategy := &jailChrootStrategy{
+			parentCgroup: opts.ParentCgroup,
+			daemonize:    opts.Daemonize,
+			createdFiles: opts.createdFiles,
+		}
 		jail = &firecracker.JailerConfig{
 			GID:            firecracker.Int(opts.Gid),
 			UID:            firecracker.Int(opts.Uid),
@@ -120,11 +211,15 @@ func (opts *options) getFirecrackerConfig() (firecracker.Config, error) {
 			JailerBinary:   opts.JailerBinary,
 			ChrootBaseDir:  opts.ChrootBaseDir,
 			Daemonize:      opts.Daemonize,
-			ChrootStrategy: firecracker.NewNaiveChrootStrategy(opts.FcKernelImage),
-			Stdout:         os.Stdout,
-			Stderr:         os.Stderr,
-			Stdin:          os.Stdin,
+			CgroupVersion:  opts.CgroupVersion,
+			ChrootStrategy: strategy,
+			Stdout:         opts.stdout,
+			Stderr:         opts.stderr,
+			Stdin:          opts.stdin,
 		}
+		// the jail holds the links to the files of the microVM, it is
+		// removed once firecracker has exited
+		opts.addCloser(strategy.removeJail)
 	} else {
 
 		// if no jail is active, either use the path from the arguments
@@ -148,6 +243,7 @@ func (opts *options) getFirecrackerConfig() (firecracker.Config, error) {
 		Drives:            blockDevices,
 		NetworkInterfaces: NICs,
 		VsockDevices:      vsocks,
+		MmdsVersion:       firecracker.MMDSVersion(opts.MmdsVersion),
 		MachineCfg: models.MachineConfiguration{
 			VcpuCount:   firecracker.Int64(opts.FcCPUCount),
 			CPUTemplate: models.CPUTemplate(opts.FcCPUTemplate),
@@ -155,6 +251,7 @@ func (opts *options) getFirecrackerConfig() (firecracker.Config, error) {
 			MemSizeMib:  firecracker.Int64(opts.FcMemSz),
 		},
 		JailerCfg: jail,
+		NetNS:     opts.NetNS,
 		VMID:      opts.Id,
 	}, nil
 }
@@ -188,15 +285,30 @@ func (opts *options) getBlockDevices() ([]models.Drive, error) {
 		return nil, err
 	}
 
-	rootDrivePath, readOnly := parseDevice(opts.FcRootDrivePath)
-	rootDrive := models.Drive{
-		DriveID:      firecracker.String("1"),
-		PathOnHost:   firecracker.String(rootDrivePath),
-		IsReadOnly:   firecracker.Bool(readOnly),
-		IsRootDevice: firecracker.Bool(true),
-		Partuuid:     opts.FcRootPartUUID,
+	if opts.FcRootDrivePath != "" {
+		for _, drive := range blockDevices {
+			if firecracker.BoolValue(drive.IsRootDevice) {
+				return nil, newConfigError("root-drive", opts.FcRootDrivePath, errMultipleRootDrives)
+			}
+		}
+		rootDrivePath, readOnly := parseDevice(opts.FcRootDrivePath)
+		rootDrive := models.Drive{
+			DriveID:      firecracker.String("1"),
+			PathOnHost:   firecracker.String(rootDrivePath),
+			IsReadOnly:   firecracker.Bool(readOnly),
+			IsRootDevice: firecracker.Bool(true),
+		}
+		blockDevices = append(blockDevices, rootDrive)
+	}
+
+	for i := range blockDevices {
+		if firecracker.BoolValue(blockDevices[i].IsRootDevice) {
+			blockDevices[i].Partuuid = opts.FcRootPartUUID
+		}
+		if opts.IoEngine != "" {
+			blockDevices[i].IoEngine = firecracker.String(opts.IoEngine)
+		}
 	}
-	blockDevices = append(blockDevices, rootDrive)
 	return blockDevices, nil
 }
 
@@ -214,7 +326,7 @@ func (opts *options) handleFifos() (io.Writer, error) {
 
 	if len(opts.FcFifoLogFile) > 0 {
 		if len(opts.FcLogFifo) > 0 {
-			return nil, errConflictingLogOpts
+			return nil, newConfigError("firecracker-log", opts.FcFifoLogFile, errConflictingLogOpts)
 		}
 		generateFifoFilename = true
 		// if a fifo log file was specified via the CLI then we need to check if
@@ -223,7 +335,8 @@ func (opts *options) handleFifos() (io.Writer, error) {
 			generateMetricFifoFilename = true
 		}
 		if fifo, err = opts.createFifoFileLogs(opts.FcFifoLogFile); err != nil {
-			return nil, fmt.Errorf("%s: %v", errUnableToCreateFifoLogFile.Error(), err)
+			return nil, newConfigError("firecracker-log", opts.FcFifoLogFile,
+				fmt.Errorf("%w: %w", errUnableToCreateFifoLogFile, err))
 		}
 		opts.addCloser(func() error {
 			return fifo.Close()
@@ -245,7 +358,7 @@ func (opts *options) handleFifos() (io.Writer, error) {
 	if generateFifoFilename || generateMetricFifoFilename {
 		dir, err := os.MkdirTemp(os.TempDir(), "fcfifo")
 		if err != nil {
-			return fifo, fmt.Errorf("fail to create temporary directory: %v", err)
+			return fifo, fmt.Errorf("fail to create temporary directory: %w", err)
 		}
 		opts.addCloser(func() error {
 			return os.RemoveAll(dir)
@@ -262,10 +375,136 @@ func (opts *options) handleFifos() (io.Writer, error) {
 	return fifo, nil
 }
 
+// captureFirecrackerLog tees the firecracker log to the given writers. Unless
+// logging was configured, the log is captured to a generated fifo and still
+// written to stderr. A --vmm-log-fifo is read by the user, not by firectl,
+// and is left alone.
+func (opts *options) captureFirecrackerLog(cfg *firecracker.Config, writers ...io.Writer) error {
+	if cfg.LogFifo == "" {
+		dir, err := os.MkdirTemp(os.TempDir(), "fcfifo")
+		if err != nil {
+			return fmt.Errorf("fail to create temporary directory: %w", err)
+		}
+		opts.addCloser(func() error {
+			return os.RemoveAll(dir)
+		})
+		cfg.LogFifo = filepath.Join(dir, "fc_fifo")
+		cfg.FifoLogWriter = opts.stderr
+	}
+	if cfg.FifoLogWriter != nil {
+		cfg.FifoLogWriter = io.MultiWriter(append([]io.Writer{cfg.FifoLogWriter}, writers...)...)
+	}
+	return nil
+}
+
+// handleConsoleLog sets up the capture of the guest console output to the
+// console log, if one was specified.
+func (opts *options) handleConsoleLog() error {
+	if len(opts.ConsoleLog) == 0 {
+		if opts.ConsoleLogOnly {
+			return newConfigError("console-log-only", "", errConsoleLogOnlyWithoutLog)
+		}
+		return nil
+	}
+
+	if opts.ConsoleLogMaxSize < 0 {
+		return newConfigError("console-log-max-size", strconv.FormatInt(opts.ConsoleLogMaxSize, 10),
+			errInvalidConsoleLogRotation)
+	}
+	if opts.ConsoleLogMaxFiles < 0 {
+		return newConfigError("console-log-max-files", strconv.Itoa(opts.ConsoleLogMaxFiles),
+			errInvalidConsoleLogRotation)
+	}
+
+	consoleLog, err := newConsoleLog(
+		opts.ConsoleLog,
+		opts.ConsoleLogMaxSize*1024*1024,
+		opts.ConsoleLogMaxFiles,
+		opts.ConsoleLogTimestamps,
+	)
+	if err != nil {
+		return newConfigError("console-log", opts.ConsoleLog,
+			fmt.Errorf("%w: %w", errUnableToCreateConsoleLog, err))
+	}
+	opts.addCloser(consoleLog.Close)
+
+	if opts.ConsoleLogOnly || opts.stdout == nil {
+		opts.stdout = consoleLog
+	} else {
+		opts.stdout = io.MultiWriter(opts.stdout, consoleLog)
+	}
+	return nil
+}
+
+// handleRecording sets up the recording of the console session, if one was
+// requested.
+func (opts *options) handleRecording() error {
+	if len(opts.Record) == 0 {
+		if opts.RecordInput {
+			return newConfigError("record-input", "", errRecordInputWithoutRecord)
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(opts.Record, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return newConfigError("record", opts.Record,
+			fmt.Errorf("%w: %w", errUnableToCreateRecording, err))
+	}
+	width, height := terminalSize(os.Stdout)
+	rec, err := newRecorder(f, width, height, time.Now)
+	if err != nil {
+		f.Close()
+		return newConfigError("record", opts.Record,
+			fmt.Errorf("%w: %w", errUnableToCreateRecording, err))
+	}
+	opts.addCloser(rec.Close)
+
+	if opts.stdout == nil {
+		opts.stdout = rec.output()
+	} else {
+		opts.stdout = io.MultiWriter(opts.stdout, rec.output())
+	}
+
+	if opts.RecordInput && opts.stdin != nil {
+		stdin, err := teeInput(opts.stdin, rec.input())
+		if err != nil {
+			return newConfigError("record", opts.Record,
+				fmt.Errorf("%w: %w", errUnableToCreateRecording, err))
+		}
+		opts.stdin = stdin
+	}
+	return nil
+}
+
+// watchConsole adds the console watchers to the outputs of the guest console,
+// once the console log and the recording were set up
+func (opts *options) watchConsole() {
+	if len(opts.consoleWatchers) == 0 {
+		return
+	}
+	writers := opts.consoleWatchers
+	if opts.stdout != nil {
+		writers = append([]io.Writer{opts.stdout}, writers...)
+	}
+	opts.stdout = io.MultiWriter(writers...)
+}
+
 func (opts *options) addCloser(c func() error) {
 	opts.closers = append(opts.closers, c)
 }
 
+// addCreatedFile records that firectl created the file at path for the
+// microVM
+func (opts *options) addCreatedFile(path string) {
+	if opts.createdFiles == nil {
+		opts.createdFiles = map[string]bool{}
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		opts.createdFiles[abs] = true
+	}
+}
+
 func (opts *options) Close() {
 	for _, closer := range opts.closers {
 		err := closer()
@@ -276,12 +515,20 @@ func (opts *options) Close() {
 }
 
 const (
-	rwDeviceSuffix = ":rw"
-	roDeviceSuffix = ":ro"
+	rwDeviceSuffix   = ":rw"
+	roDeviceSuffix   = ":ro"
+	rootDeviceSuffix = ":root"
+)
+
+// block device IO engines
+const (
+	ioEngineSync  = "Sync"
+	ioEngineAsync = "Async"
 )
 
 // Given a string in the form of path:suffix return the path and read-only marker
 func parseDevice(entry string) (path string, readOnly bool) {
+	entry, _ = splitDigest(entry)
 	if strings.HasSuffix(entry, roDeviceSuffix) {
 		return strings.TrimSuffix(entry, roDeviceSuffix), true
 	}
@@ -289,29 +536,51 @@ func parseDevice(entry string) (path string, readOnly bool) {
 	return strings.TrimSuffix(entry, rwDeviceSuffix), false
 }
 
+// parseDriveEntry parses an additional drive of the form PATH:ro or PATH:rw,
+// optionally followed by :root to boot from the drive and by :sha256=HEX to
+// pin its digest.
+func parseDriveEntry(entry string) (path string, readOnly, isRoot bool, err error) {
+	spec, _ := splitDigest(entry)
+	if strings.HasSuffix(spec, rootDeviceSuffix) {
+		isRoot = true
+		spec = strings.TrimSuffix(spec, rootDeviceSuffix)
+	}
+
+	if strings.HasSuffix(spec, rwDeviceSuffix) {
+		path = strings.TrimSuffix(spec, rwDeviceSuffix)
+	} else if strings.HasSuffix(spec, roDeviceSuffix) {
+		readOnly = true
+		path = strings.TrimSuffix(spec, roDeviceSuffix)
+	} else {
+		return "", false, false, newConfigError("add-drive", entry, errInvalidDriveSpecificationNoSuffix)
+	}
+
+	if path == "" {
+		return "", false, false, newConfigError("add-drive", entry, errInvalidDriveSpecificationNoPath)
+	}
+	return path, readOnly, isRoot, nil
+}
+
 // given a []string in the form of path:suffix converts to []models.Drive
 func parseBlockDevices(entries []string) ([]models.Drive, error) {
 	devices := []models.Drive{}
+	hasRoot := false
 
 	for i, entry := range entries {
-		path := ""
-		readOnly := true
-
-		if strings.HasSuffix(entry, rwDeviceSuffix) {
-			readOnly = false
-			path = strings.TrimSuffix(entry, rwDeviceSuffix)
-		} else if strings.HasSuffix(entry, roDeviceSuffix) {
-			path = strings.TrimSuffix(entry, roDeviceSuffix)
-		} else {
-			return nil, errInvalidDriveSpecificationNoSuffix
+		path, readOnly, isRoot, err := parseDriveEntry(entry)
+		if err != nil {
+			return nil, err
 		}
 
-		if path == "" {
-			return nil, errInvalidDriveSpecificationNoPath
+		if _, err := os.Stat(path); err != nil {
+			return nil, newConfigError("add-drive", entry, err)
 		}
 
-		if _, err := os.Stat(path); err != nil {
-			return nil, err
+		if isRoot {
+			if hasRoot {
+				return nil, newConfigError("add-drive", entry, errMultipleRootDrives)
+			}
+			hasRoot = true
 		}
 
 		e := models.Drive{
@@ -319,7 +588,7 @@ func parseBlockDevices(entries []string) ([]models.Drive, error) {
 			DriveID:      firecracker.String(strconv.Itoa(i + 2)),
 			PathOnHost:   firecracker.String(path),
 			IsReadOnly:   firecracker.Bool(readOnly),
-			IsRootDevice: firecracker.Bool(false),
+			IsRootDevice: firecracker.Bool(isRoot),
 		}
 		devices = append(devices, e)
 	}
@@ -330,7 +599,7 @@ func parseBlockDevices(entries []string) ([]models.Drive, error) {
 func parseNicConfig(cfg string) (string, string, error) {
 	fields := strings.Split(cfg, "/")
 	if len(fields) != 2 || len(fields[0]) == 0 || len(fields[1]) == 0 {
-		return "", "", errInvalidNicConfig
+		return "", "", newConfigError("tap-device", cfg, errInvalidNicConfig)
 	}
 	return fields[0], fields[1], nil
 }
@@ -342,11 +611,11 @@ func parseVsocks(devices []string) ([]firecracker.VsockDevice, error) {
 	for _, entry := range devices {
 		fields := strings.Split(entry, ":")
 		if len(fields) != 2 || len(fields[0]) == 0 || len(fields[1]) == 0 {
-			return []firecracker.VsockDevice{}, errUnableToParseVsockDevices
+			return []firecracker.VsockDevice{}, newConfigError("vsock-device", entry, errUnableToParseVsockDevices)
 		}
 		CID, err := strconv.ParseUint(fields[1], 10, 32)
 		if err != nil {
-			return []firecracker.VsockDevice{}, errUnableToParseVsockCID
+			return []firecracker.VsockDevice{}, newConfigError("vsock-device", entry, errUnableToParseVsockCID)
 		}
 		dev := firecracker.VsockDevice{
 			Path: fields[0],
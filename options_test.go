@@ -14,7 +14,12 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -44,7 +49,7 @@ func TestGetFirecrackerConfig(t *testing.T) {
 				FcMetadata: "{ invalid:json",
 			},
 			expectedErr: func(e error) (bool, error) {
-				return strings.HasPrefix(e.Error(), errInvalidMetadata.Error()), errInvalidMetadata
+				return errors.Is(e, errInvalidMetadata), errInvalidMetadata
 			},
 			outConfig: firecracker.Config{},
 		},
@@ -54,7 +59,7 @@ func TestGetFirecrackerConfig(t *testing.T) {
 				FcNicConfig: []string{"no-slash"},
 			},
 			expectedErr: func(e error) (bool, error) {
-				return e == errInvalidNicConfig, errInvalidNicConfig
+				return errors.Is(e, errInvalidNicConfig), errInvalidNicConfig
 			},
 			outConfig: firecracker.Config{},
 		},
@@ -65,7 +70,7 @@ func TestGetFirecrackerConfig(t *testing.T) {
 				FcAdditionalDrives: []string{"/no-suffix"},
 			},
 			expectedErr: func(e error) (bool, error) {
-				return e == errInvalidDriveSpecificationNoSuffix, errInvalidDriveSpecificationNoSuffix
+				return errors.Is(e, errInvalidDriveSpecificationNoSuffix), errInvalidDriveSpecificationNoSuffix
 			},
 			outConfig: firecracker.Config{},
 		},
@@ -77,7 +82,7 @@ func TestGetFirecrackerConfig(t *testing.T) {
 				FcVsockDevices:     []string{"noCID"},
 			},
 			expectedErr: func(e error) (bool, error) {
-				return e == errUnableToParseVsockDevices, errUnableToParseVsockDevices
+				return errors.Is(e, errUnableToParseVsockDevices), errUnableToParseVsockDevices
 			},
 			outConfig: firecracker.Config{},
 		},
@@ -93,7 +98,7 @@ func TestGetFirecrackerConfig(t *testing.T) {
 				},
 			},
 			expectedErr: func(e error) (bool, error) {
-				return e != nil && strings.HasPrefix(e.Error(), errUnableToCreateFifoLogFile.Error()),
+				return errors.Is(e, errUnableToCreateFifoLogFile),
 					errUnableToCreateFifoLogFile
 			},
 			outConfig: firecracker.Config{},
@@ -108,14 +113,7 @@ func TestGetFirecrackerConfig(t *testing.T) {
 			},
 			outConfig: firecracker.Config{
 				SocketPath: "/some/path/here",
-				Drives: []models.Drive{
-					{
-						DriveID:      firecracker.String("1"),
-						PathOnHost:   firecracker.String(""),
-						IsRootDevice: firecracker.Bool(true),
-						IsReadOnly:   firecracker.Bool(false),
-					},
-				},
+				Drives:     []models.Drive{},
 				MachineCfg: models.MachineConfiguration{
 					VcpuCount:  firecracker.Int64(0),
 					MemSizeMib: firecracker.Int64(0),
@@ -133,14 +131,7 @@ func TestGetFirecrackerConfig(t *testing.T) {
 			},
 			outConfig: firecracker.Config{
 				SocketPath: "valid/path",
-				Drives: []models.Drive{
-					{
-						DriveID:      firecracker.String("1"),
-						PathOnHost:   firecracker.String(""),
-						IsRootDevice: firecracker.Bool(true),
-						IsReadOnly:   firecracker.Bool(false),
-					},
-				},
+				Drives:     []models.Drive{},
 				MachineCfg: models.MachineConfiguration{
 					VcpuCount:  firecracker.Int64(0),
 					MemSizeMib: firecracker.Int64(0),
@@ -233,7 +224,7 @@ func TestParseBlockDevices(t *testing.T) {
 			in:        []string{"/path"},
 			outDrives: nil,
 			expectedErr: func(a error) bool {
-				return a == errInvalidDriveSpecificationNoSuffix
+				return errors.Is(a, errInvalidDriveSpecificationNoSuffix)
 			},
 		},
 		{
@@ -241,14 +232,16 @@ func TestParseBlockDevices(t *testing.T) {
 			in:        []string{rwDeviceSuffix},
 			outDrives: nil,
 			expectedErr: func(a error) bool {
-				return a == errInvalidDriveSpecificationNoPath
+				return errors.Is(a, errInvalidDriveSpecificationNoPath)
 			},
 		},
 		{
-			name:        "non-existant drive path",
-			in:          []string{"/does/not/exist" + roDeviceSuffix},
-			outDrives:   nil,
-			expectedErr: os.IsNotExist,
+			name:      "non-existant drive path",
+			in:        []string{"/does/not/exist" + roDeviceSuffix},
+			outDrives: nil,
+			expectedErr: func(a error) bool {
+				return errors.Is(a, fs.ErrNotExist)
+			},
 		},
 		{
 			name:      "valid drive path + suffix",
@@ -330,7 +323,7 @@ func TestParseNicConfig(t *testing.T) {
 					macaddr,
 					c.in)
 			}
-			if err != c.outError {
+			if !errors.Is(err, c.outError) {
 				t.Errorf("expected error %s but got %s for input %s",
 					c.outError,
 					err,
@@ -365,7 +358,7 @@ func TestParseVsocks(t *testing.T) {
 			in:         []string{"a3:"},
 			outDevices: []firecracker.VsockDevice{},
 			expectedErr: func(a error) bool {
-				return a == errUnableToParseVsockDevices
+				return errors.Is(a, errUnableToParseVsockDevices)
 			},
 		},
 		{
@@ -373,7 +366,7 @@ func TestParseVsocks(t *testing.T) {
 			in:         []string{""},
 			outDevices: []firecracker.VsockDevice{},
 			expectedErr: func(a error) bool {
-				return a == errUnableToParseVsockDevices
+				return errors.Is(a, errUnableToParseVsockDevices)
 			},
 		},
 		{
@@ -381,7 +374,7 @@ func TestParseVsocks(t *testing.T) {
 			in:         []string{"a:b"},
 			outDevices: []firecracker.VsockDevice{},
 			expectedErr: func(a error) bool {
-				return a == errUnableToParseVsockCID
+				return errors.Is(a, errUnableToParseVsockCID)
 			},
 		},
 		{
@@ -389,7 +382,7 @@ func TestParseVsocks(t *testing.T) {
 			in:         []string{"ae"},
 			outDevices: []firecracker.VsockDevice{},
 			expectedErr: func(a error) bool {
-				return a == errUnableToParseVsockDevices
+				return errors.Is(a, errUnableToParseVsockDevices)
 			},
 		},
 	}
@@ -427,7 +420,7 @@ func TestHandleFifos(t *testing.T) {
 			},
 			outWriterNil: true,
 			expectedErr: func(e error) (bool, error) {
-				return e == errConflictingLogOpts, errConflictingLogOpts
+				return errors.Is(e, errConflictingLogOpts), errConflictingLogOpts
 			},
 			numClosers: 0,
 			validate:   validateTrue,
@@ -442,12 +435,7 @@ func TestHandleFifos(t *testing.T) {
 			},
 			outWriterNil: true,
 			expectedErr: func(a error) (bool, error) {
-				if a == nil {
-					return false,
-						errUnableToCreateFifoLogFile
-				}
-				return strings.HasPrefix(a.Error(),
-						errUnableToCreateFifoLogFile.Error()),
+				return errors.Is(a, errUnableToCreateFifoLogFile),
 					errUnableToCreateFifoLogFile
 			},
 			numClosers: 0,
@@ -524,6 +512,186 @@ func TestHandleFifos(t *testing.T) {
 	}
 }
 
+func TestCaptureFirecrackerLog(t *testing.T) {
+	const line = "Kernel panic - not syncing: oops\n"
+	var logFile bytes.Buffer
+	cases := []struct {
+		name       string
+		cfg        firecracker.Config
+		generated  bool
+		outStderr  string
+		outWatched string
+	}{
+		{
+			name:       "no logging configured",
+			generated:  true,
+			outStderr:  line,
+			outWatched: line,
+		},
+		{
+			name:       "firecracker-log",
+			cfg:        firecracker.Config{LogFifo: "fifo", FifoLogWriter: &logFile},
+			outWatched: line,
+		},
+		{
+			name: "vmm-log-fifo",
+			cfg:  firecracker.Config{LogFifo: "fifo"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var stderr, watched bytes.Buffer
+			opts := options{stderr: &stderr}
+			defer opts.Close()
+			if err := opts.captureFirecrackerLog(&c.cfg, &watched); err != nil {
+				t.Fatal(err)
+			}
+			if generated := c.cfg.LogFifo != "fifo"; generated != c.generated {
+				t.Errorf("expected a generated log fifo to be %v but log fifo was %q", c.generated, c.cfg.LogFifo)
+			}
+			if c.cfg.FifoLogWriter != nil {
+				io.WriteString(c.cfg.FifoLogWriter, line)
+			}
+			if stderr.String() != c.outStderr {
+				t.Errorf("expected %q on stderr but got %q", c.outStderr, stderr.String())
+			}
+			if watched.String() != c.outWatched {
+				t.Errorf("expected %q to be watched but got %q", c.outWatched, watched.String())
+			}
+		})
+	}
+	if logFile.String() != line {
+		t.Errorf("expected %q in the firecracker log but got %q", line, logFile.String())
+	}
+}
+
+func TestHandleConsoleLog(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		name        string
+		opt         options
+		expectedErr func(error) (bool, error)
+		numClosers  int
+		stdoutSet   bool
+	}{
+		{
+			name: "no console log",
+			opt:  options{},
+			expectedErr: func(e error) (bool, error) {
+				return e == nil, nil
+			},
+			numClosers: 0,
+			stdoutSet:  false,
+		},
+		{
+			name: "console-log-only without console log",
+			opt: options{
+				ConsoleLogOnly: true,
+			},
+			expectedErr: func(e error) (bool, error) {
+				return errors.Is(e, errConsoleLogOnlyWithoutLog), errConsoleLogOnlyWithoutLog
+			},
+			numClosers: 0,
+			stdoutSet:  false,
+		},
+		{
+			name: "negative rotation size",
+			opt: options{
+				ConsoleLog:        filepath.Join(dir, "negative.log"),
+				ConsoleLogMaxSize: -1,
+			},
+			expectedErr: func(e error) (bool, error) {
+				return errors.Is(e, errInvalidConsoleLogRotation), errInvalidConsoleLogRotation
+			},
+			numClosers: 0,
+			stdoutSet:  false,
+		},
+		{
+			name: "unwritable console log",
+			opt: options{
+				ConsoleLog: filepath.Join(dir, "does", "not", "exist"),
+			},
+			expectedErr: func(e error) (bool, error) {
+				// the cause is kept along with the sentinel error
+				return errors.Is(e, errUnableToCreateConsoleLog) && errors.Is(e, fs.ErrNotExist),
+					errUnableToCreateConsoleLog
+			},
+			numClosers: 0,
+			stdoutSet:  false,
+		},
+		{
+			name: "valid console log",
+			opt: options{
+				ConsoleLog: filepath.Join(dir, "console.log"),
+				stdout:     os.Stdout,
+			},
+			expectedErr: func(e error) (bool, error) {
+				return e == nil, nil
+			},
+			numClosers: 1,
+			stdoutSet:  true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.opt.handleConsoleLog()
+			if ok, expected := c.expectedErr(err); !ok {
+				t.Errorf("expected %s but got %s", expected, err)
+			}
+			if len(c.opt.closers) != c.numClosers {
+				t.Errorf("expected to have %d closers but had %d",
+					c.numClosers,
+					len(c.opt.closers))
+			}
+			if (c.opt.stdout != nil) != c.stdoutSet {
+				t.Errorf("expected stdout to be set: %v", c.stdoutSet)
+			}
+			c.opt.Close()
+		})
+	}
+}
+
+func TestConsoleWatchersWithConsoleLogOnly(t *testing.T) {
+	var terminal bytes.Buffer
+	detector := &guestFailureDetector{}
+	runner, err := newScriptRunner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runner.guest.Close()
+	defer runner.input.Close()
+	opts := &options{
+		FcSocketPath:    "valid/path",
+		ConsoleLog:      filepath.Join(t.TempDir(), "console.log"),
+		ConsoleLogOnly:  true,
+		stdout:          &terminal,
+		consoleWatchers: []io.Writer{runner, detector.stream()},
+	}
+	if _, err := opts.getFirecrackerConfig(); err != nil {
+		t.Fatal(err)
+	}
+	output := "login: \nKernel panic - not syncing: Attempted to kill init!\n"
+	if _, err := io.WriteString(opts.stdout, output); err != nil {
+		t.Fatal(err)
+	}
+	opts.Close()
+
+	if terminal.Len() != 0 {
+		t.Errorf("expected nothing to be written to stdout but got %q", terminal.String())
+	}
+	if data, err := os.ReadFile(opts.ConsoleLog); err != nil || string(data) != output {
+		t.Errorf("expected the console log to contain %q but got %q, %v", output, data, err)
+	}
+	if runner.Transcript() != output {
+		t.Errorf("expected the script to see %q but got %q", output, runner.Transcript())
+	}
+	var failure *guestFailureError
+	if !errors.As(detector.failure(), &failure) {
+		t.Errorf("expected the kernel panic to be detected")
+	}
+}
+
 func TestGetFirecrackerNetworkingConfig(t *testing.T) {
 	cases := []struct {
 		name        string
@@ -545,7 +713,7 @@ func TestGetFirecrackerNetworkingConfig(t *testing.T) {
 				FcNicConfig: []string{"invalid"},
 			},
 			expectedErr: func(e error) (bool, error) {
-				return e == errInvalidNicConfig, errInvalidNicConfig
+				return errors.Is(e, errInvalidNicConfig), errInvalidNicConfig
 			},
 			expectedNic: nil,
 		},
@@ -647,11 +815,69 @@ func TestGetBlockDevices(t *testing.T) {
 				FcAdditionalDrives: []string{"ab"},
 			},
 			expectedErr: func(e error) (bool, error) {
-				return e == errInvalidDriveSpecificationNoSuffix,
+				return errors.Is(e, errInvalidDriveSpecificationNoSuffix),
 					errInvalidDriveSpecificationNoSuffix
 			},
 			expectedDrives: nil,
 		},
+		{
+			name: "root device from FcAdditionalDrives",
+			opt: options{
+				FcAdditionalDrives: []string{
+					tempFile.Name() + roDeviceSuffix,
+					tempFile.Name() + rwDeviceSuffix + rootDeviceSuffix,
+				},
+				FcRootPartUUID: "UUID",
+			},
+			expectedErr: func(e error) (bool, error) {
+				return e == nil, nil
+			},
+			expectedDrives: []models.Drive{
+				{
+					DriveID:      firecracker.String("2"),
+					PathOnHost:   firecracker.String(tempFile.Name()),
+					IsReadOnly:   firecracker.Bool(true),
+					IsRootDevice: firecracker.Bool(false),
+				},
+				{
+					DriveID:      firecracker.String("3"),
+					PathOnHost:   firecracker.String(tempFile.Name()),
+					IsReadOnly:   firecracker.Bool(false),
+					IsRootDevice: firecracker.Bool(true),
+					Partuuid:     "UUID",
+				},
+			},
+		},
+		{
+			name: "root device from both FcAdditionalDrives and FcRootDrivePath",
+			opt: options{
+				FcAdditionalDrives: []string{tempFile.Name() + roDeviceSuffix + rootDeviceSuffix},
+				FcRootDrivePath:    tempFile.Name(),
+			},
+			expectedErr: func(e error) (bool, error) {
+				return errors.Is(e, errMultipleRootDrives), errMultipleRootDrives
+			},
+			expectedDrives: nil,
+		},
+		{
+			name: "multiple root devices in FcAdditionalDrives",
+			opt: options{
+				FcAdditionalDrives: []string{
+					tempFile.Name() + roDeviceSuffix + rootDeviceSuffix,
+					tempFile.Name() + rwDeviceSuffix + rootDeviceSuffix,
+				},
+			},
+			expectedErr: func(e error) (bool, error) {
+				return errors.Is(e, errMultipleRootDrives), errMultipleRootDrives
+			},
+			expectedDrives: nil,
+		},
+		{
+			name:           "initrd only boot without drives",
+			opt:            options{FcInitrd: tempFile.Name()},
+			expectedErr:    func(e error) (bool, error) { return e == nil, nil },
+			expectedDrives: []models.Drive{},
+		},
 		{
 			name: "valid FcAdditionalDrives with valid Root drive",
 			opt: options{
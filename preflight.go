@@ -0,0 +1,429 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxVCPUCount is the maximum number of vCPUs supported by firecracker
+const maxVCPUCount = 32
+
+var (
+	// kvmDevicePath is the KVM device firecracker needs access to
+	kvmDevicePath = "/dev/kvm"
+	// netDevicesPath lists the network devices of the host
+	netDevicesPath = "/sys/class/net"
+	// hostMemoryMiB returns the total memory of the host
+	hostMemoryMiB = func() (int64, error) {
+		var info unix.Sysinfo_t
+		if err := unix.Sysinfo(&info); err != nil {
+			return 0, err
+		}
+		return int64(info.Totalram) * int64(info.Unit) >> 20, nil
+	}
+)
+
+// preflightError holds every problem found by the preflight checks
+type preflightError struct {
+	problems []error
+}
+
+func (e *preflightError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "preflight checks found %d problem(s):", len(e.problems))
+	for _, p := range e.problems {
+		fmt.Fprintf(&b, "\n  - %v", p)
+	}
+	return b.String()
+}
+
+func (e *preflightError) Unwrap() []error {
+	return e.problems
+}
+
+// preflight checks the options and the host before anything is set up or
+// launched. Rather than stopping at the first problem, every problem found is
+// reported in a single preflightError.
+func (opts *options) preflight() error {
+	var problems []error
+	problem := func(field, value string, err error) {
+		problems = append(problems, newConfigError(field, value, err))
+	}
+
+	// binaries, the version of the binary run as firecracker is only checked
+	// once it is known to be executable
+	binary, err := opts.firecrackerBinary()
+	if err == nil {
+		err = checkBinary(binary)
+	}
+	if err != nil {
+		binary = ""
+		problems = append(problems, &VMMError{Phase: vmmPhaseBinary, Err: err})
+	}
+	if opts.JailerBinary != "" {
+		if err := checkBinary(opts.JailerBinary); err != nil {
+			problem("jailer", opts.JailerBinary, err)
+		}
+		if opts.ExecFile != "" {
+			binary = opts.ExecFile
+		}
+	}
+	if opts.ExecFile != "" {
+		if err := checkBinary(opts.ExecFile); err != nil {
+			binary = ""
+			problem("exec-file", opts.ExecFile, err)
+		}
+	}
+	if binary != "" && !opts.SkipVersionCheck {
+		problems = append(problems, opts.checkFirecrackerVersion(binary)...)
+	}
+
+	// digests, which are verified once the artifacts are known to exist
+	for _, d := range []struct{ field, digest string }{
+		{"kernel-sha256", opts.KernelSHA256},
+		{"initrd-sha256", opts.InitrdSHA256},
+		{"firecracker-sha256", opts.FirecrackerSHA256},
+		{"jailer-sha256", opts.JailerSHA256},
+	} {
+		if d.digest != "" {
+			if err := checkDigest(strings.ToLower(d.digest)); err != nil {
+				problem(d.field, d.digest, err)
+			}
+		}
+	}
+	if opts.Manifest != "" {
+		if _, err := parseManifest(opts.Manifest); err != nil {
+			problem("manifest", opts.Manifest, err)
+		}
+	}
+
+	// jailer options
+	problems = append(problems, opts.checkJailer()...)
+	if _, err := opts.jailerArgs(); err != nil {
+		problems = append(problems, err)
+	}
+	if opts.JailerBinary == "" {
+		for _, o := range []struct {
+			field string
+			used  bool
+		}{
+			{"cgroup", len(opts.Cgroups) > 0},
+			{"cgroup-version", opts.CgroupVersion != ""},
+			{"parent-cgroup", opts.ParentCgroup != ""},
+			{"resource-limit", len(opts.ResourceLimits) > 0},
+			{"new-pid-ns", opts.NewPidNS},
+		} {
+			if o.used {
+				problem(o.field, "", errJailerOptionNoJailer)
+			}
+		}
+	}
+	if opts.SerialOut != "" && opts.JailerBinary != "" {
+		problem("serial-out", opts.SerialOut, errSerialOutJailer)
+	}
+	if opts.NetNS != "" {
+		if _, err := os.Stat(opts.NetNS); err != nil {
+			problem("netns", opts.NetNS, err)
+		}
+	}
+
+	if opts.Lock != "" {
+		if _, err := readLock(opts.Lock); err != nil {
+			problem("lock", opts.Lock, err)
+		}
+	}
+
+	if err := checkKVM(); err != nil {
+		problems = append(problems, err)
+	}
+
+	// kernel and initrd
+	if err := checkFile(opts.FcKernelImage, unix.R_OK); err != nil {
+		problem("kernel", opts.FcKernelImage, err)
+	} else if err := checkKernelFormat(opts.FcKernelImage, opts.ExtractKernel); err != nil {
+		problem("kernel", opts.FcKernelImage, err)
+	}
+	if opts.FcInitrd != "" {
+		if err := checkFile(opts.FcInitrd, unix.R_OK); err != nil {
+			problem("initrd-path", opts.FcInitrd, err)
+		}
+	}
+	buildInitrd := opts.InitrdFromDir != "" || len(opts.InitrdAdd) > 0
+	if buildInitrd && opts.FcInitrd != "" {
+		problem("initrd-path", opts.FcInitrd, errInitrdConflict)
+	}
+	if opts.InitrdCompress && !buildInitrd {
+		problem("initrd-compress", "", errInitrdCompressNoBuild)
+	}
+	if opts.InitrdFromDir != "" && !checkExistsAndDir(opts.InitrdFromDir) {
+		problem("initrd-from-dir", opts.InitrdFromDir, fmt.Errorf("%s is not a directory", opts.InitrdFromDir))
+	}
+	for _, entry := range opts.InitrdAdd {
+		hostPath, _, err := parseInitrdAdd(entry)
+		if err != nil {
+			problems = append(problems, err)
+		} else if _, err := os.Lstat(hostPath); err != nil {
+			problem("initrd-add", entry, err)
+		}
+	}
+
+	// drives, each path may only be attached once
+	drives := map[string]bool{}
+	checkDrive := func(field, entry, path string, readOnly bool) {
+		if _, digest := splitDigest(entry); digest != "" {
+			if err := checkDigest(strings.ToLower(digest)); err != nil {
+				problem(field, entry, err)
+			}
+		}
+		mode := uint32(unix.R_OK)
+		if !readOnly {
+			mode |= unix.W_OK
+		}
+		if err := checkFile(path, mode); err != nil {
+			problem(field, entry, err)
+		}
+		if drives[filepath.Clean(path)] {
+			problem(field, entry, errDuplicateDrive)
+		}
+		drives[filepath.Clean(path)] = true
+	}
+	hasRoot := opts.FcRootDrivePath != ""
+	if hasRoot {
+		// the guest only writes to the clone of a copy-on-write root drive
+		path, readOnly := parseDevice(opts.FcRootDrivePath)
+		checkDrive("root-drive", opts.FcRootDrivePath, path, readOnly || opts.RootDriveCOW)
+	}
+	if opts.RootDriveCOW && !hasRoot {
+		problem("root-drive-cow", "", errRootDriveCOWNoRoot)
+	}
+	if opts.KeepDisk && !opts.RootDriveCOW {
+		problem("keep-disk", "", errKeepDiskNoCOW)
+	}
+
+	// root drive built at launch
+	buildRoot := opts.RootFromDir != "" || opts.RootFromTar != ""
+	if opts.RootFromDir != "" && opts.RootFromTar != "" {
+		problem("root-from-tar", opts.RootFromTar, errImageSource)
+	}
+	if buildRoot && hasRoot {
+		problem("root-drive", opts.FcRootDrivePath, errRootImageConflict)
+	}
+	if opts.RootFromDir != "" && !checkExistsAndDir(opts.RootFromDir) {
+		problem("root-from-dir", opts.RootFromDir, fmt.Errorf("%s is not a directory", opts.RootFromDir))
+	}
+	if opts.RootFromTar != "" {
+		if err := checkFile(opts.RootFromTar, unix.R_OK); err != nil {
+			problem("root-from-tar", opts.RootFromTar, err)
+		}
+	}
+	if _, err := parseSize(opts.RootSize); err != nil {
+		problem("root-size", opts.RootSize, err)
+	} else if opts.RootSize != "" && !buildRoot {
+		problem("root-size", opts.RootSize, errRootSizeNoBuild)
+	}
+	if buildRoot {
+		field, value := "root-from-dir", opts.RootFromDir
+		if opts.RootFromTar != "" {
+			field, value = "root-from-tar", opts.RootFromTar
+		}
+		for _, tool := range imageTools(opts.RootFromTar) {
+			if _, err := exec.LookPath(tool); err != nil {
+				problem(field, value, fmt.Errorf("%w: %s is required", errUnableToBuildImage, tool))
+			}
+		}
+	}
+	hasRoot = hasRoot || buildRoot
+	for _, entry := range opts.FcAdditionalDrives {
+		path, readOnly, isRoot, err := parseDriveEntry(entry)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		checkDrive("add-drive", entry, path, readOnly)
+		if isRoot && hasRoot {
+			problem("add-drive", entry, errMultipleRootDrives)
+		}
+		hasRoot = hasRoot || isRoot
+	}
+	for _, entry := range opts.ScratchDisks {
+		disk, err := parseScratchDisk(entry)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if disk.fs != "" {
+			if _, err := exec.LookPath(mke2fsBinary); err != nil {
+				problem("scratch-disk", entry, fmt.Errorf("%w: %s is required", errUnableToCreateScratchDisk, mke2fsBinary))
+			}
+		}
+	}
+	for _, entry := range opts.Shares {
+		s, err := parseShare(entry)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if !checkExistsAndDir(s.hostDir) {
+			problem("share", entry, fmt.Errorf("%s is not a directory", s.hostDir))
+		}
+		tools := []string{mke2fsBinary}
+		if !s.readOnly {
+			tools = append(tools, debugfsBinary)
+		}
+		for _, tool := range tools {
+			if _, err := exec.LookPath(tool); err != nil {
+				problem("share", entry, fmt.Errorf("%w: %s is required", errUnableToBuildShare, tool))
+			}
+		}
+	}
+	if !hasRoot && opts.FcInitrd == "" && !buildInitrd {
+		problem("root-drive", "", errNoRootFSOrInitrd)
+	}
+	if !hasRoot && opts.FcRootPartUUID != "" {
+		problem("root-partition", opts.FcRootPartUUID, errRootPartitionWithoutRootDrive)
+	}
+
+	// NICs, whose tap devices are in the network namespace given with
+	// --netns rather than on the host when there is one
+	for _, nicConfig := range opts.FcNicConfig {
+		tapDev, _, err := parseNicConfig(nicConfig)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if opts.NetNS != "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(netDevicesPath, tapDev)); err != nil {
+			problem("tap-device", nicConfig, errTapDeviceNotFound)
+		}
+	}
+
+	// vsocks, the socket is created by firecracker in an existing directory
+	vsockPaths := map[string]bool{}
+	vsockCIDs := map[uint32]bool{}
+	for _, entry := range opts.FcVsockDevices {
+		vsocks, err := parseVsocks([]string{entry})
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		vsock := vsocks[0]
+		if !checkExistsAndDir(filepath.Dir(vsock.Path)) {
+			problem("vsock-device", entry, fmt.Errorf("directory of %q does not exist", vsock.Path))
+		} else if _, err := os.Lstat(vsock.Path); err == nil {
+			problem("vsock-device", entry, errVsockPathExists)
+		}
+		if vsockPaths[filepath.Clean(vsock.Path)] {
+			problem("vsock-device", entry, errDuplicateVsockPath)
+		}
+		if vsockCIDs[vsock.CID] {
+			problem("vsock-device", entry, errDuplicateVsockCID)
+		}
+		vsockPaths[filepath.Clean(vsock.Path)] = true
+		vsockCIDs[vsock.CID] = true
+	}
+
+	// machine configuration
+	ncpus := strconv.FormatInt(opts.FcCPUCount, 10)
+	if opts.FcCPUCount < 1 || opts.FcCPUCount > maxVCPUCount {
+		problem("ncpus", ncpus, errInvalidVCPUCount)
+	} else if runtime.GOARCH == "amd64" && !opts.FcDisableSmt && opts.FcCPUCount > 1 && opts.FcCPUCount%2 != 0 {
+		problem("ncpus", ncpus, errOddVCPUCountWithSMT)
+	}
+	memory := strconv.FormatInt(opts.FcMemSz, 10)
+	if opts.FcMemSz < 1 {
+		problem("memory", memory, errInvalidMemorySize)
+	} else if total, err := hostMemoryMiB(); err == nil && opts.FcMemSz > total {
+		problem("memory", memory, fmt.Errorf("%w (%d MiB)", errMemoryExceedsHost, total))
+	}
+
+	if opts.FcMetadata != "" {
+		var metadata interface{}
+		if err := json.Unmarshal([]byte(opts.FcMetadata), &metadata); err != nil {
+			problem("metadata", opts.FcMetadata, fmt.Errorf("%w: %w", errInvalidMetadata, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &preflightError{problems: problems}
+	}
+	return nil
+}
+
+// firecrackerBinary returns the path of the firecracker binary, which is
+// looked up in PATH unless given with --firecracker-binary
+func (opts *options) firecrackerBinary() (string, error) {
+	if len(opts.FcBinary) != 0 {
+		return opts.FcBinary, nil
+	}
+	return exec.LookPath(firecrackerDefaultPath)
+}
+
+// checkBinary returns an error if the binary at path cannot be executed
+func checkBinary(path string) error {
+	finfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Binary %q does not exist: %w", path, err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to stat binary, %q: %w", path, err)
+	}
+
+	if finfo.IsDir() {
+		return fmt.Errorf("Binary, %q, is a directory", path)
+	} else if finfo.Mode()&executableMask == 0 {
+		return fmt.Errorf("Binary, %q, is not executable. Check permissions of binary", path)
+	}
+	return nil
+}
+
+// checkFile returns an error if path does not exist, is a directory or
+// cannot be accessed with mode, a combination of unix.R_OK and unix.W_OK.
+func checkFile(path string, mode uint32) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s %w", path, errIsADirectory)
+	}
+	if err := unix.Access(path, mode); err != nil {
+		return &os.PathError{Op: "access", Path: path, Err: err}
+	}
+	return nil
+}
+
+// checkKVM returns an error unless the KVM device can be opened for reading
+// and writing
+func checkKVM() error {
+	if _, err := os.Stat(kvmDevicePath); err != nil {
+		return &HostError{Err: fmt.Errorf("%w: %w", errKVMUnavailable, err)}
+	}
+	if err := unix.Access(kvmDevicePath, unix.R_OK|unix.W_OK); err != nil {
+		return &HostError{Err: fmt.Errorf("%w: %s cannot be opened for reading and writing: %w", errKVMUnavailable, kvmDevicePath, err)}
+	}
+	return nil
+}
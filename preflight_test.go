@@ -0,0 +1,292 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupPreflight creates a fake host in a temporary directory with a KVM
+// device, a tap device named tap0, a firecracker binary, a kernel and a root
+// drive, and returns options referring to them.
+func setupPreflight(t *testing.T) *options {
+	dir := t.TempDir()
+
+	kvm := filepath.Join(dir, "kvm")
+	net := filepath.Join(dir, "net")
+	for _, path := range []string{
+		kvm,
+		filepath.Join(dir, "rootfs"),
+		filepath.Join(dir, "data"),
+	} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "vmlinux"), supportedKernel(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	firecracker := "#!/bin/sh\necho 'Firecracker v" + SupportedFirecrackerVersion + "'\n"
+	if err := os.WriteFile(filepath.Join(dir, "firecracker"), []byte(firecracker), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(net, "tap0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldKVM, oldNet, oldMemory := kvmDevicePath, netDevicesPath, hostMemoryMiB
+	kvmDevicePath, netDevicesPath = kvm, net
+	hostMemoryMiB = func() (int64, error) {
+		return 4096, nil
+	}
+	t.Cleanup(func() {
+		kvmDevicePath, netDevicesPath, hostMemoryMiB = oldKVM, oldNet, oldMemory
+	})
+
+	return &options{
+		FcBinary:        filepath.Join(dir, "firecracker"),
+		FcKernelImage:   filepath.Join(dir, "vmlinux"),
+		FcRootDrivePath: filepath.Join(dir, "rootfs"),
+		FcCPUCount:      2,
+		FcMemSz:         512,
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	opts := setupPreflight(t)
+	if err := opts.preflight(); err != nil {
+		t.Fatalf("expected no problems but got %v", err)
+	}
+
+	dir := filepath.Dir(opts.FcKernelImage)
+	opts.FcKernelImage = filepath.Join(dir, "missing-vmlinux")
+	opts.FcInitrd = dir
+	opts.FcAdditionalDrives = []string{
+		opts.FcRootDrivePath + rwDeviceSuffix,
+		filepath.Join(dir, "data"),
+	}
+	opts.FcNicConfig = []string{"tap1/06:00:c0:a8:00:02"}
+	opts.FcVsockDevices = []string{
+		filepath.Join(dir, "v.sock") + ":3",
+		filepath.Join(dir, "other.sock") + ":3",
+		filepath.Join(dir, "rootfs") + ":4",
+	}
+	opts.FcCPUCount = 64
+	opts.FcMemSz = 8192
+	opts.FcMetadata = "{ invalid:json"
+	kvmDevicePath = filepath.Join(dir, "missing-kvm")
+
+	err := opts.preflight()
+	var preflight *preflightError
+	if !errors.As(err, &preflight) {
+		t.Fatalf("expected a preflight error but got %v", err)
+	}
+
+	expected := []error{
+		errKVMUnavailable,
+		fs.ErrNotExist,
+		errIsADirectory,
+		errDuplicateDrive,
+		errInvalidDriveSpecificationNoSuffix,
+		errTapDeviceNotFound,
+		errDuplicateVsockCID,
+		errVsockPathExists,
+		errInvalidVCPUCount,
+		errMemoryExceedsHost,
+		errInvalidMetadata,
+	}
+	if len(preflight.problems) != len(expected) {
+		t.Errorf("expected %d problems but got %v", len(expected), err)
+	}
+	for _, e := range expected {
+		if !errors.Is(err, e) {
+			t.Errorf("expected problem %q in %v", e, err)
+		}
+	}
+	if code := exitCode(err, false); code != exitHostError {
+		t.Errorf("expected exit code %d but got %d", exitHostError, code)
+	}
+}
+
+func TestPreflightBinary(t *testing.T) {
+	opts := setupPreflight(t)
+	opts.FcBinary = opts.FcKernelImage
+
+	err := opts.preflight()
+	var vmmErr *VMMError
+	if !errors.As(err, &vmmErr) || vmmErr.Phase != vmmPhaseBinary {
+		t.Fatalf("expected a binary error but got %v", err)
+	}
+	if code := exitCode(err, false); code != exitBinaryNotFound {
+		t.Errorf("expected exit code %d but got %d", exitBinaryNotFound, code)
+	}
+}
+
+func TestPreflightJailerOptions(t *testing.T) {
+	opts := setupPreflight(t)
+	opts.NewPidNS = true
+	opts.CgroupVersion = "2"
+	opts.NetNS = filepath.Join(filepath.Dir(opts.FcKernelImage), "missing-netns")
+
+	err := opts.preflight()
+	var preflight *preflightError
+	if !errors.As(err, &preflight) || len(preflight.problems) != 3 {
+		t.Fatalf("expected 3 problems but got %v", err)
+	}
+	if !errors.Is(err, errJailerOptionNoJailer) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected jailer options and a missing netns to be reported but got %v", err)
+	}
+}
+
+func TestPreflightNetNSTapDevice(t *testing.T) {
+	opts := setupPreflight(t)
+	// the tap device is only in the network namespace
+	opts.NetNS = filepath.Join(filepath.Dir(opts.FcKernelImage), "netns")
+	if err := os.WriteFile(opts.NetNS, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts.FcNicConfig = []string{"tap1/06:00:c0:a8:00:02"}
+	if err := opts.preflight(); err != nil {
+		t.Errorf("expected the tap device not to be looked up on the host but got %v", err)
+	}
+}
+
+func TestPreflightRootFS(t *testing.T) {
+	cases := []struct {
+		name   string
+		setup  func(opts *options)
+		outErr error
+	}{
+		{
+			name: "initrd only",
+			setup: func(opts *options) {
+				opts.FcInitrd, opts.FcRootDrivePath = opts.FcRootDrivePath, ""
+			},
+		},
+		{
+			name: "root device from an additional drive",
+			setup: func(opts *options) {
+				opts.FcAdditionalDrives = []string{opts.FcRootDrivePath + roDeviceSuffix + rootDeviceSuffix}
+				opts.FcRootDrivePath = ""
+			},
+		},
+		{
+			name: "neither root drive nor initrd",
+			setup: func(opts *options) {
+				opts.FcRootDrivePath = ""
+			},
+			outErr: errNoRootFSOrInitrd,
+		},
+		{
+			name: "root partition without root drive",
+			setup: func(opts *options) {
+				opts.FcInitrd, opts.FcRootDrivePath = opts.FcRootDrivePath, ""
+				opts.FcRootPartUUID = "UUID"
+			},
+			outErr: errRootPartitionWithoutRootDrive,
+		},
+		{
+			name: "root drive built from a directory",
+			setup: func(opts *options) {
+				opts.RootFromDir, opts.FcRootDrivePath = filepath.Dir(opts.FcRootDrivePath), ""
+				opts.RootSize = "1G"
+			},
+		},
+		{
+			name: "root drive and root drive built from a directory",
+			setup: func(opts *options) {
+				opts.RootFromDir = filepath.Dir(opts.FcRootDrivePath)
+			},
+			outErr: errRootImageConflict,
+		},
+		{
+			name: "root size without root drive built",
+			setup: func(opts *options) {
+				opts.RootSize = "1G"
+			},
+			outErr: errRootSizeNoBuild,
+		},
+		{
+			name: "copy-on-write read-only root drive",
+			setup: func(opts *options) {
+				if err := os.Chmod(opts.FcRootDrivePath, 0444); err != nil {
+					t.Fatal(err)
+				}
+				opts.RootDriveCOW = true
+			},
+		},
+		{
+			name: "copy-on-write without root drive",
+			setup: func(opts *options) {
+				opts.FcInitrd, opts.FcRootDrivePath = opts.FcRootDrivePath, ""
+				opts.RootDriveCOW = true
+			},
+			outErr: errRootDriveCOWNoRoot,
+		},
+		{
+			name: "keep disk without copy-on-write",
+			setup: func(opts *options) {
+				opts.KeepDisk = true
+			},
+			outErr: errKeepDiskNoCOW,
+		},
+		{
+			name: "two root devices",
+			setup: func(opts *options) {
+				opts.FcAdditionalDrives = []string{filepath.Join(filepath.Dir(opts.FcRootDrivePath), "data") + rwDeviceSuffix + rootDeviceSuffix}
+			},
+			outErr: errMultipleRootDrives,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := setupPreflight(t)
+			c.setup(opts)
+			err := opts.preflight()
+			if c.outErr == nil && err != nil {
+				t.Errorf("expected no problems but got %v", err)
+			}
+			if c.outErr != nil && !errors.Is(err, c.outErr) {
+				t.Errorf("expected %v but got %v", c.outErr, err)
+			}
+		})
+	}
+}
+
+func TestPreflightImageTools(t *testing.T) {
+	// only mke2fs is installed
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, mke2fsBinary), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	opts := setupPreflight(t)
+	opts.RootFromDir, opts.FcRootDrivePath = filepath.Dir(opts.FcRootDrivePath), ""
+	if err := opts.preflight(); err != nil {
+		t.Errorf("expected a root drive to be built from a directory with mke2fs but got %v", err)
+	}
+
+	opts = setupPreflight(t)
+	opts.RootFromTar, opts.FcRootDrivePath = opts.FcRootDrivePath, ""
+	err := opts.preflight()
+	if !errors.Is(err, errUnableToBuildImage) || !strings.Contains(err.Error(), debugfsBinary) {
+		t.Errorf("expected debugfs to be required to build a root drive from a tarball but got %v", err)
+	}
+}
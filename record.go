@@ -0,0 +1,178 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	asciicastVersion = 2
+
+	// size of the recorded terminal when it cannot be determined
+	defaultTerminalWidth  = 80
+	defaultTerminalHeight = 24
+
+	asciicastOutput = "o"
+	asciicastInput  = "i"
+)
+
+// asciicastHeader is the first line of an asciicast v2 file, see
+// https://docs.asciinema.org/manual/asciicast/v2/
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// recorder writes the console session in asciicast v2 format. Each write to
+// one of its streams is recorded as an event along with the time elapsed
+// since the start of the recording.
+type recorder struct {
+	mu    sync.Mutex
+	w     io.WriteCloser
+	start time.Time
+	now   func() time.Time
+}
+
+// newRecorder writes the asciicast header to w and returns a recorder writing
+// events to it.
+func newRecorder(w io.WriteCloser, width, height int, now func() time.Time) (*recorder, error) {
+	start := now()
+	header, err := json.Marshal(asciicastHeader{
+		Version:   asciicastVersion,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     "firectl",
+		Env: map[string]string{
+			"TERM": os.Getenv("TERM"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", header); err != nil {
+		return nil, err
+	}
+
+	return &recorder{
+		w:     w,
+		start: start,
+		now:   now,
+	}, nil
+}
+
+func (r *recorder) event(kind string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elapsed := float64(r.now().Sub(r.start).Microseconds()) / 1e6
+	line, err := json.Marshal([]interface{}{elapsed, kind, string(data)})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.w, "%s\n", line)
+	return err
+}
+
+// output returns a writer recording the console output
+func (r *recorder) output() io.Writer {
+	return &recorderStream{recorder: r, kind: asciicastOutput}
+}
+
+// input returns a writer recording the keystrokes sent to the console
+func (r *recorder) input() io.Writer {
+	return &recorderStream{recorder: r, kind: asciicastInput}
+}
+
+// Close closes the underlying file
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Close()
+}
+
+// recorderStream records the data written to it as events of one kind. Since
+// events are JSON strings, incomplete UTF-8 sequences at the end of a write
+// are held back until the rest of the sequence is written.
+type recorderStream struct {
+	recorder *recorder
+	kind     string
+	pending  []byte
+}
+
+func (s *recorderStream) Write(p []byte) (int, error) {
+	data := append(s.pending, p...)
+	s.pending = nil
+
+	// look for an incomplete multi-byte sequence in the last few bytes
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		c := data[len(data)-i]
+		if !utf8.RuneStart(c) {
+			continue
+		}
+		if c >= utf8.RuneSelf && !utf8.FullRune(data[len(data)-i:]) {
+			s.pending = append([]byte{}, data[len(data)-i:]...)
+			data = data[:len(data)-i]
+		}
+		break
+	}
+
+	if len(data) > 0 {
+		if err := s.recorder.event(s.kind, data); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// terminalSize returns the size of the terminal referred to by f, or the
+// default size if it is not a terminal.
+func terminalSize(f *os.File) (width, height int) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 || ws.Row == 0 {
+		return defaultTerminalWidth, defaultTerminalHeight
+	}
+	return int(ws.Col), int(ws.Row)
+}
+
+// teeInput returns a pipe which yields the data read from in, while copying
+// it to w. The pipe is handed to firecracker as is, so that waiting for the
+// process to exit does not also wait for in to be closed.
+func teeInput(in io.Reader, w io.Writer) (*os.File, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer pw.Close()
+		if _, err := io.Copy(pw, io.TeeReader(in, w)); err != nil {
+			log.Debugf("Stopped copying console input: %v", err)
+		}
+	}()
+	return r, nil
+}
@@ -0,0 +1,106 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopWriteCloser struct {
+	bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestRecorder(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	cases := []struct {
+		name      string
+		output    []string
+		input     []string
+		outEvents [][]interface{}
+	}{
+		{
+			name:   "output and input events",
+			output: []string{"login: "},
+			input:  []string{"root\r"},
+			outEvents: [][]interface{}{
+				{0.5, "o", "login: "},
+				{1.0, "i", "root\r"},
+			},
+		},
+		{
+			name:   "multi-byte sequence split across writes",
+			output: []string{"caf\xc3", "\xa9\r\n"},
+			outEvents: [][]interface{}{
+				{0.5, "o", "caf"},
+				{1.0, "o", "é\r\n"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ticks := 0
+			now := func() time.Time {
+				defer func() { ticks++ }()
+				return start.Add(time.Duration(ticks) * 500 * time.Millisecond)
+			}
+
+			w := &nopWriteCloser{}
+			rec, err := newRecorder(w, 100, 30, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, input := rec.output(), rec.input()
+			for _, o := range c.output {
+				if _, err := output.Write([]byte(o)); err != nil {
+					t.Error(err)
+				}
+			}
+			for _, i := range c.input {
+				if _, err := input.Write([]byte(i)); err != nil {
+					t.Error(err)
+				}
+			}
+
+			lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+			var header asciicastHeader
+			if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+				t.Fatal(err)
+			}
+			if header.Version != 2 || header.Width != 100 || header.Height != 30 ||
+				header.Timestamp != start.Unix() {
+				t.Errorf("unexpected header %+v", header)
+			}
+
+			var events [][]interface{}
+			for _, line := range lines[1:] {
+				var event []interface{}
+				if err := json.Unmarshal([]byte(line), &event); err != nil {
+					t.Fatal(err)
+				}
+				events = append(events, event)
+			}
+			if !reflect.DeepEqual(events, c.outEvents) {
+				t.Errorf("expected events %v but got %v", c.outEvents, events)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultScriptTimeout = 30 * time.Second
+
+	// scriptShutdownTimeout is how long the guest is given to shut down
+	// once the script completed
+	scriptShutdownTimeout = 10 * time.Second
+)
+
+// script commands
+const (
+	scriptTimeout    = "timeout"
+	scriptExpect     = "expect"
+	scriptSend       = "send"
+	scriptSendLine   = "sendline"
+	scriptSleep      = "sleep"
+	scriptCapture    = "capture"
+	scriptEndCapture = "endcapture"
+)
+
+// scriptStep is a single command of a console script
+type scriptStep struct {
+	line    int
+	command string
+	arg     string
+
+	// re is the pattern of expect steps
+	re *regexp.Regexp
+	// duration is the duration of timeout and sleep steps
+	duration time.Duration
+}
+
+// parseScript reads a console script. Each line holds a command followed by
+// its argument, which is the rest of the line. The argument may be given as a
+// double quoted Go string to include leading or trailing spaces and escape
+// sequences such as \r or \x03. Empty lines and lines starting with # are
+// ignored.
+func parseScript(r io.Reader) ([]scriptStep, error) {
+	var steps []scriptStep
+	capturing := false
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		step := scriptStep{line: line, command: text}
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			step.command = text[:i]
+			step.arg = strings.TrimSpace(text[i+1:])
+		}
+		if strings.HasPrefix(step.arg, `"`) {
+			arg, err := strconv.Unquote(step.arg)
+			if err != nil {
+				return nil, fmt.Errorf("script line %d: invalid quoted argument: %w", line, err)
+			}
+			step.arg = arg
+		}
+
+		var err error
+		switch step.command {
+		case scriptTimeout, scriptSleep:
+			step.duration, err = time.ParseDuration(step.arg)
+		case scriptExpect:
+			step.re, err = regexp.Compile(step.arg)
+		case scriptSend, scriptSendLine:
+		case scriptCapture:
+			if step.arg == "" || strings.ContainsAny(step.arg, `/\`) {
+				err = errInvalidCaptureName
+			} else if capturing {
+				err = errNestedCapture
+			}
+			capturing = true
+		case scriptEndCapture:
+			if !capturing {
+				err = errEndCaptureWithoutCapture
+			}
+			capturing = false
+		default:
+			err = fmt.Errorf("unknown command %q", step.command)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("script line %d: %w", line, err)
+		}
+
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if capturing {
+		return nil, errUnterminatedCapture
+	}
+	return steps, nil
+}
+
+// scriptCaptureOutput is the console output captured by a script
+type scriptCaptureOutput struct {
+	name   string
+	output string
+}
+
+// scriptRunner drives the guest console according to a script. The console
+// output must be written to the runner, while the input of the console is
+// read from the guest end of its pipe.
+type scriptRunner struct {
+	mu         sync.Mutex
+	transcript bytes.Buffer
+	updated    chan struct{}
+
+	// guest is the read end of the pipe given to firecracker as its stdin
+	guest *os.File
+	input io.WriteCloser
+
+	// pos is the offset in the transcript from which expect steps search
+	pos      int
+	captures []scriptCaptureOutput
+}
+
+// loadScript reads the console script at path
+func loadScript(path string) ([]scriptStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseScript(f)
+}
+
+func newScriptRunner() (*scriptRunner, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &scriptRunner{
+		updated: make(chan struct{}, 1),
+		guest:   r,
+		input:   w,
+	}, nil
+}
+
+// Write records console output
+func (r *scriptRunner) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	r.transcript.Write(p)
+	r.mu.Unlock()
+
+	select {
+	case r.updated <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Transcript returns the console output seen so far
+func (r *scriptRunner) Transcript() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.transcript.String()
+}
+
+// Captures returns the output captured by the script
+func (r *scriptRunner) Captures() []scriptCaptureOutput {
+	return r.captures
+}
+
+// run executes the script steps in order. It returns a scriptTimeoutError if
+// the output expected by a step does not show up in time.
+func (r *scriptRunner) run(ctx context.Context, steps []scriptStep) error {
+	defer r.input.Close()
+
+	timeout := defaultScriptTimeout
+	captureStart := 0
+	for _, step := range steps {
+		switch step.command {
+		case scriptTimeout:
+			timeout = step.duration
+		case scriptExpect:
+			if err := r.expect(ctx, step, timeout); err != nil {
+				return err
+			}
+		case scriptSend, scriptSendLine:
+			data := step.arg
+			if step.command == scriptSendLine {
+				data += "\n"
+			}
+			if _, err := io.WriteString(r.input, data); err != nil {
+				return fmt.Errorf("script line %d: failed to send input: %w", step.line, err)
+			}
+		case scriptSleep:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(step.duration):
+			}
+		case scriptCapture:
+			r.captures = append(r.captures, scriptCaptureOutput{name: step.arg})
+			captureStart = r.pos
+		case scriptEndCapture:
+			r.mu.Lock()
+			r.captures[len(r.captures)-1].output = string(r.transcript.Bytes()[captureStart:r.pos])
+			r.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// drive runs the script against the machine's console. Once the script
+// completes a clean shutdown is requested, the VMM is stopped if the guest
+// does not shut down in time or if the script fails. The result of the script
+// is sent on the returned channel.
+func (r *scriptRunner) drive(ctx context.Context, m *firecracker.Machine, steps []scriptStep) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		err := r.run(ctx, steps)
+		result <- err
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			log.Printf("Script completed, requesting clean shutdown")
+			if err := m.Shutdown(ctx); err != nil {
+				log.Errorf("An error occurred while shutting down Firecracker VM: %v", err)
+			} else {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(scriptShutdownTimeout):
+					log.Printf("VM did not shut down within %s, forcing shutdown", scriptShutdownTimeout)
+				}
+			}
+		}
+		if err := m.StopVMM(); err != nil {
+			log.Errorf("An error occurred while stopping Firecracker VMM: %v", err)
+		}
+	}()
+	return result
+}
+
+// expect waits for the step's pattern to show up in the output following the
+// previous match.
+func (r *scriptRunner) expect(ctx context.Context, step scriptStep, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		r.mu.Lock()
+		loc := step.re.FindIndex(r.transcript.Bytes()[r.pos:])
+		if loc != nil {
+			r.pos += loc[1]
+		}
+		r.mu.Unlock()
+		if loc != nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("script line %d: VM stopped while waiting for %q", step.line, step.arg)
+		case <-timer.C:
+			return &scriptTimeoutError{line: step.line, pattern: step.arg, timeout: timeout}
+		case <-r.updated:
+		}
+	}
+}
+
+// writeCaptures writes each capture to NAME.txt in dir
+func writeCaptures(dir string, captures []scriptCaptureOutput) error {
+	for _, c := range captures {
+		if err := os.WriteFile(filepath.Join(dir, c.name+".txt"), []byte(c.output), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scriptTimeoutError is returned when expected output did not show up in time
+type scriptTimeoutError struct {
+	line    int
+	pattern string
+	timeout time.Duration
+}
+
+func (e *scriptTimeoutError) Error() string {
+	return fmt.Sprintf("script line %d: timed out after %s waiting for %q", e.line, e.timeout, e.pattern)
+}
@@ -0,0 +1,159 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScript(t *testing.T) {
+	cases := []struct {
+		name        string
+		in          string
+		outCommands []string
+		outArgs     []string
+		expectedErr func(error) bool
+	}{
+		{
+			name: "valid script",
+			in: strings.Join([]string{
+				"# log in",
+				"timeout 1m",
+				"expect login:",
+				"",
+				`sendline "root"`,
+				`send "\x03"`,
+				"capture uname",
+				"endcapture",
+			}, "\n"),
+			outCommands: []string{"timeout", "expect", "sendline", "send", "capture", "endcapture"},
+			outArgs:     []string{"1m", "login:", "root", "\x03", "uname", ""},
+			expectedErr: func(e error) bool {
+				return e == nil
+			},
+		},
+		{
+			name: "unknown command",
+			in:   "wait login:",
+			expectedErr: func(e error) bool {
+				return e != nil && strings.HasPrefix(e.Error(), "script line 1: unknown command")
+			},
+		},
+		{
+			name: "invalid regexp",
+			in:   "expect (",
+			expectedErr: func(e error) bool {
+				return e != nil && strings.HasPrefix(e.Error(), "script line 1:")
+			},
+		},
+		{
+			name: "invalid quoted argument",
+			in:   `send "unterminated`,
+			expectedErr: func(e error) bool {
+				return e != nil && strings.HasPrefix(e.Error(), "script line 1: invalid quoted argument")
+			},
+		},
+		{
+			name: "nested capture",
+			in:   "capture a\ncapture b",
+			expectedErr: func(e error) bool {
+				return e != nil && strings.HasSuffix(e.Error(), errNestedCapture.Error())
+			},
+		},
+		{
+			name: "unterminated capture",
+			in:   "capture a",
+			expectedErr: func(e error) bool {
+				return e == errUnterminatedCapture
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			steps, err := parseScript(strings.NewReader(c.in))
+			if !c.expectedErr(err) {
+				t.Errorf("did not get the expected err but received %v", err)
+			}
+			if len(steps) != len(c.outCommands) {
+				t.Fatalf("expected %d steps but got %d", len(c.outCommands), len(steps))
+			}
+			for i, step := range steps {
+				if step.command != c.outCommands[i] || step.arg != c.outArgs[i] {
+					t.Errorf("expected step %q %q but got %q %q",
+						c.outCommands[i],
+						c.outArgs[i],
+						step.command,
+						step.arg)
+				}
+			}
+		})
+	}
+}
+
+func TestScriptRunner(t *testing.T) {
+	script := strings.Join([]string{
+		"timeout 1s",
+		"expect login:",
+		"sendline root",
+		"expect # $",
+		"capture uname",
+		"sendline uname",
+		"expect # $",
+		"endcapture",
+		"expect never",
+	}, "\n")
+	steps, err := parseScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner, err := newScriptRunner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fake guest answering the commands sent by the script
+	go func() {
+		runner.Write([]byte("\r\nlogin: "))
+		input := bufio.NewScanner(runner.guest)
+		for input.Scan() {
+			switch input.Text() {
+			case "root":
+				runner.Write([]byte("\r\n# "))
+			case "uname":
+				runner.Write([]byte("uname\r\nLinux\r\n# "))
+			}
+		}
+	}()
+
+	err = runner.run(context.Background(), steps)
+	var timeoutErr *scriptTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.line != 9 || timeoutErr.timeout != time.Second {
+		t.Errorf("expected timeout on line 9 but got %v", err)
+	}
+
+	captures := runner.Captures()
+	if len(captures) != 1 || captures[0].name != "uname" || captures[0].output != "uname\r\nLinux\r\n# " {
+		t.Errorf("unexpected captures %+v", captures)
+	}
+	if !strings.HasSuffix(runner.Transcript(), "Linux\r\n# ") {
+		t.Errorf("unexpected transcript %q", runner.Transcript())
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// setSerialOutputHandlerName is the name of the handler setting the file the
+// guest serial console is written to
+const setSerialOutputHandlerName = "firectl.SetSerialOutput"
+
+// serialOutputHandler returns a handler making firecracker write the guest
+// serial console to the file at path. Firecracker writes to an existing file,
+// which is created empty. The serial API is newer than the SDK, so it is
+// called directly.
+func serialOutputHandler(path string) firecracker.Handler {
+	return firecracker.Handler{
+		Name: setSerialOutputHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			path, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			return putFirecrackerAPI(ctx, m.Cfg.SocketPath, "/serial", struct {
+				SerialOutPath string `json:"serial_out_path"`
+			}{path})
+		},
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+func TestSerialOutputHandler(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "firecracker.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotPath, gotBody string
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(body)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	serial := filepath.Join(dir, "serial.out")
+	if err := os.WriteFile(serial, []byte("previous run"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := &firecracker.Machine{Cfg: firecracker.Config{SocketPath: socketPath}}
+	if err := serialOutputHandler(serial).Fn(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"serial_out_path":"` + serial + `"}`; gotPath != "/serial" || gotBody != expected {
+		t.Errorf("expected PUT /serial %s but got %s %s", expected, gotPath, gotBody)
+	}
+	if info, err := os.Stat(serial); err != nil || info.Size() != 0 {
+		t.Errorf("expected the serial output file to be created empty: %v", err)
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// shareLabelPrefix prefixes the filesystem label of the image of each
+	// share, followed by its index
+	shareLabelPrefix = "firectl-share"
+	// shareKernelParam tells the guest where to mount each share, as
+	// LABEL:GUEST:ro or LABEL:GUEST:rw
+	shareKernelParam = "firectl.share"
+)
+
+// share is a host directory shared with the guest through a generated image
+type share struct {
+	hostDir   string
+	guestPath string
+	readOnly  bool
+}
+
+// parseShare parses a share of the form HOST:GUEST, optionally suffixed with
+// :ro or :rw. Shares are read-only by default.
+func parseShare(entry string) (share, error) {
+	s := share{readOnly: true}
+	spec := entry
+	if strings.HasSuffix(spec, rwDeviceSuffix) {
+		s.readOnly = false
+		spec = strings.TrimSuffix(spec, rwDeviceSuffix)
+	} else {
+		spec = strings.TrimSuffix(spec, roDeviceSuffix)
+	}
+
+	i := strings.LastIndex(spec, ":")
+	if i <= 0 || !path.IsAbs(spec[i+1:]) {
+		return share{}, newConfigError("share", entry, errInvalidShare)
+	}
+	s.hostDir, s.guestPath = spec[:i], path.Clean(spec[i+1:])
+	return s, nil
+}
+
+// fileState is the state of a file of a share when its image was built
+type fileState struct {
+	size   int64
+	digest string
+}
+
+// snapshotDir records the size and digest of the regular files in dir, by
+// path relative to dir
+func snapshotDir(dir string) (map[string]fileState, error) {
+	var rels, paths []string
+	var sizes []int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rels, paths, sizes = append(rels, rel), append(paths, p), append(sizes, info.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	digests, errs := hashFiles(paths)
+	snapshot := make(map[string]fileState, len(rels))
+	for i, rel := range rels {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		snapshot[rel] = fileState{size: sizes[i], digest: digests[i]}
+	}
+	return snapshot, nil
+}
+
+// buildShares builds an image of each directory given with --share, attaches
+// it as a drive and tells the guest where to mount it on the kernel command
+// line. On exit, the files changed in read-write shares are copied back to
+// the host and the images are removed.
+func (opts *options) buildShares() error {
+	if len(opts.Shares) == 0 {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "firectl-share-")
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUnableToBuildShare, err)
+	}
+
+	type syncBack struct {
+		share    share
+		image    string
+		snapshot map[string]fileState
+	}
+	var syncs []syncBack
+	// the microVM has exited when the closers run, so the images are
+	// consistent
+	opts.addCloser(func() error {
+		for _, s := range syncs {
+			if err := syncShare(s.image, s.share.hostDir, s.snapshot); err != nil {
+				log.Errorf("Failed to sync the share %s back: %v", s.share.hostDir, err)
+			}
+		}
+		return os.RemoveAll(dir)
+	})
+
+	params := []string{opts.FcKernelCmdLine}
+	for i, entry := range opts.Shares {
+		s, err := parseShare(entry)
+		if err != nil {
+			return err
+		}
+		label := fmt.Sprintf("%s%d", shareLabelPrefix, i)
+		image := filepath.Join(dir, label+".ext4")
+
+		var snapshot map[string]fileState
+		if !s.readOnly {
+			if snapshot, err = snapshotDir(s.hostDir); err != nil {
+				return fmt.Errorf("%w: %s: %w", errUnableToBuildShare, entry, err)
+			}
+		}
+		if err := buildExt4Image(s.hostDir, "", 0, label, image); err != nil {
+			return fmt.Errorf("%w: %s: %w", errUnableToBuildShare, entry, err)
+		}
+		if !s.readOnly {
+			syncs = append(syncs, syncBack{share: s, image: image, snapshot: snapshot})
+		}
+
+		mode, suffix := "ro", roDeviceSuffix
+		if !s.readOnly {
+			mode, suffix = "rw", rwDeviceSuffix
+		}
+		opts.FcAdditionalDrives = append(opts.FcAdditionalDrives, image+suffix)
+		param, err := kernelParam(fmt.Sprintf("%s=%s:%s:%s", shareKernelParam, label, s.guestPath, mode))
+		if err != nil {
+			return newConfigError("share", entry, err)
+		}
+		params = append(params, param)
+		log.Debugf("Built image %s of share %s", image, entry)
+		opts.addCreatedFile(image)
+	}
+	opts.FcKernelCmdLine = strings.Join(params, " ")
+	return nil
+}
+
+// syncShare copies the files of the image which were added or changed since
+// snapshot back to hostDir. Files deleted in the image are left in hostDir,
+// and so are host directories the guest replaced. Nothing is written outside
+// of hostDir: paths leading through a host symlink and symlinks pointing out
+// of the share are skipped.
+func syncShare(image, hostDir string, snapshot map[string]fileState) error {
+	dump, err := os.MkdirTemp("", "firectl-share-dump-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dump)
+	if err := dumpImage(image, dump, hostDir); err != nil {
+		return err
+	}
+
+	synced := 0
+	skip := func(rel string, reason interface{}) {
+		log.Warnf("Not syncing %s back to %s: %v", rel, hostDir, reason)
+	}
+	err = filepath.WalkDir(dump, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dump, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if rel == "lost+found" {
+			return filepath.SkipDir
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target, existing, err := shareTarget(hostDir, rel)
+		if err != nil {
+			skip(rel, err)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case d.IsDir():
+			if existing == nil {
+				return os.Mkdir(target, info.Mode().Perm())
+			}
+			if !existing.IsDir() {
+				skip(rel, "it is a directory in the guest but not on the host")
+				return filepath.SkipDir
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if filepath.IsAbs(link) || !filepath.IsLocal(filepath.Join(filepath.Dir(rel), link)) {
+				skip(rel, fmt.Errorf("%w: it links to %s", errShareEscape, link))
+				return nil
+			}
+			if existing != nil {
+				if current, err := os.Readlink(target); err == nil && current == link {
+					return nil
+				}
+				if existing.IsDir() {
+					skip(rel, "it is a directory on the host")
+					return nil
+				}
+				if err := os.Remove(target); err != nil {
+					return err
+				}
+			}
+			synced++
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			if existing != nil && existing.IsDir() {
+				skip(rel, "it is a directory on the host")
+				return nil
+			}
+			if state, ok := snapshot[rel]; ok && state.size == info.Size() {
+				digest, err := fileSHA256(p)
+				if err != nil {
+					return err
+				}
+				if digest == state.digest {
+					return nil
+				}
+			}
+			synced++
+			return copyFile(p, target, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Synced %d changed files back to %s", synced, hostDir)
+	return nil
+}
+
+// dumpImage dumps the content of image into the directory dump with debugfs.
+// When firectl runs as root, debugfs runs as the owner of hostDir, so that
+// the image written by the guest is not parsed as root and the dumped files
+// do not get the owners and modes chosen in the guest.
+func dumpImage(image, dump, hostDir string) error {
+	cmd := exec.Command(debugfsBinary, "-R", fmt.Sprintf("rdump / \"%s\"", dump), image)
+	if os.Geteuid() == 0 {
+		info, err := os.Stat(hostDir)
+		if err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+			if err := os.Chown(dump, int(stat.Uid), int(stat.Gid)); err != nil {
+				return err
+			}
+			// the directory of the image is only accessible to root, so
+			// the image is passed open
+			f, err := os.Open(image)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			cmd.ExtraFiles = []*os.File{f}
+			cmd.Args[len(cmd.Args)-1] = "/proc/self/fd/3"
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Credential: &syscall.Credential{Uid: stat.Uid, Gid: stat.Gid},
+			}
+		}
+	}
+	return runToolCommand(cmd)
+}
+
+// shareTarget returns the host path of the file rel of the share at hostDir
+// and its current state, nil if it does not exist. Paths which are not local
+// or lead through anything but a directory, such as a symlink, are refused.
+func shareTarget(hostDir, rel string) (string, fs.FileInfo, error) {
+	if !filepath.IsLocal(rel) {
+		return "", nil, fmt.Errorf("%w: %s", errShareEscape, rel)
+	}
+	dir := hostDir
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return "", nil, err
+		}
+		if !info.IsDir() {
+			return "", nil, fmt.Errorf("%w: %s is not a directory", errShareEscape, dir)
+		}
+	}
+	target := filepath.Join(hostDir, rel)
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return target, nil, nil
+	}
+	return target, info, err
+}
+
+// copyFile replaces target with a copy of the file at p, with the mode and
+// modification time of info
+func copyFile(p, target string, info fs.FileInfo) error {
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// the copy is renamed over target once complete
+	out, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	mtime := info.ModTime()
+	if err := os.Chtimes(out.Name(), time.Now(), mtime); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), target)
+}
@@ -0,0 +1,189 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseShare(t *testing.T) {
+	cases := []struct {
+		in     string
+		out    share
+		outErr error
+	}{
+		{in: "./src:/mnt/src", out: share{hostDir: "./src", guestPath: "/mnt/src", readOnly: true}},
+		{in: "./src:/mnt/src:ro", out: share{hostDir: "./src", guestPath: "/mnt/src", readOnly: true}},
+		{in: "./src:/mnt/src/:rw", out: share{hostDir: "./src", guestPath: "/mnt/src"}},
+		{in: "/a:b:/mnt", out: share{hostDir: "/a:b", guestPath: "/mnt", readOnly: true}},
+		{in: "./src", outErr: errInvalidShare},
+		{in: "./src:mnt/src", outErr: errInvalidShare},
+		{in: ":/mnt/src:rw", outErr: errInvalidShare},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			s, err := parseShare(c.in)
+			if s != c.out || !errors.Is(err, c.outErr) {
+				t.Errorf("expected %+v, %v but got %+v, %v", c.out, c.outErr, s, err)
+			}
+		})
+	}
+}
+
+func TestBuildShares(t *testing.T) {
+	for _, tool := range []string{mke2fsBinary, debugfsBinary} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %v", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"a.txt": "a", "sub/b.txt": "b"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &options{
+		FcKernelCmdLine: "console=ttyS0",
+		Shares:          []string{src + ":/mnt/src:rw"},
+	}
+	defer opts.Close()
+	if err := opts.buildShares(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedCmdLine := "console=ttyS0 firectl.share=firectl-share0:/mnt/src:rw"
+	if opts.FcKernelCmdLine != expectedCmdLine {
+		t.Errorf("expected kernel command line %q but got %q", expectedCmdLine, opts.FcKernelCmdLine)
+	}
+	if len(opts.FcAdditionalDrives) != 1 {
+		t.Fatalf("expected the share to be attached but got %v", opts.FcAdditionalDrives)
+	}
+	image, readOnly, _, err := parseDriveEntry(opts.FcAdditionalDrives[0])
+	if err != nil || readOnly {
+		t.Fatalf("expected a read-write drive but got %q, %v", opts.FcAdditionalDrives[0], err)
+	}
+
+	// change the share as the guest would
+	changed := filepath.Join(dir, "changed")
+	if err := os.WriteFile(changed, []byte("changed in the guest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "rm /a.txt\nwrite " + changed + " /a.txt\nwrite " + changed + " /sub/new.txt\n"
+	cmd := exec.Command(debugfsBinary, "-w", "-f", "-", image)
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	opts.Close()
+	for name, expected := range map[string]string{
+		"a.txt":       "changed in the guest",
+		"sub/b.txt":   "b",
+		"sub/new.txt": "changed in the guest",
+	} {
+		content, err := os.ReadFile(filepath.Join(src, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("expected %s to contain %q but got %q, %v", name, expected, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(src, "lost+found")); !os.IsNotExist(err) {
+		t.Errorf("expected lost+found not to be synced back")
+	}
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Errorf("expected the image to be removed on close")
+	}
+}
+
+func TestSyncShareEscapes(t *testing.T) {
+	for _, tool := range []string{mke2fsBinary, debugfsBinary} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is required: %v", tool, err)
+		}
+	}
+
+	dir := t.TempDir()
+	src, outside := filepath.Join(dir, "src"), filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(src, "sub"), filepath.Join(src, "kept"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"same.txt", "kept/file.txt"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte("host"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot, err := snapshotDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(dir, "share.ext4")
+	if err := buildExt4Image(src, "", 0, "share", image); err != nil {
+		t.Fatal(err)
+	}
+
+	// the guest changes a file keeping its size, replaces a directory with
+	// a symlink and adds links out of the share, while a directory of the
+	// share is replaced with a symlink to outside of it on the host
+	changed := filepath.Join(dir, "changed")
+	if err := os.WriteFile(changed, []byte("gues"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "rm /same.txt\nwrite " + changed + " /same.txt\nwrite " + changed + " /sub/new.txt\n" +
+		"rm /kept/file.txt\nrmdir /kept\nsymlink /kept sub\n" +
+		"symlink /absolute /etc/passwd\nsymlink /relative ../outside\nsymlink /inside sub/new.txt\n"
+	cmd := exec.Command(debugfsBinary, "-w", "-f", "-", image)
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if err := os.RemoveAll(filepath.Join(src, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(src, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncShare(image, src, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(src, "same.txt")); err != nil || string(content) != "gues" {
+		t.Errorf("expected a change of the same size to be synced but got %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written through a host symlink but got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(src, "kept", "file.txt")); err != nil {
+		t.Errorf("expected a directory replaced in the guest to be kept: %v", err)
+	}
+	for _, name := range []string{"absolute", "relative"} {
+		if _, err := os.Lstat(filepath.Join(src, name)); !os.IsNotExist(err) {
+			t.Errorf("expected the symlink %s leaving the share to be skipped but got %v", name, err)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(src, "inside")); err != nil || link != "sub/new.txt" {
+		t.Errorf("expected the symlink within the share to be synced but got %q, %v", link, err)
+	}
+}
@@ -13,8 +13,166 @@
 
 package main
 
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
 // Version represents the major, minor, and patch version of FireCTL.
 const Version = "0.2.0"
 
 // SupportedFirecrackerVersion is the firecracker version that the sdk supports
 const SupportedFirecrackerVersion = "1.0.0"
+
+// The range of firecracker versions firectl runs, from minFirecrackerVersion
+// up to, but excluding, maxFirecrackerVersion. Versions from
+// untestedFirecrackerVersion on have not been tested with firectl yet and are
+// run with a warning.
+const (
+	minFirecrackerVersion      = "1.0.0"
+	untestedFirecrackerVersion = "1.14.0"
+	maxFirecrackerVersion      = "2.0.0"
+)
+
+// firecrackerFeature is a feature which requires a given firecracker version.
+// Features are checked even when an unsupported version is allowed to run.
+type firecrackerFeature struct {
+	// option is the option enabling the feature
+	option      string
+	description string
+	since       string
+	used        func(opts *options) bool
+}
+
+var firecrackerFeatures = []firecrackerFeature{
+	{
+		option:      "mmds-version",
+		description: "MMDS version 2",
+		since:       "1.0.0",
+		used: func(opts *options) bool {
+			return opts.MmdsVersion == string(firecracker.MMDSv2)
+		},
+	},
+	{
+		option:      "io-engine",
+		description: "the io_uring block device engine",
+		since:       "1.0.0",
+		used: func(opts *options) bool {
+			return opts.IoEngine == ioEngineAsync
+		},
+	},
+	{
+		option:      "entropy-device",
+		description: "the entropy device",
+		since:       "1.4.0",
+		used: func(opts *options) bool {
+			return opts.EntropyDevice
+		},
+	},
+	{
+		option:      "serial-out",
+		description: "the serial output file",
+		since:       "1.13.0",
+		used: func(opts *options) bool {
+			return opts.SerialOut != ""
+		},
+	},
+}
+
+// firecrackerVersionPattern matches the version reported by
+// firecracker --version, such as "Firecracker v1.0.0"
+var firecrackerVersionPattern = regexp.MustCompile(`v(\d+\.\d+\.\d+)`)
+
+// firecrackerVersion runs the firecracker binary with --version and returns
+// the version it reports, without the leading v.
+func firecrackerVersion(binary string) (string, error) {
+	out, err := exec.Command(binary, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	m := firecrackerVersionPattern.FindSubmatch(out)
+	if m == nil {
+		line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		return "", fmt.Errorf("unexpected output of %s --version: %q", binary, line)
+	}
+	return string(m[1]), nil
+}
+
+// compareVersions compares two versions of the form MAJOR.MINOR.PATCH,
+// returning -1, 0 or 1. Missing or invalid numbers are treated as 0.
+func compareVersions(a, b string) int {
+	parse := func(version string) [3]int {
+		var v [3]int
+		for i, field := range strings.SplitN(strings.TrimPrefix(version, "v"), ".", len(v)) {
+			v[i], _ = strconv.Atoi(field)
+		}
+		return v
+	}
+
+	va, vb := parse(a), parse(b)
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkVersionSupported returns an error if firecracker version is outside of
+// the supported range
+func checkVersionSupported(version string) error {
+	if compareVersions(version, minFirecrackerVersion) < 0 || compareVersions(version, maxFirecrackerVersion) >= 0 {
+		return fmt.Errorf("%w: version %s is not in the supported range [%s, %s)",
+			errUnsupportedFirecracker, version, minFirecrackerVersion, maxFirecrackerVersion)
+	}
+	return nil
+}
+
+// checkVersionTested returns an error if firecracker version is newer than the
+// versions firectl is tested with
+func checkVersionTested(version string) error {
+	if compareVersions(version, untestedFirecrackerVersion) >= 0 {
+		return fmt.Errorf("%w: version %s is newer than the tested range [%s, %s)",
+			errUntestedFirecracker, version, minFirecrackerVersion, untestedFirecrackerVersion)
+	}
+	return nil
+}
+
+// checkFirecrackerVersion detects the version of the firecracker binary and
+// returns a problem if it is not supported, or if it does not support one of
+// the features enabled by the options.
+func (opts *options) checkFirecrackerVersion(binary string) []error {
+	version, err := firecrackerVersion(binary)
+	if err != nil {
+		return []error{&VMMError{Phase: vmmPhaseBinary, Err: err}}
+	}
+	log.Debugf("Detected firecracker version %s", version)
+
+	if err := checkVersionSupported(version); err != nil {
+		if !opts.AllowUnsupported {
+			return []error{newConfigError("firecracker-binary", binary, err)}
+		}
+		log.Warnf("Running unsupported firecracker: %v", err)
+	} else if err := checkVersionTested(version); err != nil {
+		log.Warnf("Running untested firecracker: %v", err)
+	}
+
+	var problems []error
+	for _, f := range firecrackerFeatures {
+		if f.used(opts) && compareVersions(version, f.since) < 0 {
+			problems = append(problems, newConfigError(f.option, "",
+				fmt.Errorf("%w: %s requires firecracker %s or later, %s is version %s",
+					errUnsupportedFeature, f.description, f.since, binary, version)))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,159 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFirecrackerVersion(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "firecracker")
+	script := "#!/bin/sh\necho 'Firecracker v1.0.0'\necho\necho 'Supported snapshot data format versions: v1.0.0'\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := firecrackerVersion(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.0.0" {
+		t.Errorf("expected version 1.0.0 but got %q", version)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		out  int
+	}{
+		{a: "1.0.0", b: "1.0.0", out: 0},
+		{a: "v1.4.1", b: "1.4.0", out: 1},
+		{a: "1.3.9", b: "1.4.0", out: -1},
+		{a: "1.10.0", b: "1.9.0", out: 1},
+		{a: "0.25.2", b: "1.0.0", out: -1},
+	}
+	for _, c := range cases {
+		if out := compareVersions(c.a, c.b); out != c.out {
+			t.Errorf("expected %d comparing %s to %s but got %d", c.out, c.a, c.b, out)
+		}
+	}
+}
+
+func TestCheckVersionTested(t *testing.T) {
+	cases := []struct {
+		version string
+		outErr  error
+	}{
+		{version: "1.0.0"},
+		{version: "1.7.0"},
+		{version: "1.13.1"},
+		{version: "1.14.0", outErr: errUntestedFirecracker},
+		{version: "1.20.3", outErr: errUntestedFirecracker},
+	}
+	for _, c := range cases {
+		if err := checkVersionTested(c.version); !errors.Is(err, c.outErr) {
+			t.Errorf("expected %v for version %s but got %v", c.outErr, c.version, err)
+		}
+	}
+}
+
+func TestCheckFirecrackerVersion(t *testing.T) {
+	cases := []struct {
+		name    string
+		version string
+		opts    *options
+		outErrs []error
+	}{
+		{
+			name:    "supported",
+			version: "1.0.0",
+			opts:    &options{MmdsVersion: "V2", IoEngine: ioEngineAsync},
+		},
+		{
+			name:    "newer minor",
+			version: "1.7.0",
+			opts:    &options{EntropyDevice: true},
+		},
+		{
+			name:    "too old",
+			version: "0.25.2",
+			opts:    &options{},
+			outErrs: []error{errUnsupportedFirecracker},
+		},
+		{
+			name:    "next major",
+			version: "2.0.0",
+			opts:    &options{},
+			outErrs: []error{errUnsupportedFirecracker},
+		},
+		{
+			name:    "too old but allowed",
+			version: "0.25.2",
+			opts:    &options{AllowUnsupported: true},
+		},
+		{
+			name:    "MMDS version 2 unsupported",
+			version: "0.25.2",
+			opts:    &options{AllowUnsupported: true, MmdsVersion: "V2"},
+			outErrs: []error{errUnsupportedFeature},
+		},
+		{
+			name:    "io_uring unsupported",
+			version: "0.25.2",
+			opts:    &options{AllowUnsupported: true, IoEngine: ioEngineAsync},
+			outErrs: []error{errUnsupportedFeature},
+		},
+		{
+			name:    "entropy device unsupported",
+			version: "1.3.0",
+			opts:    &options{EntropyDevice: true},
+			outErrs: []error{errUnsupportedFeature},
+		},
+		{
+			name:    "serial output unsupported",
+			version: "1.12.1",
+			opts:    &options{SerialOut: "serial.out"},
+			outErrs: []error{errUnsupportedFeature},
+		},
+		{
+			name:    "serial output",
+			version: "1.13.0",
+			opts:    &options{SerialOut: "serial.out"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			binary := filepath.Join(t.TempDir(), "firecracker")
+			script := "#!/bin/sh\necho 'Firecracker v" + c.version + "'\n"
+			if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			problems := c.opts.checkFirecrackerVersion(binary)
+			if len(problems) != len(c.outErrs) {
+				t.Fatalf("expected %d problems but got %v", len(c.outErrs), problems)
+			}
+			for i, err := range c.outErrs {
+				var configErr *ConfigError
+				if !errors.Is(problems[i], err) || !errors.As(problems[i], &configErr) {
+					t.Errorf("expected a config error wrapping %v but got %v", err, problems[i])
+				}
+			}
+		})
+	}
+}